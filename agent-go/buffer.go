@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sampleQueue is a bounded FIFO of unsent samples. When full the oldest sample
+// is discarded so the most recent history survives a long outage.
+type sampleQueue struct {
+	mu      sync.Mutex
+	buf     []queuedMsg
+	head    int
+	n       int
+	next    uint64
+	dropped uint64
+}
+
+// queuedMsg tags a sample with its position in the push order, so a pop can
+// tell whether the head it peeked was evicted in the meantime.
+type queuedMsg struct {
+	Msg
+	id uint64
+}
+
+func newSampleQueue(capacity int) *sampleQueue {
+	if capacity <= 0 {
+		return nil
+	}
+	return &sampleQueue{buf: make([]queuedMsg, capacity)}
+}
+
+func (q *sampleQueue) push(m Msg) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n == len(q.buf) {
+		q.head = (q.head + 1) % len(q.buf)
+		q.n--
+		q.dropped++
+	}
+	q.next++
+	q.buf[(q.head+q.n)%len(q.buf)] = queuedMsg{Msg: m, id: q.next}
+	q.n++
+}
+
+func (q *sampleQueue) peek() (queuedMsg, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n == 0 {
+		return queuedMsg{}, false
+	}
+	return q.buf[q.head], true
+}
+
+// pop removes the head if it is still the sample with the given id; callers
+// peek first and pop only once the sample is sent.
+func (q *sampleQueue) pop(id uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n == 0 || q.buf[q.head].id != id {
+		return
+	}
+	q.buf[q.head] = queuedMsg{}
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+}
+
+func (q *sampleQueue) stats() (queued int, dropped uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n, q.dropped
+}
+
+// watchHealth polls the controller health endpoint and flips the emitter
+// between live sending and buffering. Without a URL it falls back to retrying
+// the oldest buffered sample, which only notices outages that surface as write
+// errors (ICMP port unreachable on the connected socket).
+func (e *emitter) watchHealth(ctx context.Context, url string, every time.Duration) {
+	client := &http.Client{Timeout: every}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		healthy := false
+		if url != "" {
+			resp, err := client.Get(url)
+			if err == nil {
+				healthy = resp.StatusCode >= 200 && resp.StatusCode < 300
+				resp.Body.Close()
+			}
+		} else if queued, _ := e.queue.stats(); e.down.Load() && queued > 0 {
+			healthy = e.sendBuffered()
+		} else {
+			healthy = true
+		}
+
+		if !healthy {
+			if !e.down.Swap(true) {
+				log.Printf("controller unavailable, buffering samples")
+			}
+			continue
+		}
+		if e.down.Swap(false) {
+			queued, dropped := e.queue.stats()
+			log.Printf("controller back, backfilling %d samples (%d dropped while down)", queued, dropped)
+		}
+		if e.draining.CompareAndSwap(false, true) {
+			go func() {
+				defer e.draining.Store(false)
+				e.drain(ctx)
+			}()
+		}
+	}
+}
+
+// drain replays buffered samples with their original timestamps, flagged as
+// backfill so the controller only writes them to history. It paces itself to
+// backfillRate per device so no device trips the controller's rate limiter.
+func (e *emitter) drain(ctx context.Context) {
+	wait := e.backfillWait()
+	for !e.down.Load() {
+		if !e.sendBuffered() {
+			return
+		}
+		if !sleepCtx(ctx, wait) {
+			return
+		}
+	}
+}
+
+// backfillWait spaces backfilled sends so the queue, which interleaves every
+// device's samples, drains at backfillRate msgs/s per device.
+func (e *emitter) backfillWait() time.Duration {
+	if e.backfillRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / (e.backfillRate * float64(max(e.devices, 1))))
+}
+
+// sendBuffered writes the oldest queued sample and reports whether there was
+// one and it went out. A failed write marks the controller down. Sends are
+// serialised so the drainer and the health probe never replay the same head.
+func (e *emitter) sendBuffered() bool {
+	e.backfillMu.Lock()
+	defer e.backfillMu.Unlock()
+	m, ok := e.queue.peek()
+	if !ok {
+		return false
+	}
+	m.Backfill = true
+	if err := e.write(m.Msg); err != nil {
+		e.down.Store(true)
+		return false
+	}
+	e.queue.pop(m.id)
+	e.backfilled.Add(1)
+	return true
+}
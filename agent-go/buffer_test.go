@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// udpEmitter returns an emitter writing to a local listener, and the listener.
+func udpEmitter(t *testing.T, capacity int) (*emitter, *net.UDPConn) {
+	t.Helper()
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conn, err := net.DialUDP("udp", nil, ln.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &emitter{conn: conn, queue: newSampleQueue(capacity)}, ln
+}
+
+func TestSampleQueuePopSkipsEvictedHead(t *testing.T) {
+	q := newSampleQueue(2)
+	q.push(Msg{Seq: 1})
+	q.push(Msg{Seq: 2})
+	head, _ := q.peek()
+	// a push while the head is in flight evicts it
+	q.push(Msg{Seq: 3})
+	q.pop(head.id)
+	if queued, dropped := q.stats(); queued != 2 || dropped != 1 {
+		t.Fatalf("expected 2 queued and 1 dropped, got %d and %d", queued, dropped)
+	}
+	if m, _ := q.peek(); m.Seq != 2 {
+		t.Fatalf("unsent sample removed: head is seq %d", m.Seq)
+	}
+}
+
+func TestBufferedSendsAreSerialised(t *testing.T) {
+	const n = 200
+	e, ln := udpEmitter(t, n)
+	for i := 1; i <= n; i++ {
+		e.queue.push(Msg{DeviceID: "sw-1", Iface: "eth0", Seq: uint64(i)})
+	}
+
+	got := make(map[uint64]int)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 2048)
+		for len(got) < n {
+			ln.SetReadDeadline(time.Now().Add(2 * time.Second))
+			k, err := ln.Read(buf)
+			if err != nil {
+				return
+			}
+			var m Msg
+			if err := json.Unmarshal(buf[:k], &m); err != nil || !m.Backfill {
+				t.Errorf("unexpected packet %q", buf[:k])
+				return
+			}
+			got[m.Seq]++
+		}
+	}()
+
+	// the drainer and a health probe race for the queue head
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		e.drain(context.Background())
+	}()
+	go func() {
+		defer wg.Done()
+		for e.sendBuffered() {
+		}
+	}()
+	wg.Wait()
+	<-done
+
+	if queued, _ := e.queue.stats(); queued != 0 {
+		t.Fatalf("%d samples left queued", queued)
+	}
+	if e.backfilled.Load() != n || len(got) != n {
+		t.Fatalf("expected %d distinct samples, backfilled %d, received %d", n, e.backfilled.Load(), len(got))
+	}
+	for seq, c := range got {
+		if c != 1 {
+			t.Fatalf("seq %d sent %d times", seq, c)
+		}
+	}
+}
+
+func TestDrainFailureMarksControllerDown(t *testing.T) {
+	e, _ := udpEmitter(t, 4)
+	e.queue.push(Msg{Seq: 1})
+	e.conn.Close()
+	e.drain(context.Background())
+	if !e.down.Load() {
+		t.Fatalf("failed backfill send did not mark the controller down")
+	}
+	if queued, _ := e.queue.stats(); queued != 1 {
+		t.Fatalf("unsent sample was dropped: %d queued", queued)
+	}
+}
+
+func TestBackfillRateIsPerDevice(t *testing.T) {
+	e := &emitter{backfillRate: 5}
+	if w := e.backfillWait(); w != 200*time.Millisecond {
+		t.Fatalf("single device: expected 200ms between sends, got %s", w)
+	}
+	e.devices = 100
+	if w := e.backfillWait(); w != 2*time.Millisecond {
+		t.Fatalf("fleet of 100: expected 2ms between sends, got %s", w)
+	}
+	e.backfillRate = 0
+	if w := e.backfillWait(); w != 0 {
+		t.Fatalf("unpaced: expected no wait, got %s", w)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// emitter serialises, signs and writes samples on a shared UDP socket while
+// counting what went out. UDPConn.Write is safe for concurrent use. With a
+// queue configured, samples produced while the controller is down are held
+// and later backfilled (see buffer.go).
+type emitter struct {
+	conn   *net.UDPConn
+	secret []byte
+
+	queue        *sampleQueue
+	backfillRate float64 // per device
+	devices      int
+	backfillMu   sync.Mutex // serialises sendBuffered
+	down         atomic.Bool
+	draining     atomic.Bool
+
+	sent       atomic.Uint64
+	bytes      atomic.Uint64
+	errors     atomic.Uint64
+	backfilled atomic.Uint64
+}
+
+func (e *emitter) send(m Msg) {
+	if e.queue != nil && e.down.Load() {
+		e.queue.push(m)
+		return
+	}
+	if err := e.write(m); err != nil && e.queue != nil {
+		e.queue.push(m)
+		e.down.Store(true)
+	}
+}
+
+func (e *emitter) write(m Msg) error {
+	if len(e.secret) > 0 {
+		m.Sig = computeSignature(m, e.secret)
+	}
+	b, _ := json.Marshal(m)
+	b = append(b, '\n')
+	if _, err := e.conn.Write(b); err != nil {
+		if n := e.errors.Add(1); n == 1 || n%1000 == 0 {
+			log.Printf("udp write err (%d total): %v", n, err)
+		}
+		return err
+	}
+	e.sent.Add(1)
+	e.bytes.Add(uint64(len(b)))
+	return nil
+}
+
+// deviceSim drives one simulated device on its own schedule.
+type deviceSim struct {
+	id     string
+	ifaces []string
+	gen    Generator
+	seq    uint64
+
+	period time.Duration
+	phase  time.Duration // initial offset so a fleet doesn't send in lockstep
+	jitter float64       // +/- fraction of period applied to every sleep
+	rng    *rand.Rand
+	speeds map[string]float64 // link speed per iface, "" for every iface
+}
+
+// run emits one sample per iface every period until ctx is done or runFor of
+// simulated time has elapsed (0 runs forever).
+func (d *deviceSim) run(ctx context.Context, e *emitter, runFor time.Duration) {
+	if d.phase > 0 && !sleepCtx(ctx, d.phase) {
+		return
+	}
+	for tick := 0; ; tick++ {
+		elapsed := time.Duration(tick) * d.period
+		if runFor > 0 && elapsed >= runFor {
+			return
+		}
+		for _, ifname := range d.ifaces {
+			m, ok := d.gen.Next(d.id, ifname, elapsed)
+			if !ok {
+				continue
+			}
+			m.TsUnixMs = time.Now().UnixMilli()
+			if m.SpeedBps == 0 {
+				if bps, ok := d.speeds[ifname]; ok {
+					m.SpeedBps = bps
+				} else {
+					m.SpeedBps = d.speeds[""]
+				}
+			}
+			d.seq++
+			m.Seq = d.seq
+			e.send(m)
+		}
+		wait := d.period
+		if d.jitter > 0 && d.rng != nil {
+			wait += time.Duration((d.rng.Float64()*2 - 1) * d.jitter * float64(d.period))
+		}
+		if !sleepCtx(ctx, wait) {
+			return
+		}
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// fleetDeviceID names the i-th simulated device, zero padded to the fleet size
+// so ids sort naturally (sim-0001 ... sim-2000).
+func fleetDeviceID(prefix string, i, n int) string {
+	width := len(fmt.Sprint(n))
+	return fmt.Sprintf("%s%0*d", prefix, width, i+1)
+}
+
+// runFleet starts every sim concurrently and logs achieved throughput every
+// reportEvery until they all finish or ctx is cancelled.
+func runFleet(ctx context.Context, sims []*deviceSim, e *emitter, runFor, reportEvery time.Duration) {
+	var target float64
+	for _, d := range sims {
+		target += float64(len(d.ifaces)) / d.period.Seconds()
+	}
+	log.Printf("fleet: devices=%d target=%.0f msgs/s", len(sims), target)
+
+	var wg sync.WaitGroup
+	for _, d := range sims {
+		wg.Add(1)
+		go func(d *deviceSim) {
+			defer wg.Done()
+			d.run(ctx, e, runFor)
+		}(d)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	start := time.Now()
+	ticker := time.NewTicker(reportEvery)
+	defer ticker.Stop()
+	var lastSent, lastBytes uint64
+	last := start
+	for {
+		select {
+		case <-done:
+			elapsed := time.Since(start).Seconds()
+			sent := e.sent.Load()
+			log.Printf("fleet done: sent=%d errors=%d avg=%.0f msgs/s (%.2f Mbit/s) over %.1fs",
+				sent, e.errors.Load(), float64(sent)/elapsed, float64(e.bytes.Load())*8/elapsed/1e6, elapsed)
+			return
+		case now := <-ticker.C:
+			sent, bytes := e.sent.Load(), e.bytes.Load()
+			secs := now.Sub(last).Seconds()
+			log.Printf("fleet: %.0f msgs/s (%.2f Mbit/s) target=%.0f sent=%d errors=%d",
+				float64(sent-lastSent)/secs, float64(bytes-lastBytes)*8/secs/1e6, target, sent, e.errors.Load())
+			lastSent, lastBytes, last = sent, bytes, now
+		}
+	}
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -24,16 +26,37 @@ type Msg struct {
 	Q        int32   `json:"queue_depth"`
 	LatMs    float64 `json:"latency_ms"`
 	Seq      uint64  `json:"seq"`
+	SpeedBps float64 `json:"speed_bps,omitempty"` // link speed; 0 when unknown
+	Backfill bool    `json:"backfill,omitempty"`
 	Sig      string  `json:"sig,omitempty"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+
 	ctrl := flag.String("controller", "127.0.0.1:9000", "controller UDP address")
 	device := flag.String("device", "sw-01", "device id")
 	ifaces := flag.String("ifaces", "eth0", "comma-delimited ifaces")
 	period := flag.Duration("period", time.Second, "send period")
 	spikeProb := flag.Float64("spike-prob", 0.05, "probability of spike per sample")
 	secret := flag.String("secret", "", "shared HMAC secret")
+	scenarioPath := flag.String("scenario", "", "scenario file describing the traffic timeline (overrides --ifaces and --spike-prob)")
+	seed := flag.Int64("seed", 0, "random seed (0 uses the scenario seed, or the current time without a scenario)")
+	fleet := flag.Int("fleet", 0, "simulate this many devices from one process (0 runs a single --device)")
+	fleetPrefix := flag.String("fleet-prefix", "sim-", "device id prefix in fleet mode")
+	fleetIfaces := flag.Int("fleet-ifaces", 0, "ifaces per simulated device, named eth0..ethN-1 (0 uses --ifaces)")
+	rate := flag.Float64("rate", 0, "target aggregate msgs/s in fleet mode; derives the per-device period (0 uses --period)")
+	jitter := flag.Float64("jitter", 0.1, "per-send jitter in fleet mode as a fraction of the period")
+	runFor := flag.Duration("duration", 0, "stop after this much simulated time (0 runs forever, scenarios default to their own duration)")
+	reportEvery := flag.Duration("report-every", 5*time.Second, "fleet throughput report interval")
+	bufferSize := flag.Int("buffer", 0, "samples to hold while the controller is unreachable (0 disables store-and-forward)")
+	healthURL := flag.String("health-url", "", "controller health endpoint probed to detect outages, e.g. http://127.0.0.1:8080/healthz")
+	healthEvery := flag.Duration("health-every", 2*time.Second, "controller health probe interval")
+	ifaceSpeed := flag.String("iface-speed", "", "link speed to report in bps, for every iface (10e9) or per iface (eth0=10e9,eth1=1e9); scenario speeds take precedence")
+	backfillRate := flag.Float64("backfill-rate", 5, "max backfilled msgs/s per device once the controller returns, on top of live samples (0 is unpaced)")
 	flag.Parse()
 
 	addr, err := net.ResolveUDPAddr("udp", *ctrl)
@@ -46,31 +69,85 @@ func main() {
 	}
 	defer conn.Close()
 
+	speeds, err := parseIfaceSpeeds(*ifaceSpeed)
+	if err != nil {
+		log.Fatalf("--iface-speed: %v", err)
+	}
+
 	ifaceList := strings.Split(*ifaces, ",")
-	seq := uint64(1)
-	rand.Seed(time.Now().UnixNano())
+	var sc *Scenario
+	if *scenarioPath != "" {
+		sc, err = loadScenario(*scenarioPath)
+		if err != nil {
+			log.Fatalf("load scenario: %v", err)
+		}
+		if *seed == 0 {
+			*seed = sc.Seed
+		}
+		if *runFor == 0 {
+			*runFor = sc.Duration.D()
+		}
+		ifaceList = sc.IfaceNames()
+		log.Printf("scenario %s loaded: ifaces=%v events=%d seed=%d", *scenarioPath, ifaceList, len(sc.Events), *seed)
+	} else if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	newGen := func(seed int64) Generator {
+		if sc != nil {
+			return newScenarioGenerator(sc, seed)
+		}
+		return &spikeGenerator{rng: rand.New(rand.NewSource(seed)), prob: *spikeProb}
+	}
 
-	for {
-		for _, ifname := range ifaceList {
-			m := Msg{DeviceID: *device, Iface: ifname, TsUnixMs: time.Now().UnixMilli(), RxBps: 1e8, TxBps: 8e7, Drops: 0, Q: 3, LatMs: 0.5, Seq: seq}
-			// random spike
-			if rand.Float64() < *spikeProb {
-				m.Drops = uint32(150 + rand.Intn(200))
-				m.Q = int32(25 + rand.Intn(10))
-				m.LatMs = 10.0 + rand.Float64()*50.0
-			}
-			if *secret != "" {
-				m.Sig = computeSignature(m, []byte(*secret))
-			}
-			b, _ := json.Marshal(m)
-			b = append(b, '\n')
-			if _, err := conn.Write(b); err != nil {
-				log.Printf("udp write err: %v", err)
-			}
-			seq++
+	e := &emitter{conn: conn, secret: []byte(*secret), queue: newSampleQueue(*bufferSize), backfillRate: *backfillRate, devices: max(*fleet, 1)}
+	ctx := context.Background()
+	if e.queue != nil {
+		go e.watchHealth(ctx, *healthURL, *healthEvery)
+	}
+
+	if *fleet <= 0 {
+		d := &deviceSim{id: *device, ifaces: ifaceList, gen: newGen(*seed), period: *period, speeds: speeds}
+		d.run(ctx, e, *runFor)
+		if *runFor > 0 {
+			log.Printf("run finished after %s: sent=%d", *runFor, e.sent.Load())
 		}
-		time.Sleep(*period)
+		return
 	}
+
+	if *fleetIfaces > 0 && sc == nil {
+		ifaceList = make([]string, *fleetIfaces)
+		for i := range ifaceList {
+			ifaceList[i] = "eth" + strconv.Itoa(i)
+		}
+	}
+	if *reportEvery <= 0 {
+		log.Fatalf("--report-every must be positive")
+	}
+	devPeriod := *period
+	if *rate > 0 {
+		devPeriod = time.Duration(float64(*fleet*len(ifaceList)) / *rate * float64(time.Second))
+	}
+	if devPeriod <= 0 {
+		// a --rate beyond one message per nanosecond per device rounds to 0
+		log.Fatalf("per-device period is %s; lower --rate or raise --period", devPeriod)
+	}
+	// schedule rng is separate from the value generators so jitter never
+	// changes what a scenario produces
+	sched := rand.New(rand.NewSource(*seed))
+	sims := make([]*deviceSim, *fleet)
+	for i := range sims {
+		sims[i] = &deviceSim{
+			id:     fleetDeviceID(*fleetPrefix, i, *fleet),
+			ifaces: ifaceList,
+			gen:    newGen(*seed + int64(i)),
+			period: devPeriod,
+			phase:  time.Duration(sched.Int63n(int64(devPeriod) + 1)),
+			jitter: *jitter,
+			rng:    rand.New(rand.NewSource(sched.Int63())),
+			speeds: speeds,
+		}
+	}
+	runFleet(ctx, sims, e, *runFor, *reportEvery)
 }
 
 func signingString(m Msg) string {
@@ -85,9 +162,39 @@ func signingString(m Msg) string {
 		strconv.FormatFloat(m.LatMs, 'f', -1, 64),
 		strconv.FormatUint(m.Seq, 10),
 	}
+	// appended only when set, so agents that don't report speed keep the
+	// original signing string
+	if m.SpeedBps != 0 {
+		parts = append(parts, strconv.FormatFloat(m.SpeedBps, 'f', -1, 64))
+	}
+	// backfill likewise, so it can't be flipped on a signed sample
+	if m.Backfill {
+		parts = append(parts, "backfill")
+	}
 	return strings.Join(parts, "|")
 }
 
+// parseIfaceSpeeds reads --iface-speed: a bare value applies to every iface
+// (keyed ""), name=value pairs to the named ones.
+func parseIfaceSpeeds(v string) (map[string]float64, error) {
+	speeds := make(map[string]float64)
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(part, "=")
+		if !ok {
+			name, val = "", part
+		}
+		bps, err := strconv.ParseFloat(val, 64)
+		if err != nil || bps <= 0 {
+			return nil, fmt.Errorf("invalid speed %q", part)
+		}
+		speeds[name] = bps
+	}
+	return speeds, nil
+}
+
 func computeSignature(m Msg, secret []byte) string {
 	mac := hmac.New(sha256.New, secret)
 	mac.Write([]byte(signingString(m)))
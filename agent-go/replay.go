@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCSVMap matches data/mlab_sample.csv: throughput is in Mbit/s and the
+// timestamp column in Unix seconds.
+const defaultCSVMap = "device_id=clientLocation,iface=iface,ts_unix_ms=timestamp*1000," +
+	"rx_bps=meanThroughputMbps*125000,tx_bps=meanThroughputMbps*125000," +
+	"drops=packetRetransmits,queue_depth=queueDepth,latency_ms=minRTT"
+
+// replayRecord is one message to resend. raw holds the original datagram when
+// it can be sent byte for byte; ts is the timeline position in ms. rawOnly
+// marks captured datagrams that never decoded and can only be resent verbatim.
+type replayRecord struct {
+	ts      int64
+	msg     Msg
+	raw     []byte
+	rawOnly bool
+}
+
+type replaySource interface {
+	Next() (replayRecord, error)
+	Close() error
+}
+
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	ctrl := fs.String("controller", "127.0.0.1:9000", "controller UDP address")
+	format := fs.String("format", "auto", "input format: csv, ndjson or auto (by file extension)")
+	mapping := fs.String("map", defaultCSVMap, "csv column mapping: field=column[*scale] or field=@literal, comma separated")
+	speed := fs.Float64("speed", 1, "playback speed multiplier (2 = twice as fast, 0.5 = half speed)")
+	interval := fs.Duration("interval", time.Second, "spacing between records that carry no timestamp")
+	timestamps := fs.String("timestamps", "rebase", "preserve original timestamps or rebase them onto the replay clock")
+	loops := fs.Int("loops", 1, "times to play the input (0 loops forever)")
+	secret := fs.String("secret", "", "shared HMAC secret used to (re)sign every message")
+	includeRejected := fs.Bool("include-rejected", false, "also replay datagrams a controller capture marked as rejected")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: agent replay [flags] <file.csv|file.ndjson>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+	if *speed <= 0 {
+		log.Fatalf("--speed must be positive")
+	}
+	if *timestamps != "preserve" && *timestamps != "rebase" {
+		log.Fatalf("--timestamps must be preserve or rebase")
+	}
+	if *format == "auto" {
+		*format = "ndjson"
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			*format = "csv"
+		}
+	}
+	var cols []columnMap
+	if *format == "csv" {
+		var err error
+		if cols, err = parseColumnMap(*mapping); err != nil {
+			log.Fatalf("parse --map: %v", err)
+		}
+	}
+	open := func() (replaySource, error) {
+		switch *format {
+		case "csv":
+			return openCSVSource(path, cols)
+		case "ndjson":
+			return openNDJSONSource(path, *includeRejected)
+		}
+		return nil, fmt.Errorf("unknown format %q", *format)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", *ctrl)
+	if err != nil {
+		log.Fatalf("resolve udp addr: %v", err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		log.Fatalf("dial udp: %v", err)
+	}
+	defer conn.Close()
+
+	r := &replayer{
+		e:        &emitter{conn: conn, secret: []byte(*secret)},
+		speed:    *speed,
+		interval: *interval,
+		rebase:   *timestamps == "rebase",
+		resign:   *secret != "",
+	}
+	ctx := context.Background()
+	for loop := 0; *loops == 0 || loop < *loops; loop++ {
+		src, err := open()
+		if err != nil {
+			log.Fatalf("open %s: %v", path, err)
+		}
+		n, err := r.play(ctx, src)
+		src.Close()
+		if err != nil {
+			log.Fatalf("replay %s: %v", path, err)
+		}
+		log.Printf("replay pass %d: sent %d records", loop+1, n)
+		if n == 0 {
+			return
+		}
+	}
+}
+
+type replayer struct {
+	e        *emitter
+	speed    float64
+	interval time.Duration
+	rebase   bool
+	resign   bool
+
+	// shift carries rebased timestamps forward across loops so each pass
+	// continues the timeline instead of rewinding it
+	shift   int64
+	started bool
+	seq     uint64
+}
+
+func (r *replayer) play(ctx context.Context, src replaySource) (int, error) {
+	var (
+		n         int
+		first     int64
+		prev      int64
+		passStart time.Time
+		lastTs    int64
+	)
+	for {
+		rec, err := src.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if rec.ts == 0 {
+			// untimed rows are spaced by --interval
+			rec.ts = prev + r.interval.Milliseconds()
+			if n == 0 {
+				rec.ts = time.Now().UnixMilli()
+			}
+		}
+		if n == 0 {
+			first, passStart = rec.ts, time.Now()
+			if r.rebase && !r.started {
+				r.shift = passStart.UnixMilli() - first
+			}
+			r.started = true
+		}
+		// sleep until this record's scaled offset from the start of the pass
+		due := passStart.Add(time.Duration(float64(time.Duration(rec.ts-first)*time.Millisecond) / r.speed))
+		if !sleepCtx(ctx, time.Until(due)) {
+			return n, ctx.Err()
+		}
+		prev = rec.ts
+
+		if rec.raw != nil && (rec.rawOnly || (!r.rebase && !r.resign)) {
+			if _, err := r.e.conn.Write(rec.raw); err != nil {
+				log.Printf("udp write err: %v", err)
+			}
+		} else {
+			m := rec.msg
+			if r.rebase {
+				m.TsUnixMs = r.shift + first + int64(float64(rec.ts-first)/r.speed)
+				lastTs = m.TsUnixMs
+			}
+			if m.Seq == 0 {
+				r.seq++
+				m.Seq = r.seq
+			}
+			m.Sig = ""
+			r.e.write(m)
+		}
+		n++
+	}
+	if r.rebase && n > 0 {
+		// next pass starts one interval after this one ended
+		r.shift = lastTs + r.interval.Milliseconds() - first
+	}
+	return n, nil
+}
+
+// columnMap binds one Msg field to a CSV column (optionally scaled) or a literal.
+type columnMap struct {
+	field   string
+	column  string
+	scale   float64
+	literal string
+	idx     int
+}
+
+func parseColumnMap(spec string) ([]columnMap, error) {
+	var out []columnMap
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field, src, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: expected field=column", part)
+		}
+		switch field {
+		case "device_id", "iface", "ts_unix_ms", "rx_bps", "tx_bps", "drops", "queue_depth", "latency_ms", "seq":
+		default:
+			return nil, fmt.Errorf("%q: unknown field %q", part, field)
+		}
+		cm := columnMap{field: field, scale: 1, idx: -1}
+		if lit, ok := strings.CutPrefix(src, "@"); ok {
+			cm.literal = lit
+		} else if col, scale, ok := strings.Cut(src, "*"); ok {
+			f, err := strconv.ParseFloat(scale, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q: bad scale: %w", part, err)
+			}
+			cm.column, cm.scale = col, f
+		} else {
+			cm.column = src
+		}
+		out = append(out, cm)
+	}
+	return out, nil
+}
+
+type csvSource struct {
+	f    *os.File
+	r    *csv.Reader
+	cols []columnMap
+	line int
+}
+
+func openCSVSource(path string, cols []columnMap) (*csvSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	bound := make([]columnMap, len(cols))
+	copy(bound, cols)
+	for i := range bound {
+		if bound[i].column == "" {
+			continue
+		}
+		for j, h := range header {
+			if strings.TrimSpace(h) == bound[i].column {
+				bound[i].idx = j
+			}
+		}
+		if bound[i].idx < 0 {
+			log.Printf("csv column %q not found, %s left unset", bound[i].column, bound[i].field)
+		}
+	}
+	return &csvSource{f: f, r: r, cols: bound, line: 1}, nil
+}
+
+func (c *csvSource) Next() (replayRecord, error) {
+	for {
+		row, err := c.r.Read()
+		if err != nil {
+			return replayRecord{}, err
+		}
+		c.line++
+		var m Msg
+		if err := applyColumns(&m, c.cols, row); err != nil {
+			log.Printf("skipping csv line %d: %v", c.line, err)
+			continue
+		}
+		return replayRecord{ts: m.TsUnixMs, msg: m}, nil
+	}
+}
+
+func (c *csvSource) Close() error { return c.f.Close() }
+
+func applyColumns(m *Msg, cols []columnMap, row []string) error {
+	for _, cm := range cols {
+		raw := cm.literal
+		if cm.column != "" {
+			if cm.idx < 0 || cm.idx >= len(row) {
+				continue
+			}
+			raw = strings.TrimSpace(row[cm.idx])
+		}
+		if cm.field == "device_id" || cm.field == "iface" {
+			if cm.field == "device_id" {
+				m.DeviceID = raw
+			} else {
+				m.Iface = raw
+			}
+			continue
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cm.field, err)
+		}
+		v *= cm.scale
+		switch cm.field {
+		case "ts_unix_ms":
+			m.TsUnixMs = int64(v)
+		case "rx_bps":
+			m.RxBps = v
+		case "tx_bps":
+			m.TxBps = v
+		case "drops":
+			m.Drops = uint32(v)
+		case "queue_depth":
+			m.Q = int32(v)
+		case "latency_ms":
+			m.LatMs = v
+		case "seq":
+			m.Seq = uint64(v)
+		}
+	}
+	if m.DeviceID == "" || m.Iface == "" {
+		return errors.New("device_id and iface are required")
+	}
+	return nil
+}
+
+// captureRecord is a line written by the controller's --capture-dir recorder.
+// Plain agent NDJSON lines have no "data" and are replayed as they are.
+type captureRecord struct {
+	RecvMs int64  `json:"recv_ms"`
+	Status string `json:"status"`
+	Data   string `json:"data"`
+}
+
+type ndjsonSource struct {
+	f               *os.File
+	sc              *bufio.Scanner
+	includeRejected bool
+	line            int
+}
+
+func openNDJSONSource(path string, includeRejected bool) (*ndjsonSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &ndjsonSource{f: f, sc: sc, includeRejected: includeRejected}, nil
+}
+
+func (n *ndjsonSource) Next() (replayRecord, error) {
+	for n.sc.Scan() {
+		n.line++
+		line := n.sc.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var capRec captureRecord
+		if err := json.Unmarshal(line, &capRec); err != nil {
+			log.Printf("skipping ndjson line %d: %v", n.line, err)
+			continue
+		}
+		// agents terminate each datagram with a newline; keep it so a plain
+		// recording replays byte for byte
+		raw := append(append([]byte(nil), line...), '\n')
+		ts := int64(0)
+		if capRec.Data != "" {
+			if capRec.Status != "accepted" && !n.includeRejected {
+				continue
+			}
+			raw, ts = []byte(capRec.Data), capRec.RecvMs
+		}
+		var m Msg
+		rawOnly := false
+		if err := json.Unmarshal(raw, &m); err != nil {
+			if capRec.Data == "" {
+				log.Printf("skipping ndjson line %d: %v", n.line, err)
+				continue
+			}
+			rawOnly = true
+		}
+		if ts == 0 {
+			ts = m.TsUnixMs
+		}
+		return replayRecord{ts: ts, msg: m, raw: raw, rawOnly: rawOnly}, nil
+	}
+	if err := n.sc.Err(); err != nil {
+		return replayRecord{}, err
+	}
+	return replayRecord{}, io.EOF
+}
+
+func (n *ndjsonSource) Close() error { return n.f.Close() }
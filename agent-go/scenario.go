@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Scenario describes a deterministic traffic timeline for a device. Offsets
+// are measured from the start of the run in simulated time (tick * period), so
+// a scenario with a fixed seed produces identical values on every run.
+type Scenario struct {
+	Seed     int64                    `json:"seed"`
+	Duration Duration                 `json:"duration"`
+	Clock    Duration                 `json:"clock_start"`
+	Ifaces   map[string]IfaceBaseline `json:"ifaces"`
+	Events   []ScenarioEvent          `json:"events"`
+}
+
+type IfaceBaseline struct {
+	RxBps   float64  `json:"rx_bps"`
+	TxBps   float64  `json:"tx_bps"`
+	Drops   uint32   `json:"drops"`
+	Q       int32    `json:"queue_depth"`
+	LatMs   float64  `json:"latency_ms"`
+	Noise   float64  `json:"noise"`
+	Speed   float64  `json:"speed_bps,omitempty"` // link speed reported with every sample
+	Diurnal *Diurnal `json:"diurnal,omitempty"`
+}
+
+// Diurnal scales rx/tx by 1 ± amplitude along a cosine peaking at Peak.
+type Diurnal struct {
+	Amplitude float64  `json:"amplitude"`
+	Period    Duration `json:"period"`
+	Peak      Duration `json:"peak"`
+}
+
+// ScenarioEvent is one timeline entry. Which fields matter depends on Type:
+//
+//	ramp          Field moves linearly From -> To across the window and holds To afterwards
+//	outage        the iface sends nothing during the window
+//	flap          the iface alternates down/up every Period during the window
+//	latency_creep latency grows linearly by To ms across the window and stays raised
+//	burst         each sample is a storm with probability Prob (default 1)
+type ScenarioEvent struct {
+	Type     string   `json:"type"`
+	Iface    string   `json:"iface,omitempty"` // empty applies to every iface
+	Start    Duration `json:"start"`
+	Duration Duration `json:"duration"`
+
+	Field  string   `json:"field,omitempty"`
+	From   *float64 `json:"from,omitempty"`
+	To     float64  `json:"to,omitempty"`
+	Period Duration `json:"period,omitempty"`
+
+	Prob     float64 `json:"prob,omitempty"`
+	Drops    uint32  `json:"drops,omitempty"`
+	Q        int32   `json:"queue_depth,omitempty"`
+	LatMs    float64 `json:"latency_ms,omitempty"`
+	RxFactor float64 `json:"rx_factor,omitempty"`
+}
+
+// Duration accepts Go duration strings ("90s") or plain seconds in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(v)
+		return nil
+	}
+	secs, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	*d = Duration(secs * float64(time.Second))
+	return nil
+}
+
+func (d Duration) D() time.Duration { return time.Duration(d) }
+
+func loadScenario(path string) (*Scenario, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc Scenario
+	if err := json.Unmarshal(raw, &sc); err != nil {
+		return nil, fmt.Errorf("parse scenario %s: %w", path, err)
+	}
+	if len(sc.Ifaces) == 0 {
+		return nil, fmt.Errorf("scenario %s defines no ifaces", path)
+	}
+	for i, ev := range sc.Events {
+		switch ev.Type {
+		case "ramp":
+			if !validField(ev.Field) {
+				return nil, fmt.Errorf("event %d: unknown ramp field %q", i, ev.Field)
+			}
+		case "flap":
+			if ev.Period <= 0 {
+				return nil, fmt.Errorf("event %d: flap requires period", i)
+			}
+		case "outage", "latency_creep", "burst":
+		default:
+			return nil, fmt.Errorf("event %d: unknown type %q", i, ev.Type)
+		}
+		if ev.Iface != "" {
+			if _, ok := sc.Ifaces[ev.Iface]; !ok {
+				return nil, fmt.Errorf("event %d: unknown iface %q", i, ev.Iface)
+			}
+		}
+	}
+	return &sc, nil
+}
+
+// IfaceNames returns the scenario ifaces in a stable order.
+func (sc *Scenario) IfaceNames() []string {
+	names := make([]string, 0, len(sc.Ifaces))
+	for name := range sc.Ifaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validField(f string) bool {
+	switch f {
+	case "rx_bps", "tx_bps", "drops", "queue_depth", "latency_ms":
+		return true
+	}
+	return false
+}
+
+// Generator produces the next sample for an iface at a simulated offset.
+// ok is false when the iface should stay silent (outage, flap down).
+type Generator interface {
+	Next(device, iface string, elapsed time.Duration) (m Msg, ok bool)
+}
+
+// spikeGenerator is the original flat-baseline behaviour with random spikes.
+type spikeGenerator struct {
+	rng  *rand.Rand
+	prob float64
+}
+
+func (g *spikeGenerator) Next(device, iface string, _ time.Duration) (Msg, bool) {
+	m := Msg{DeviceID: device, Iface: iface, RxBps: 1e8, TxBps: 8e7, Drops: 0, Q: 3, LatMs: 0.5}
+	// random spike
+	if g.rng.Float64() < g.prob {
+		m.Drops = uint32(150 + g.rng.Intn(200))
+		m.Q = int32(25 + g.rng.Intn(10))
+		m.LatMs = 10.0 + g.rng.Float64()*50.0
+	}
+	return m, true
+}
+
+type scenarioGenerator struct {
+	sc  *Scenario
+	rng *rand.Rand
+}
+
+func newScenarioGenerator(sc *Scenario, seed int64) *scenarioGenerator {
+	return &scenarioGenerator{sc: sc, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (g *scenarioGenerator) Next(device, iface string, elapsed time.Duration) (Msg, bool) {
+	base, ok := g.sc.Ifaces[iface]
+	if !ok {
+		return Msg{}, false
+	}
+	vals := map[string]float64{
+		"rx_bps":      base.RxBps,
+		"tx_bps":      base.TxBps,
+		"drops":       float64(base.Drops),
+		"queue_depth": float64(base.Q),
+		"latency_ms":  base.LatMs,
+	}
+	if dn := base.Diurnal; dn != nil && dn.Period > 0 {
+		clock := g.sc.Clock.D() + elapsed
+		phase := 2 * math.Pi * float64(clock-dn.Peak.D()) / float64(dn.Period.D())
+		f := 1 + dn.Amplitude*math.Cos(phase)
+		vals["rx_bps"] *= f
+		vals["tx_bps"] *= f
+	}
+
+	up := true
+	for _, ev := range g.sc.Events {
+		if ev.Iface != "" && ev.Iface != iface {
+			continue
+		}
+		start, end := ev.Start.D(), ev.Start.D()+ev.Duration.D()
+		if elapsed < start {
+			continue
+		}
+		active := elapsed < end
+		switch ev.Type {
+		case "ramp":
+			from := vals[ev.Field]
+			if ev.From != nil {
+				from = *ev.From
+			}
+			vals[ev.Field] = from + (ev.To-from)*progress(elapsed, start, end)
+		case "latency_creep":
+			vals["latency_ms"] += ev.To * progress(elapsed, start, end)
+		case "outage":
+			if active {
+				up = false
+			}
+		case "flap":
+			if active && ((elapsed-start)/ev.Period.D())%2 == 0 {
+				up = false
+			}
+		case "burst":
+			if !active {
+				continue
+			}
+			prob := ev.Prob
+			if prob <= 0 {
+				prob = 1
+			}
+			if g.rng.Float64() >= prob {
+				continue
+			}
+			jitter := 0.75 + g.rng.Float64()*0.5
+			vals["drops"] += float64(ev.Drops) * jitter
+			vals["queue_depth"] += float64(ev.Q) * jitter
+			vals["latency_ms"] += ev.LatMs * jitter
+			if ev.RxFactor > 0 {
+				vals["rx_bps"] *= ev.RxFactor
+			}
+		}
+	}
+	// draw noise even while down so the stream stays aligned across scenarios
+	// that differ only by outage windows
+	nRx, nTx := 1+base.Noise*g.rng.NormFloat64(), 1+base.Noise*g.rng.NormFloat64()
+	if !up {
+		return Msg{}, false
+	}
+	return Msg{
+		DeviceID: device,
+		Iface:    iface,
+		RxBps:    math.Max(0, vals["rx_bps"]*nRx),
+		TxBps:    math.Max(0, vals["tx_bps"]*nTx),
+		Drops:    uint32(clampRound(vals["drops"], math.MaxUint32)),
+		Q:        int32(clampRound(vals["queue_depth"], math.MaxInt32)),
+		LatMs:    math.Max(0, vals["latency_ms"]),
+		SpeedBps: base.Speed,
+	}, true
+}
+
+// progress reports how far elapsed is through [start, end), clamped to 1.
+func progress(elapsed, start, end time.Duration) float64 {
+	if end <= start || elapsed >= end {
+		return 1
+	}
+	return float64(elapsed-start) / float64(end-start)
+}
+
+// clampRound rounds v into [0, max] so the integer conversion can't overflow.
+func clampRound(v, max float64) float64 {
+	return math.Min(max, math.Max(0, math.Round(v)))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScenario(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "scenario.json")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatalf("write scenario: %v", err)
+	}
+	return path
+}
+
+func TestLoadScenarioParsesDurationsAndEvents(t *testing.T) {
+	sc, err := loadScenario("scenarios/incident.json")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if sc.Seed != 42 || sc.Duration.D() != 10*time.Minute || sc.Clock.D() != 8*time.Hour {
+		t.Fatalf("unexpected header: seed=%d duration=%s clock=%s", sc.Seed, sc.Duration.D(), sc.Clock.D())
+	}
+	if names := sc.IfaceNames(); !reflect.DeepEqual(names, []string{"eth0", "eth1"}) {
+		t.Fatalf("unexpected ifaces %v", names)
+	}
+	if dn := sc.Ifaces["eth0"].Diurnal; dn == nil || dn.Period.D() != 24*time.Hour || dn.Peak.D() != 14*time.Hour {
+		t.Fatalf("unexpected diurnal %+v", dn)
+	}
+	if len(sc.Events) != 5 || sc.Events[3].Type != "flap" || sc.Events[3].Period.D() != 10*time.Second {
+		t.Fatalf("unexpected events %+v", sc.Events)
+	}
+
+	// plain numbers are seconds
+	sc, err = loadScenario(writeScenario(t, `{"duration": 90.5, "ifaces": {"eth0": {}}}`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if sc.Duration.D() != 90500*time.Millisecond {
+		t.Fatalf("expected 90.5s, got %s", sc.Duration.D())
+	}
+}
+
+func TestLoadScenarioRejectsInvalid(t *testing.T) {
+	cases := map[string]string{
+		"no ifaces":     `{"seed": 1}`,
+		"bad duration":  `{"duration": "soon", "ifaces": {"eth0": {}}}`,
+		"unknown type":  `{"ifaces": {"eth0": {}}, "events": [{"type": "meltdown"}]}`,
+		"unknown field": `{"ifaces": {"eth0": {}}, "events": [{"type": "ramp", "field": "errors"}]}`,
+		"flap period":   `{"ifaces": {"eth0": {}}, "events": [{"type": "flap"}]}`,
+		"unknown iface": `{"ifaces": {"eth0": {}}, "events": [{"type": "outage", "iface": "eth9"}]}`,
+	}
+	want := map[string]string{
+		"no ifaces":     "defines no ifaces",
+		"bad duration":  "parse scenario",
+		"unknown type":  `unknown type "meltdown"`,
+		"unknown field": `unknown ramp field "errors"`,
+		"flap period":   "flap requires period",
+		"unknown iface": `unknown iface "eth9"`,
+	}
+	for name, body := range cases {
+		_, err := loadScenario(writeScenario(t, body))
+		if err == nil || !strings.Contains(err.Error(), want[name]) {
+			t.Errorf("%s: expected error containing %q, got %v", name, want[name], err)
+		}
+	}
+}
+
+// collect gathers every sample a generator emits over d at the given period.
+func collect(g Generator, ifaces []string, d, period time.Duration) []Msg {
+	var out []Msg
+	for elapsed := time.Duration(0); elapsed < d; elapsed += period {
+		for _, iface := range ifaces {
+			if m, ok := g.Next("sw-1", iface, elapsed); ok {
+				out = append(out, m)
+			}
+		}
+	}
+	return out
+}
+
+func TestScenarioGeneratorIsDeterministicPerSeed(t *testing.T) {
+	sc, err := loadScenario("scenarios/incident.json")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	ifaces := sc.IfaceNames()
+	a := collect(newScenarioGenerator(sc, sc.Seed), ifaces, sc.Duration.D(), time.Second)
+	b := collect(newScenarioGenerator(sc, sc.Seed), ifaces, sc.Duration.D(), time.Second)
+	if len(a) == 0 || !reflect.DeepEqual(a, b) {
+		t.Fatalf("same seed produced different samples (%d vs %d)", len(a), len(b))
+	}
+	// eth1 is silent through its outage and half of its flap
+	if n := len(a); n >= 2*600 {
+		t.Fatalf("expected eth1 to miss samples, got %d", n)
+	}
+	if c := collect(newScenarioGenerator(sc, sc.Seed+1), ifaces, sc.Duration.D(), time.Second); reflect.DeepEqual(a, c) {
+		t.Fatalf("different seeds produced identical samples")
+	}
+}
+
+func TestScenarioGeneratorClampsIntegerFields(t *testing.T) {
+	sc, err := loadScenario(writeScenario(t, `{
+		"ifaces": {"eth0": {"drops": 10, "queue_depth": 5}},
+		"events": [
+			{"type": "ramp", "field": "drops", "start": 0, "duration": 0, "to": 1e12},
+			{"type": "ramp", "field": "queue_depth", "start": 0, "duration": 0, "to": -1e12}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	m, ok := newScenarioGenerator(sc, 1).Next("sw-1", "eth0", time.Second)
+	if !ok || m.Drops != math.MaxUint32 || m.Q != 0 {
+		t.Fatalf("expected clamped drops and queue depth, got %+v", m)
+	}
+	sc.Events[1].To = 1e12
+	if m, _ := newScenarioGenerator(sc, 1).Next("sw-1", "eth0", time.Second); m.Q != math.MaxInt32 {
+		t.Fatalf("expected queue depth clamped to MaxInt32, got %d", m.Q)
+	}
+}
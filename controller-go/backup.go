@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// historyBackup is implemented by stores that can stream a consistent copy
+// of themselves while running.
+type historyBackup interface {
+	Backup(w io.Writer) error
+}
+
+var errBackupUnsupported = errors.New("history backend does not support backups")
+
+// BackupStatus describes the most recent snapshot attempts.
+type BackupStatus struct {
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	File        string    `json:"file,omitempty"`
+	Bytes       int64     `json:"bytes"`
+	Duration    string    `json:"duration,omitempty"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// BackupManager writes history snapshots into a directory, on a schedule
+// and on demand, keeping the newest keep files. A nil *BackupManager means
+// backups are disabled; its methods are no-ops.
+type BackupManager struct {
+	store   historyBackup
+	dir     string
+	backend string
+	keep    int
+
+	snapMu sync.Mutex // one snapshot at a time
+	last   time.Time  // name time of the newest snapshot; guarded by snapMu
+
+	mu     sync.Mutex
+	status BackupStatus
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewBackupManager(store HistoryStore, backend, dir string, interval time.Duration, keep int) (*BackupManager, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, nil
+	}
+	b, ok := store.(historyBackup)
+	if !ok || !store.Enabled() {
+		return nil, errBackupUnsupported
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating backup dir: %w", err)
+	}
+	m := &BackupManager{store: b, dir: dir, backend: backend, keep: keep, done: make(chan struct{})}
+	if interval > 0 {
+		m.wg.Add(1)
+		go m.loop(interval)
+	}
+	return m, nil
+}
+
+func (m *BackupManager) loop(interval time.Duration) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			if _, err := m.Snapshot(); err != nil {
+				log.Printf("history backup failed: %v", err)
+			}
+		}
+	}
+}
+
+// Snapshot writes a new backup file and prunes old ones. The file only
+// appears under its final name once it is complete.
+func (m *BackupManager) Snapshot() (BackupStatus, error) {
+	m.snapMu.Lock()
+	defer m.snapMu.Unlock()
+	start := time.Now()
+	name := m.nextName(start)
+	size, err := m.write(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.LastAttempt = start
+	if err != nil {
+		m.status.LastError = err.Error()
+		cBackups.WithLabelValues("failure").Inc()
+		return m.status, err
+	}
+	m.status = BackupStatus{
+		LastSuccess: start,
+		File:        name,
+		Bytes:       size,
+		Duration:    time.Since(start).Round(time.Millisecond).String(),
+		LastAttempt: start,
+	}
+	cBackups.WithLabelValues("success").Inc()
+	gBackupLast.Set(float64(start.Unix()))
+	gBackupBytes.Set(float64(size))
+	if err := m.prune(); err != nil {
+		log.Printf("pruning history backups: %v", err)
+	}
+	return m.status, nil
+}
+
+// nextName returns a file name for a snapshot taken at now. Names carry
+// milliseconds and sort in snapshot order, so back-to-back snapshots never
+// replace each other; snapMu must be held.
+func (m *BackupManager) nextName(now time.Time) string {
+	now = now.Truncate(time.Millisecond)
+	if !now.After(m.last) {
+		now = m.last.Add(time.Millisecond)
+	}
+	for {
+		name := filepath.Join(m.dir, fmt.Sprintf("history-%s-%s.bak", m.backend, now.UTC().Format("20060102T150405.000")))
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			m.last = now
+			return name
+		}
+		now = now.Add(time.Millisecond)
+	}
+}
+
+func (m *BackupManager) write(name string) (int64, error) {
+	tmp := name + ".partial"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	if err := m.store.Backup(f); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(tmp, name)
+}
+
+// prune removes all but the newest keep backups of this backend.
+func (m *BackupManager) prune() error {
+	if m.keep <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(m.dir, "history-"+m.backend+"-*.bak"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for len(files) > m.keep {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+func (m *BackupManager) Status() BackupStatus {
+	if m == nil {
+		return BackupStatus{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+func (m *BackupManager) Close() {
+	if m == nil {
+		return
+	}
+	close(m.done)
+	m.wg.Wait()
+}
+
+// registerAdminAPI serves /api/admin/snapshot: GET reports the last backup,
+// POST takes a snapshot now. Requests must carry token as a bearer token.
+// store is the history backing m, consulted to tell a backend that can't be
+// backed up (501) from backups that are merely not configured (404).
+func registerAdminAPI(mux *http.ServeMux, m *BackupManager, store HistoryStore, token string) {
+	_, canBackup := store.(historyBackup)
+	canBackup = canBackup && store.Enabled()
+	mux.HandleFunc("/api/admin/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if m == nil && !canBackup {
+			http.Error(w, errBackupUnsupported.Error(), http.StatusNotImplemented)
+			return
+		}
+		if m == nil {
+			http.Error(w, "backups disabled", http.StatusNotFound)
+			return
+		}
+		status := m.Status()
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var err error
+			if status, err = m.Snapshot(); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(status)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+// authorized reports whether r carries token as a bearer token. An empty
+// token authorizes nothing, so admin endpoints stay closed until
+// --admin-token is set.
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// restoreHistory replaces the history under dir with a backup file written
+// by the same backend. It runs before the store is opened. The backup is
+// loaded and checked beside dir first, so a bad file leaves dir untouched.
+func restoreHistory(backend, dir, path string) error {
+	if strings.TrimSpace(dir) == "" {
+		return errors.New("restoring needs a history dir")
+	}
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating history dir: %w", err)
+	}
+	switch backend {
+	case "badger":
+		stage := dir + ".restore"
+		if err := os.RemoveAll(stage); err != nil {
+			return err
+		}
+		if err := loadBadgerBackup(stage, path); err != nil {
+			os.RemoveAll(stage)
+			return fmt.Errorf("loading %s: %w", path, err)
+		}
+		return swapDir(stage, dir)
+	case "sqlite":
+		dst := filepath.Join(dir, "history.db")
+		if err := copyFile(path, dst+".restore"); err != nil {
+			return err
+		}
+		if err := checkSQLiteFile(dst + ".restore"); err != nil {
+			os.Remove(dst + ".restore")
+			return fmt.Errorf("checking %s: %w", path, err)
+		}
+		for _, suffix := range []string{"-wal", "-shm"} {
+			if err := os.Remove(dst + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return os.Rename(dst+".restore", dst)
+	}
+	return fmt.Errorf("%w: %s", errBackupUnsupported, backend)
+}
+
+// loadBadgerBackup loads a badger backup stream into a new database at dir.
+func loadBadgerBackup(dir, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		return err
+	}
+	if err := db.Load(f, 256); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// swapDir moves stage into place at dir, removing what dir held before.
+func swapDir(stage, dir string) error {
+	old := dir + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, old); err != nil {
+		return err
+	}
+	if err := os.Rename(stage, dir); err != nil {
+		os.Rename(old, dir)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capture statuses written alongside each datagram
+const (
+	captureAccepted         = "accepted"
+	captureInvalidJSON      = "invalid_json"
+	captureRateLimited      = "rate_limited"
+	captureMissingSignature = "missing_signature"
+	captureInvalidSignature = "invalid_signature"
+	captureUnregistered     = "unregistered"
+	captureSourceNotAllowed = "source_not_allowed"
+)
+
+// CaptureRecord is one line of a capture file. Data is the datagram exactly as
+// received so `agent replay` can resend it byte for byte.
+type CaptureRecord struct {
+	RecvMs int64  `json:"recv_ms"`
+	Src    string `json:"src"`
+	Status string `json:"status"`
+	Data   string `json:"data"`
+}
+
+// Recorder appends datagrams to rotating NDJSON capture files. A nil Recorder
+// records nothing.
+type Recorder struct {
+	dir             string
+	maxBytes        int64
+	keep            int
+	includeRejected bool
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+	last time.Time // timestamp in the current file's name
+	done chan struct{}
+}
+
+func NewRecorder(dir string, maxBytes int64, keep int, includeRejected bool) (*Recorder, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating capture dir: %w", err)
+	}
+	r := &Recorder{dir: dir, maxBytes: maxBytes, keep: keep, includeRejected: includeRejected, done: make(chan struct{})}
+	if err := r.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	go r.flushLoop()
+	return r, nil
+}
+
+func (r *Recorder) Record(recv time.Time, src net.Addr, data []byte, status string) {
+	if r == nil || (status != captureAccepted && !r.includeRejected) {
+		return
+	}
+	rec := CaptureRecord{RecvMs: recv.UnixMilli(), Status: status, Data: string(data)}
+	if src != nil {
+		rec.Src = src.String()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return
+	}
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(line)) > r.maxBytes {
+		if err := r.rotate(recv); err != nil {
+			log.Printf("capture rotate failed: %v", err)
+			return
+		}
+	}
+	n, err := r.w.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		log.Printf("capture write failed: %v", err)
+	}
+}
+
+// rotate closes the current file, opens a fresh one and prunes old captures.
+// Callers hold r.mu (or own r exclusively during construction).
+func (r *Recorder) rotate(now time.Time) error {
+	if err := r.closeFile(); err != nil {
+		log.Printf("capture close failed: %v", err)
+	}
+	// names must sort in write order, even when rotating more than once
+	// within a millisecond
+	now = now.Truncate(time.Millisecond)
+	if !now.After(r.last) {
+		now = r.last.Add(time.Millisecond)
+	}
+	var f *os.File
+	for {
+		name := filepath.Join(r.dir, "capture-"+now.UTC().Format("20060102T150405.000")+".ndjson")
+		var err error
+		f, err = os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("opening capture file: %w", err)
+		}
+		now = now.Add(time.Millisecond)
+	}
+	r.f, r.w, r.size, r.last = f, bufio.NewWriterSize(f, 64*1024), 0, now
+	r.prune()
+	return nil
+}
+
+func (r *Recorder) prune() {
+	if r.keep <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(r.dir, "capture-*.ndjson"))
+	if err != nil || len(files) <= r.keep {
+		return
+	}
+	// names embed a sortable UTC timestamp
+	sort.Strings(files)
+	for _, old := range files[:len(files)-r.keep] {
+		if err := os.Remove(old); err != nil {
+			log.Printf("capture prune failed: %v", err)
+		}
+	}
+}
+
+func (r *Recorder) closeFile() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f, r.w = nil, nil
+	return err
+}
+
+func (r *Recorder) flushLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			if r.w != nil {
+				if err := r.w.Flush(); err != nil {
+					log.Printf("capture flush failed: %v", err)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	close(r.done)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closeFile()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRecorderRotatesAndRoundTrips(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(dir, 512, 0, true)
+	if err != nil {
+		t.Fatalf("recorder: %v", err)
+	}
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}
+	recv := time.Now()
+	var want []CaptureRecord
+	for i := 0; i < 40; i++ {
+		data := fmt.Sprintf(`{"device_id":"sw-01","iface":"eth0","seq":%d}`+"\n", i)
+		status := captureAccepted
+		if i%10 == 9 {
+			data, status = "not json", captureInvalidJSON
+		}
+		// every record in the same millisecond, so rotations collide on name
+		r.Record(recv, src, []byte(data), status)
+		want = append(want, CaptureRecord{RecvMs: recv.UnixMilli(), Src: src.String(), Status: status, Data: data})
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "capture-*.ndjson"))
+	if len(files) < 3 {
+		t.Fatalf("expected rotation at 512 bytes, got %d files", len(files))
+	}
+	sort.Strings(files)
+	var got []CaptureRecord
+	for _, name := range files {
+		st, _ := os.Stat(name)
+		if st.Size() > 512 {
+			t.Fatalf("%s is %d bytes, over --capture-max-bytes", name, st.Size())
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var rec CaptureRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got = append(got, rec)
+		}
+		f.Close()
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read back %d records, wrote %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("record %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRecorderKeepsNewestFiles(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(dir, 100, 2, false)
+	if err != nil {
+		t.Fatalf("recorder: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		r.Record(time.Now(), nil, []byte(fmt.Sprintf(`{"seq":%d}`, i)), captureAccepted)
+		r.Record(time.Now(), nil, []byte("dropped"), captureInvalidJSON) // rejected not captured
+	}
+	r.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "capture-*.ndjson"))
+	if len(files) != 2 {
+		t.Fatalf("expected --capture-keep 2 files, got %d", len(files))
+	}
+	sort.Strings(files)
+	data, _ := os.ReadFile(files[1])
+	var rec CaptureRecord
+	if err := json.Unmarshal(data, &rec); err != nil || rec.Data != `{"seq":19}` {
+		t.Fatalf("newest file should end with the last record: %q", data)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const checkpointVersion = 1
+
+// stateCheckpoint is the on-disk form of the live device/iface state.
+type stateCheckpoint struct {
+	Version int                `json:"version"`
+	SavedAt int64              `json:"saved_at"`
+	Devices []deviceCheckpoint `json:"devices"`
+}
+
+type deviceCheckpoint struct {
+	ID        string            `json:"id"`
+	Status    string            `json:"status"`
+	FirstSeen int64             `json:"first_seen"`
+	Messages  uint64            `json:"messages"`
+	Ifaces    []ifaceCheckpoint `json:"ifaces"`
+	// source address, so a restart doesn't look like an address change
+	Source        string `json:"source,omitempty"`
+	SourceSince   int64  `json:"source_since,omitempty"`
+	PrevSource    string `json:"prev_source,omitempty"`
+	SourceChanges uint64 `json:"source_changes,omitempty"`
+}
+
+type ifaceCheckpoint struct {
+	Name      string   `json:"name"`
+	Last      Sample   `json:"last"`
+	Buf       []Sample `json:"buf"`
+	FirstSeen int64    `json:"first_seen"`
+	LastSeen  int64    `json:"last_seen"`
+	Messages  uint64   `json:"messages"`
+	EWMARx    float64  `json:"ewma_rx"`
+	EWMATx    float64  `json:"ewma_tx"`
+	EWMALat   float64  `json:"ewma_lat"`
+	Status    string   `json:"status"`
+	Breaches  int      `json:"breaches"`
+	// last speed the agent reported
+	ReportedSpeedBps float64 `json:"reported_speed_bps,omitempty"`
+}
+
+// Checkpoint captures the live state of every device and iface.
+func (s *State) Checkpoint() stateCheckpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cp := stateCheckpoint{Version: checkpointVersion, SavedAt: time.Now().UnixMilli(), Devices: make([]deviceCheckpoint, 0, len(s.Devices))}
+	for _, d := range s.Devices {
+		dc := deviceCheckpoint{ID: d.ID, Status: d.Status, FirstSeen: d.FirstSeen.UnixMilli(), Messages: d.Messages, Ifaces: make([]ifaceCheckpoint, 0, len(d.Ifaces)),
+			Source: d.Source, PrevSource: d.PrevSource, SourceChanges: d.SourceChanges}
+		if d.Source != "" {
+			dc.SourceSince = d.SourceSince.UnixMilli()
+		}
+		for name, ifs := range d.Ifaces {
+			ifs.mu.Lock()
+			dc.Ifaces = append(dc.Ifaces, ifaceCheckpoint{
+				Name:      name,
+				Last:      ifs.Last,
+				Buf:       append([]Sample(nil), ifs.Buf...),
+				FirstSeen: ifs.FirstSeen.UnixMilli(),
+				LastSeen:  ifs.LastSeen.UnixMilli(),
+				Messages:  ifs.Messages,
+				EWMARx:    ifs.EWMARx,
+				EWMATx:    ifs.EWMATx,
+				EWMALat:   ifs.EWMALat,
+				Status:    ifs.Status,
+				Breaches:  ifs.breaches,
+
+				ReportedSpeedBps: ifs.ReportedSpeedBps,
+			})
+			ifs.mu.Unlock()
+		}
+		cp.Devices = append(cp.Devices, dc)
+	}
+	return cp
+}
+
+// Restore loads checkpointed devices and ifaces that aren't already known.
+// Restored ifaces are stale until their next sample arrives: they keep their
+// checkpointed status, and go OFFLINE if nothing arrives within offlineAfter
+// of the restore.
+func (s *State) Restore(cp stateCheckpoint, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	restored := 0
+	for _, dc := range cp.Devices {
+		d, ok := s.Devices[dc.ID]
+		if !ok {
+			d = s.addDeviceLocked(&Device{ID: dc.ID, Status: dc.Status, FirstSeen: time.UnixMilli(dc.FirstSeen), Messages: dc.Messages,
+				Source: dc.Source, PrevSource: dc.PrevSource, SourceChanges: dc.SourceChanges})
+			if dc.Source != "" {
+				d.SourceSince = time.UnixMilli(dc.SourceSince)
+			}
+		}
+		s.markDirty(dc.ID)
+		for _, ic := range dc.Ifaces {
+			if _, ok := d.Ifaces[ic.Name]; ok {
+				continue
+			}
+			buf := make([]Sample, len(ic.Buf), 128)
+			copy(buf, ic.Buf)
+			s.addIfaceLocked(d, ic.Name, &IfaceState{
+				Last:      ic.Last,
+				Buf:       buf,
+				FirstSeen: time.UnixMilli(ic.FirstSeen),
+				LastSeen:  time.UnixMilli(ic.LastSeen),
+				Messages:  ic.Messages,
+				EWMARx:    ic.EWMARx,
+				EWMATx:    ic.EWMATx,
+				EWMALat:   ic.EWMALat,
+				Status:    ic.Status,
+				breaches:  ic.Breaches,
+
+				ReportedSpeedBps: ic.ReportedSpeedBps,
+				restoredAt:       now,
+			})
+			restored++
+		}
+	}
+	return restored
+}
+
+// Checkpointer periodically saves the live state to a file and saves it
+// once more on Close. A nil *Checkpointer means checkpointing is disabled.
+type Checkpointer struct {
+	state *State
+	path  string
+	mu    sync.Mutex
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewCheckpointer restores state from path if the file exists, then starts
+// saving to it every interval.
+func NewCheckpointer(state *State, path string, interval time.Duration) (*Checkpointer, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, nil
+	}
+	if interval <= 0 {
+		return nil, errors.New("checkpoint interval must be positive")
+	}
+	cp, err := loadCheckpoint(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		// a damaged checkpoint shouldn't keep the controller down
+		log.Printf("ignoring state checkpoint %s: %v", path, err)
+	default:
+		n := state.Restore(cp, time.Now())
+		log.Printf("restored %d ifaces from state checkpoint saved %s", n, time.UnixMilli(cp.SavedAt).Format(time.RFC3339))
+	}
+	c := &Checkpointer{state: state, path: path, done: make(chan struct{})}
+	c.wg.Add(1)
+	go c.loop(interval)
+	return c, nil
+}
+
+func (c *Checkpointer) loop(interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.Save(); err != nil {
+				log.Printf("state checkpoint failed: %v", err)
+			}
+		}
+	}
+}
+
+// Save writes a checkpoint, replacing the previous file atomically.
+func (c *Checkpointer) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.Marshal(c.state.Checkpoint())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *Checkpointer) Close() {
+	if c == nil {
+		return
+	}
+	close(c.done)
+	c.wg.Wait()
+	if err := c.Save(); err != nil {
+		log.Printf("final state checkpoint failed: %v", err)
+	}
+}
+
+func loadCheckpoint(path string) (stateCheckpoint, error) {
+	var cp stateCheckpoint
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, err
+	}
+	if cp.Version != checkpointVersion {
+		return cp, fmt.Errorf("unsupported checkpoint version %d", cp.Version)
+	}
+	return cp, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"time"
+)
+
+// WebSocket clients get a full versioned snapshot when they connect, then
+// deltas. Each delta names the version it applies on top of (Base); a client
+// whose version differs has missed something and sends {"type":"resync"}
+// to get a fresh snapshot.
+
+type versionedSnapshot struct {
+	Type    string `json:"type"` // "snapshot"
+	Version uint64 `json:"version"`
+	StateSnapshot
+}
+
+// DeviceDelta carries a new or changed device: its status, tags and
+// metadata in full, and only the ifaces that are new or changed.
+type DeviceDelta struct {
+	ID            string            `json:"id"`
+	Status        string            `json:"status"`
+	Stale         bool              `json:"stale,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Meta          map[string]string `json:"meta,omitempty"`
+	Ifaces        []IfaceSnapshot   `json:"ifaces,omitempty"`
+	RemovedIfaces []string          `json:"removed_ifaces,omitempty"`
+}
+
+type StateDelta struct {
+	Type    string        `json:"type"` // "delta"
+	Version uint64        `json:"version"`
+	Base    uint64        `json:"base"`
+	T       int64         `json:"t"`
+	Devices []DeviceDelta `json:"devices,omitempty"`
+	Removed []string      `json:"removed,omitempty"` // device ids
+}
+
+// diffSnapshots returns the changes from prev to next, and false when there
+// are none. Version and Base are left for the caller.
+func diffSnapshots(prev, next StateSnapshot) (StateDelta, bool) {
+	delta := StateDelta{Type: "delta", T: next.T}
+	old := make(map[string]DeviceSnapshot, len(prev.Devices))
+	for _, d := range prev.Devices {
+		old[d.ID] = d
+	}
+	for _, d := range next.Devices {
+		p, ok := old[d.ID]
+		delete(old, d.ID)
+		dd := DeviceDelta{ID: d.ID, Status: d.Status, Stale: d.Stale, Tags: d.Tags, Meta: d.Meta}
+		if !ok {
+			dd.Ifaces = d.Ifaces
+			delta.Devices = append(delta.Devices, dd)
+			continue
+		}
+		oldIfaces := make(map[string]IfaceSnapshot, len(p.Ifaces))
+		for _, is := range p.Ifaces {
+			oldIfaces[is.Name] = is
+		}
+		for _, is := range d.Ifaces {
+			if pi, ok := oldIfaces[is.Name]; !ok || !reflect.DeepEqual(pi, is) {
+				dd.Ifaces = append(dd.Ifaces, is)
+			}
+			delete(oldIfaces, is.Name)
+		}
+		for name := range oldIfaces {
+			dd.RemovedIfaces = append(dd.RemovedIfaces, name)
+		}
+		sameHeader := p.Status == d.Status && p.Stale == d.Stale && reflect.DeepEqual(p.Tags, d.Tags) && reflect.DeepEqual(p.Meta, d.Meta)
+		if sameHeader && len(dd.Ifaces) == 0 && len(dd.RemovedIfaces) == 0 {
+			continue
+		}
+		sort.Strings(dd.RemovedIfaces)
+		delta.Devices = append(delta.Devices, dd)
+	}
+	for id := range old {
+		delta.Removed = append(delta.Removed, id)
+	}
+	sort.Slice(delta.Devices, func(i, j int) bool { return delta.Devices[i].ID < delta.Devices[j].ID })
+	sort.Strings(delta.Removed)
+	return delta, len(delta.Devices) > 0 || len(delta.Removed) > 0
+}
+
+// updateStateLocked records the latest state, moving to version when it
+// differs from the last one; h.mu must be held.
+func (h *Hub) updateStateLocked(snap StateSnapshot, version uint64) {
+	if _, changed := diffSnapshots(h.wsState, snap); changed {
+		h.wsVersion = version
+	}
+	h.wsState = snap
+}
+
+// sendUpdateLocked brings c up to date with a delta against the state it
+// holds, unless nothing it subscribes to changed. While its rate cap or a
+// full queue holds the update back, c stays pending and later changes are
+// folded into the same delta. h.mu must be held.
+func (h *Hub) sendUpdateLocked(c *wsClient, now time.Time) {
+	if c.sub.MaxRate > 0 && now.Sub(c.lastSend) < time.Duration(float64(time.Second)/c.sub.MaxRate) {
+		c.pending = true
+		return
+	}
+	if !c.roomLocked(now) {
+		if !c.pending {
+			cWSDropped.WithLabelValues("coalesced").Inc()
+		}
+		c.pending = true
+		return
+	}
+	c.pending = false
+	view := c.sub.view(h.wsState)
+	delta, changed := diffSnapshots(c.sent, view)
+	c.sent = view
+	if !changed {
+		return
+	}
+	delta.Version, delta.Base = h.wsVersion, c.version
+	c.version = h.wsVersion
+	c.lastSend = now
+	c.queueJSONLocked(delta, now)
+}
+
+// sendSnapshotLocked queues the full state c subscribes to at the current
+// version, on connect, on resync and after its subscription changes. When
+// the queue is full it is sent once there is room. h.mu must be held.
+func (h *Hub) sendSnapshotLocked(c *wsClient) {
+	now := time.Now()
+	if !c.roomLocked(now) {
+		c.needSnapshot = true
+		return
+	}
+	c.sent = c.sub.view(h.wsState)
+	c.version = h.wsVersion
+	c.pending, c.needSnapshot = false, false
+	c.lastSend = now
+	c.queueJSONLocked(versionedSnapshot{Type: "snapshot", Version: c.version, StateSnapshot: c.sent}, now)
+}
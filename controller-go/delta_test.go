@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	prev := StateSnapshot{T: 1, Devices: []DeviceSnapshot{
+		{ID: "sw-01", Status: "OK", Ifaces: []IfaceSnapshot{{Name: "eth0", RxBps: 1}, {Name: "eth1"}}},
+		{ID: "sw-02", Status: "OK", Ifaces: []IfaceSnapshot{{Name: "eth0"}}},
+		{ID: "sw-03", Status: "OK"},
+	}}
+	next := StateSnapshot{T: 2, Devices: []DeviceSnapshot{
+		{ID: "sw-04", Status: "OK", Ifaces: []IfaceSnapshot{{Name: "eth0"}}},
+		{ID: "sw-01", Status: "OK", Ifaces: []IfaceSnapshot{{Name: "eth0", RxBps: 2}}},
+		{ID: "sw-02", Status: "OK", Ifaces: []IfaceSnapshot{{Name: "eth0"}}},
+	}}
+	delta, changed := diffSnapshots(prev, next)
+	if !changed || delta.T != 2 || len(delta.Devices) != 2 || strings.Join(delta.Removed, ",") != "sw-03" {
+		t.Fatalf("unexpected delta: %+v", delta)
+	}
+	d := delta.Devices[0]
+	if d.ID != "sw-01" || len(d.Ifaces) != 1 || d.Ifaces[0].RxBps != 2 || strings.Join(d.RemovedIfaces, ",") != "eth1" {
+		t.Fatalf("unexpected sw-01 delta: %+v", d)
+	}
+	if d := delta.Devices[1]; d.ID != "sw-04" || len(d.Ifaces) != 1 {
+		t.Fatalf("new devices should come with every iface: %+v", d)
+	}
+	if _, changed := diffSnapshots(next, StateSnapshot{T: 3, Devices: next.Devices}); changed {
+		t.Fatalf("a new timestamp alone is not a change")
+	}
+}
+
+func TestWebSocketSnapshotThenDeltas(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	hub.BroadcastState(StateSnapshot{T: 1, Devices: []DeviceSnapshot{{ID: "sw-01", Status: "OK"}}})
+	srv := httptest.NewServer(http.HandlerFunc(hub.ServeWS))
+	defer srv.Close()
+	// let Run apply the first snapshot so the client starts from it
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		hub.mu.Lock()
+		v := hub.wsVersion
+		hub.mu.Unlock()
+		if v != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first snapshot not applied")
+		}
+	}
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var snap versionedSnapshot
+	if err := c.ReadJSON(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Type != "snapshot" || snap.Version == 0 || len(snap.Devices) != 1 {
+		t.Fatalf("unexpected initial snapshot: %+v", snap)
+	}
+
+	hub.BroadcastState(StateSnapshot{T: 2, Devices: []DeviceSnapshot{{ID: "sw-01", Status: "OK"}}}) // unchanged
+	hub.BroadcastState(StateSnapshot{T: 3, Devices: []DeviceSnapshot{{ID: "sw-01", Status: "ALERT"}}})
+	var delta StateDelta
+	if err := c.ReadJSON(&delta); err != nil {
+		t.Fatal(err)
+	}
+	if delta.Type != "delta" || delta.Base != snap.Version || delta.Version <= snap.Version || len(delta.Devices) != 1 || delta.Devices[0].Status != "ALERT" {
+		t.Fatalf("unexpected delta: %+v (snapshot version %d)", delta, snap.Version)
+	}
+
+	if err := c.WriteJSON(map[string]string{"type": "resync"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReadJSON(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Type != "snapshot" || snap.Version != delta.Version || snap.Devices[0].Status != "ALERT" {
+		t.Fatalf("unexpected resync snapshot: %+v", snap)
+	}
+}
+
+func TestWebSocketSubscriptions(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	srv := httptest.NewServer(http.HandlerFunc(hub.ServeWS))
+	defer srv.Close()
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var snap versionedSnapshot
+	if err := c.ReadJSON(&snap); err != nil {
+		t.Fatal(err)
+	}
+
+	c.WriteJSON(map[string]interface{}{"type": "subscribe", "status": []string{"bogus"}})
+	var e map[string]string
+	if err := c.ReadJSON(&e); err != nil || e["type"] != "error" {
+		t.Fatalf("expected an error for an unknown status: %v %v", e, err)
+	}
+	// malformed frames are answered and the connection stays up
+	for _, frame := range []string{"{not json", `{"type": "subscribe", "devices": "sw-*"}`} {
+		c.WriteMessage(websocket.TextMessage, []byte(frame))
+		e = nil
+		if err := c.ReadJSON(&e); err != nil || e["type"] != "error" {
+			t.Fatalf("expected an error for %q: %v %v", frame, e, err)
+		}
+	}
+	c.WriteJSON(map[string]interface{}{"type": "subscribe", "devices": []string{"sw-*"}, "status": []string{"alert"}})
+	if err := c.ReadJSON(&snap); err != nil || snap.Type != "snapshot" {
+		t.Fatalf("subscribing should answer with a snapshot: %+v %v", snap, err)
+	}
+
+	devices := []DeviceSnapshot{{ID: "sw-01", Status: "OK"}, {ID: "sw-02", Status: "ALERT"}, {ID: "rtr-01", Status: "ALERT"}}
+	hub.BroadcastState(StateSnapshot{T: 1, Devices: devices})
+	hub.BroadcastEvent(Event{Kind: "forgotten", Device: "rtr-02"})
+	hub.BroadcastEvent(Event{Kind: "forgotten", Device: "sw-09"})
+	var delta StateDelta
+	if err := c.ReadJSON(&delta); err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Devices) != 1 || delta.Devices[0].ID != "sw-02" || delta.Base != snap.Version {
+		t.Fatalf("delta should carry only alerting sw-* devices: %+v", delta)
+	}
+	var ev Event
+	if err := c.ReadJSON(&ev); err != nil || ev.Device != "sw-09" {
+		t.Fatalf("expected only the sw-09 event: %+v %v", ev, err)
+	}
+
+	// sw-02 leaves the subscribed statuses
+	devices = []DeviceSnapshot{{ID: "sw-01", Status: "OK"}, {ID: "sw-02", Status: "OK"}, {ID: "rtr-01", Status: "OK"}}
+	hub.BroadcastState(StateSnapshot{T: 2, Devices: devices})
+	delta = StateDelta{}
+	if err := c.ReadJSON(&delta); err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Devices) != 0 || strings.Join(delta.Removed, ",") != "sw-02" {
+		t.Fatalf("a device leaving the view should be removed: %+v", delta)
+	}
+
+	c.WriteJSON(map[string]string{"type": "unsubscribe"})
+	snap = versionedSnapshot{}
+	if err := c.ReadJSON(&snap); err != nil || len(snap.Devices) != 0 {
+		t.Fatalf("unsubscribing should answer with an empty snapshot: %+v %v", snap, err)
+	}
+}
+
+func TestSubscriptionRules(t *testing.T) {
+	var s wsSubscription
+	rate := 2.0
+	if err := s.subscribe(clientMessage{Devices: []string{"a", "b*"}, Tags: []string{"core"}, MaxRate: &rate}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.subscribe(clientMessage{Devices: []string{"c", "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(s.filter.IDs, ",") != "a,b*,c" || s.MaxRate != 2 || len(s.filter.Tags) != 1 {
+		t.Fatalf("unexpected subscription: %+v", s)
+	}
+	if err := s.subscribe(clientMessage{Devices: []string{"[a"}}); err == nil {
+		t.Fatalf("bad glob accepted")
+	}
+	s.unsubscribe(clientMessage{Devices: []string{"a", "b*", "c"}})
+	if !s.none || s.matchEvent(Event{Device: "a"}) {
+		t.Fatalf("unsubscribing from every device should stop updates: %+v", s)
+	}
+	s.subscribe(clientMessage{Devices: []string{"x"}})
+	if s.none || !s.matchEvent(Event{Device: "x"}) || s.matchEvent(Event{Device: "a"}) {
+		t.Fatalf("subscribing again should follow only the new devices: %+v", s)
+	}
+
+	// from every device, unsubscribing leaves devices out rather than
+	// stopping updates, and subscribing to them brings them back
+	var all wsSubscription
+	all.unsubscribe(clientMessage{Devices: []string{"dc1-sw-07"}})
+	if all.none || all.matchEvent(Event{Device: "dc1-sw-07"}) || !all.matchEvent(Event{Device: "dc1-sw-08"}) {
+		t.Fatalf("unsubscribing one device from all should exclude only it: %+v", all)
+	}
+	all.subscribe(clientMessage{Devices: []string{"dc1-sw-07"}})
+	if len(all.filter.IDs) != 0 || len(all.exclude) != 0 || !all.matchEvent(Event{Device: "dc1-sw-08"}) {
+		t.Fatalf("subscribing to an excluded device should restore every device: %+v", all)
+	}
+}
+
+func TestWebSocketUnsubscribeFromAll(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	srv := httptest.NewServer(http.HandlerFunc(hub.ServeWS))
+	defer srv.Close()
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var snap versionedSnapshot
+	if err := c.ReadJSON(&snap); err != nil {
+		t.Fatal(err)
+	}
+	hub.BroadcastState(StateSnapshot{T: 1, Devices: []DeviceSnapshot{{ID: "dc1-sw-07", Status: "OK"}, {ID: "dc1-sw-08", Status: "OK"}}})
+	var delta StateDelta
+	if err := c.ReadJSON(&delta); err != nil || len(delta.Devices) != 2 {
+		t.Fatalf("expected both devices: %+v %v", delta, err)
+	}
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"type":"unsubscribe","devices":["dc1-sw-07"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	snap = versionedSnapshot{}
+	if err := c.ReadJSON(&snap); err != nil || len(snap.Devices) != 1 || snap.Devices[0].ID != "dc1-sw-08" {
+		t.Fatalf("unsubscribing dc1-sw-07 should keep every other device: %+v %v", snap, err)
+	}
+	hub.BroadcastState(StateSnapshot{T: 2, Devices: []DeviceSnapshot{{ID: "dc1-sw-07", Status: "ALERT"}, {ID: "dc1-sw-08", Status: "ALERT"}}})
+	delta = StateDelta{}
+	if err := c.ReadJSON(&delta); err != nil || len(delta.Devices) != 1 || delta.Devices[0].ID != "dc1-sw-08" {
+		t.Fatalf("updates for the other devices should continue: %+v %v", delta, err)
+	}
+}
+
+func TestWebSocketRateCapCoalesces(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	srv := httptest.NewServer(http.HandlerFunc(hub.ServeWS))
+	defer srv.Close()
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var snap versionedSnapshot
+	c.ReadJSON(&snap)
+	c.WriteJSON(map[string]interface{}{"type": "subscribe", "max_rate": 2})
+	c.ReadJSON(&snap)
+
+	start := time.Now()
+	for i := 1; i <= 3; i++ {
+		hub.BroadcastState(StateSnapshot{T: int64(i), Devices: []DeviceSnapshot{{ID: "sw-01", Status: "OK", Ifaces: []IfaceSnapshot{{Name: "eth0", RxBps: float64(i)}}}}})
+	}
+	var delta StateDelta
+	if err := c.ReadJSON(&delta); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || delta.T != 3 || delta.Devices[0].Ifaces[0].RxBps != 3 {
+		t.Fatalf("expected one coalesced delta after the rate cap, got %+v after %s", delta, elapsed)
+	}
+}
+
+func TestWebSocketSlowClientDisconnected(t *testing.T) {
+	hub := NewHub()
+	hub.wsQueue = 2
+	hub.wsSlowTimeout = 200 * time.Millisecond
+	go hub.Run()
+	srv := httptest.NewServer(http.HandlerFunc(hub.ServeWS))
+	defer srv.Close()
+	// a client that never reads
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fast, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	received := make(chan int64, 1024)
+	go func() {
+		for {
+			var m struct{ T int64 }
+			if err := fast.ReadJSON(&m); err != nil {
+				return
+			}
+			received <- m.T
+		}
+	}()
+
+	devices := make([]DeviceSnapshot, 2000)
+	for i := range devices {
+		// long ids make each snapshot big enough to fill the socket buffers
+		devices[i] = DeviceSnapshot{ID: fmt.Sprintf("sw-%04d-%s", i, strings.Repeat("x", 200)), Status: "OK"}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for i := int64(1); ; i++ {
+		for j := range devices {
+			devices[j].Ifaces = []IfaceSnapshot{{Name: "eth0", RxBps: float64(i)}}
+		}
+		hub.BroadcastState(StateSnapshot{T: i, Devices: append([]DeviceSnapshot(nil), devices...)})
+		time.Sleep(20 * time.Millisecond)
+		hub.mu.Lock()
+		n := len(hub.clients)
+		hub.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slow client was never disconnected")
+		}
+	}
+	// the reading client kept getting updates
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("fast client starved by the slow one")
+	}
+}
+
+func TestWebSocketSlowClockStopsOnceDrained(t *testing.T) {
+	hub := NewHub()
+	c := &wsClient{send: make(chan []byte, 1)}
+	s0 := StateSnapshot{T: 1, Devices: []DeviceSnapshot{{ID: "sw-01", Status: "OK"}}}
+	hub.wsState = s0
+	c.sent = c.sub.view(s0)
+	c.send <- []byte("{}") // full
+
+	now := time.Now()
+	hub.wsState = StateSnapshot{T: 2, Devices: []DeviceSnapshot{{ID: "sw-01", Status: "ALERT"}}}
+	hub.sendUpdateLocked(c, now)
+	if !c.pending || c.slowSince.IsZero() {
+		t.Fatalf("a full queue should hold the update and start the slow clock: %+v", c)
+	}
+
+	// the change reverts and the queue drains: nothing is left to queue, but
+	// the client is no longer behind
+	hub.wsState = s0
+	<-c.send
+	hub.sendUpdateLocked(c, now.Add(time.Second))
+	if c.pending || !c.slowSince.IsZero() || len(c.send) != 0 {
+		t.Fatalf("a drained queue should stop the slow clock: %+v", c)
+	}
+}
@@ -8,23 +8,25 @@ import (
 func startDetector(s *State) {
 	ticker := time.NewTicker(1 * time.Second)
 	for range ticker.C {
-		snap := s.evaluateStatuses(time.Now())
-		if s.hub != nil {
-			s.hub.BroadcastState(snap)
-		}
-		log.Printf("detector tick: devices=%d", len(snap.Devices))
+		s.forgetExpired(time.Now())
+		n := s.evaluateStatuses(time.Now())
+		log.Printf("detector tick: devices=%d", n)
 	}
 }
 
-func (s *State) evaluateStatuses(now time.Time) StateSnapshot {
+// evaluateStatuses updates iface and device statuses, marking devices whose
+// status changed dirty, and returns the number of devices.
+func (s *State) evaluateStatuses(now time.Time) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for _, d := range s.Devices {
 		deviceStatus := "OFFLINE"
+		changed := false
 		for _, ifs := range d.Ifaces {
 			ifs.mu.Lock()
-			status := evaluateIfaceStatus(ifs, now, s.offlineAfter, s.alertConsec)
+			status := evaluateIfaceStatus(ifs, now, s.offlineAfter, s.alertConsec, s.utilAlertPct)
+			changed = changed || status != ifs.Status
 			ifs.Status = status
 			if status == "ALERT" {
 				deviceStatus = "ALERT"
@@ -33,18 +35,39 @@ func (s *State) evaluateStatuses(now time.Time) StateSnapshot {
 			}
 			ifs.mu.Unlock()
 		}
+		if deviceStatus == "OK" && now.Before(d.sourceAlertUntil) {
+			deviceStatus = "ALERT"
+		}
+		if changed || deviceStatus != d.Status {
+			s.markDirty(d.ID)
+		}
 		d.Status = deviceStatus
 	}
-	return s.snapshotLocked()
+	return len(s.Devices)
 }
 
-func evaluateIfaceStatus(ifs *IfaceState, now time.Time, offlineAfter time.Duration, alertConsec int) string {
+// evaluateIfaceStatus applies the breach rules to the latest sample. A
+// utilAlertPct above 0 also counts rx or tx utilization at or over it as a
+// breach, for ifaces whose link speed is known.
+func evaluateIfaceStatus(ifs *IfaceState, now time.Time, offlineAfter time.Duration, alertConsec int, utilAlertPct float64) string {
+	if ifs.Stale() {
+		// restored from a checkpoint: keep the saved status until fresh data
+		// arrives, but give up on the iface after offlineAfter
+		if now.Sub(ifs.restoredAt) > offlineAfter {
+			ifs.breaches = 0
+			return "OFFLINE"
+		}
+		return ifs.Status
+	}
 	if now.Sub(ifs.LastSeen) > offlineAfter {
 		ifs.breaches = 0
 		return "OFFLINE"
 	}
 
 	breach := ifs.Last.Drops > 100 || ifs.Last.Q > 20 || ifs.Last.Lat > 5.0
+	if utilAlertPct > 0 && ifs.Last.Speed > 0 {
+		breach = breach || ifs.Last.RxUtilPct() >= utilAlertPct || ifs.Last.TxUtilPct() >= utilAlertPct
+	}
 	if breach {
 		ifs.breaches++
 	} else {
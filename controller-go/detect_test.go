@@ -10,13 +10,13 @@ func TestEvaluateIfaceStatusConsecutive(t *testing.T) {
 	ifs := &IfaceState{LastSeen: now}
 
 	ifs.Last = Sample{Drops: 150}
-	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 3); status != "OK" {
+	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 3, 0); status != "OK" {
 		t.Fatalf("expected OK after first breach, got %s", status)
 	}
-	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 3); status != "OK" {
+	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 3, 0); status != "OK" {
 		t.Fatalf("expected OK after second breach, got %s", status)
 	}
-	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 3); status != "ALERT" {
+	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 3, 0); status != "ALERT" {
 		t.Fatalf("expected ALERT after third breach, got %s", status)
 	}
 	if ifs.breaches != 3 {
@@ -24,7 +24,7 @@ func TestEvaluateIfaceStatusConsecutive(t *testing.T) {
 	}
 
 	ifs.Last = Sample{Drops: 0}
-	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 3); status != "OK" {
+	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 3, 0); status != "OK" {
 		t.Fatalf("expected OK after recovery, got %s", status)
 	}
 	if ifs.breaches != 0 {
@@ -32,7 +32,7 @@ func TestEvaluateIfaceStatusConsecutive(t *testing.T) {
 	}
 
 	ifs.LastSeen = now.Add(-6 * time.Second)
-	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 3); status != "OFFLINE" {
+	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 3, 0); status != "OFFLINE" {
 		t.Fatalf("expected OFFLINE when past offlineAfter, got %s", status)
 	}
 	if ifs.breaches != 0 {
@@ -51,7 +51,8 @@ func TestStateEvaluateStatusesAggregatesDevice(t *testing.T) {
 	state.Devices[device.ID] = device
 	state.mu.Unlock()
 
-	snap := state.evaluateStatuses(now)
+	state.evaluateStatuses(now)
+	snap := state.Snapshot()
 	if got := snap.Devices[0].Status; got != "OK" {
 		t.Fatalf("expected device status OK, got %s", got)
 	}
@@ -61,7 +62,8 @@ func TestStateEvaluateStatusesAggregatesDevice(t *testing.T) {
 		iface.Last = Sample{Drops: 200}
 		iface.LastSeen = now
 		state.mu.Unlock()
-		snap = state.evaluateStatuses(now)
+		state.evaluateStatuses(now)
+		snap = state.Snapshot()
 	}
 	if got := snap.Devices[0].Status; got != "ALERT" {
 		t.Fatalf("expected device status ALERT after consecutive breaches, got %s", got)
@@ -73,7 +75,8 @@ func TestStateEvaluateStatusesAggregatesDevice(t *testing.T) {
 	state.mu.Lock()
 	iface.LastSeen = now.Add(-10 * time.Second)
 	state.mu.Unlock()
-	snap = state.evaluateStatuses(now)
+	state.evaluateStatuses(now)
+	snap = state.Snapshot()
 	if got := snap.Devices[0].Status; got != "OFFLINE" {
 		t.Fatalf("expected device status OFFLINE when iface stale, got %s", got)
 	}
@@ -81,3 +84,28 @@ func TestStateEvaluateStatusesAggregatesDevice(t *testing.T) {
 		t.Fatalf("expected iface status OFFLINE, got %s", snap.Devices[0].Ifaces[0].Status)
 	}
 }
+
+func TestUtilizationThreshold(t *testing.T) {
+	now := time.Now()
+	ifs := &IfaceState{LastSeen: now}
+
+	// 950 Mbps on a 1G link is 95%
+	ifs.Last = Sample{Rx: 9.5e8, Speed: 1e9}
+	if got := ifs.Last.RxUtilPct(); got != 95 {
+		t.Fatalf("rx utilization = %v, want 95", got)
+	}
+	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 1, 0); status != "OK" {
+		t.Fatalf("expected OK with the threshold disabled, got %s", status)
+	}
+	if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 1, 90); status != "ALERT" {
+		t.Fatalf("expected ALERT at 95%% against a 90%% threshold, got %s", status)
+	}
+
+	// the same rate is idle on a 100G link, and unknown speed never breaches
+	for _, speed := range []float64{1e11, 0} {
+		ifs.Last = Sample{Rx: 9.5e8, Speed: speed}
+		if status := evaluateIfaceStatus(ifs, now, 5*time.Second, 1, 90); status != "OK" {
+			t.Fatalf("speed %v: expected OK, got %s", speed, status)
+		}
+	}
+}
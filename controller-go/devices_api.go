@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDeviceLimit = 100
+	maxDeviceLimit     = 1000
+)
+
+type SampleView struct {
+	Ts         int64   `json:"ts"`
+	RxBps      float64 `json:"rx_bps"`
+	TxBps      float64 `json:"tx_bps"`
+	Drops      uint32  `json:"drops"`
+	QueueDepth int32   `json:"queue_depth"`
+	LatencyMs  float64 `json:"latency_ms"`
+	Seq        uint64  `json:"seq"`
+	// omitted while the link speed is unknown
+	SpeedBps  float64 `json:"speed_bps,omitempty"`
+	RxUtilPct float64 `json:"rx_util_pct,omitempty"`
+	TxUtilPct float64 `json:"tx_util_pct,omitempty"`
+}
+
+type EWMAView struct {
+	RxBps     float64 `json:"rx_bps"`
+	TxBps     float64 `json:"tx_bps"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// IfaceInfo is the catalog view of one iface. Times are Unix epoch ms.
+type IfaceInfo struct {
+	Name      string     `json:"name"`
+	Status    string     `json:"status"`
+	Stale     bool       `json:"stale,omitempty"`
+	FirstSeen int64      `json:"first_seen"`
+	LastSeen  int64      `json:"last_seen"`
+	Messages  uint64     `json:"messages"`
+	Breaches  int        `json:"breaches"`
+	Last      SampleView `json:"last"`
+	EWMA      EWMAView   `json:"ewma"`
+	// SpeedBps is the current link speed: the inventory's, else the agent's
+	SpeedBps         float64 `json:"speed_bps,omitempty"`
+	ReportedSpeedBps float64 `json:"reported_speed_bps,omitempty"`
+	// from the inventory
+	Description string            `json:"description,omitempty"`
+	Tags        []string          `json:"tags"`
+	Meta        map[string]string `json:"meta"`
+}
+
+// DeviceInfo is the catalog view of one device. LastSeen is the newest
+// LastSeen of its ifaces.
+type DeviceInfo struct {
+	ID         string            `json:"id"`
+	Status     string            `json:"status"`
+	Stale      bool              `json:"stale,omitempty"`
+	FirstSeen  int64             `json:"first_seen"`
+	LastSeen   int64             `json:"last_seen"`
+	Messages   uint64            `json:"messages"`
+	Tags       []string          `json:"tags"`
+	Meta       map[string]string `json:"meta"`
+	Source     *SourceInfo       `json:"source,omitempty"`
+	IfaceCount int               `json:"iface_count"`
+	Ifaces     []IfaceInfo       `json:"ifaces,omitempty"`
+}
+
+func ifaceInfo(name string, ifs *IfaceState) IfaceInfo {
+	ifs.mu.Lock()
+	defer ifs.mu.Unlock()
+	l := ifs.Last
+	return IfaceInfo{
+		Name:      name,
+		Status:    ifs.Status,
+		Stale:     ifs.Stale(),
+		FirstSeen: ifs.FirstSeen.UnixMilli(),
+		LastSeen:  ifs.LastSeen.UnixMilli(),
+		Messages:  ifs.Messages,
+		Breaches:  ifs.breaches,
+		Last: SampleView{Ts: l.Ts, RxBps: l.Rx, TxBps: l.Tx, Drops: l.Drops, QueueDepth: l.Q, LatencyMs: l.Lat, Seq: l.Seq,
+			SpeedBps: l.Speed, RxUtilPct: l.RxUtilPct(), TxUtilPct: l.TxUtilPct()},
+		EWMA:             EWMAView{RxBps: ifs.EWMARx, TxBps: ifs.EWMATx, LatencyMs: ifs.EWMALat},
+		SpeedBps:         ifs.speed(),
+		ReportedSpeedBps: ifs.ReportedSpeedBps,
+		Description:      ifs.Description,
+		Tags:             append([]string{}, ifs.Tags...),
+		Meta:             copyMeta(ifs.Meta),
+	}
+}
+
+func copyMeta(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// deviceInfoLocked builds d's catalog entry; s.mu must be held.
+func (s *State) deviceInfoLocked(d *Device, withIfaces bool) DeviceInfo {
+	info := DeviceInfo{
+		ID:         d.ID,
+		Status:     d.Status,
+		Stale:      len(d.Ifaces) > 0,
+		FirstSeen:  d.FirstSeen.UnixMilli(),
+		Messages:   d.Messages,
+		Tags:       append([]string{}, d.Tags...),
+		Meta:       copyMeta(d.Meta),
+		Source:     s.sourceInfoLocked(d, time.Now()),
+		IfaceCount: len(d.Ifaces),
+	}
+	for name, ifs := range d.Ifaces {
+		ii := ifaceInfo(name, ifs)
+		info.Stale = info.Stale && ii.Stale
+		if ii.LastSeen > info.LastSeen {
+			info.LastSeen = ii.LastSeen
+		}
+		if withIfaces {
+			info.Ifaces = append(info.Ifaces, ii)
+		}
+	}
+	sort.Slice(info.Ifaces, func(i, j int) bool { return info.Ifaces[i].Name < info.Ifaces[j].Name })
+	return info
+}
+
+// DeviceList returns every device's catalog entry.
+func (s *State) DeviceList(withIfaces bool) []DeviceInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]DeviceInfo, 0, len(s.Devices))
+	for _, d := range s.Devices {
+		out = append(out, s.deviceInfoLocked(d, withIfaces))
+	}
+	return out
+}
+
+func (s *State) DeviceInfo(id string) (DeviceInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.Devices[id]
+	if !ok {
+		return DeviceInfo{}, false
+	}
+	return s.deviceInfoLocked(d, true), true
+}
+
+func (s *State) IfaceInfo(id, name string) (IfaceInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.Devices[id]
+	if !ok {
+		return IfaceInfo{}, false
+	}
+	ifs, ok := d.Ifaces[name]
+	if !ok {
+		return IfaceInfo{}, false
+	}
+	return ifaceInfo(name, ifs), true
+}
+
+// DeviceFilter selects and orders catalog entries.
+type DeviceFilter struct {
+	IDs      []string          // path.Match globs
+	Statuses []string          // any of
+	Tags     []string          // all of
+	Meta     map[string]string // all of, from key:value params
+	Sort     string            // field name, "-" prefix for descending
+	Offset   int
+	Limit    int
+}
+
+var deviceSortKeys = map[string]func(a, b DeviceInfo) int{
+	"id":         func(a, b DeviceInfo) int { return strings.Compare(a.ID, b.ID) },
+	"status":     func(a, b DeviceInfo) int { return strings.Compare(a.Status, b.Status) },
+	"first_seen": func(a, b DeviceInfo) int { return cmpInt64(a.FirstSeen, b.FirstSeen) },
+	"last_seen":  func(a, b DeviceInfo) int { return cmpInt64(a.LastSeen, b.LastSeen) },
+	"messages":   func(a, b DeviceInfo) int { return cmpInt64(int64(a.Messages), int64(b.Messages)) },
+	"ifaces":     func(a, b DeviceInfo) int { return cmpInt64(int64(a.IfaceCount), int64(b.IfaceCount)) },
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func parseDeviceFilter(params url.Values) (DeviceFilter, error) {
+	f := DeviceFilter{
+		IDs:      listParam(params, "id"),
+		Statuses: listParam(params, "status"),
+		Tags:     listParam(params, "tag"),
+		Sort:     params.Get("sort"),
+		Limit:    defaultDeviceLimit,
+	}
+	if f.Sort == "" {
+		f.Sort = "id"
+	}
+	if pairs := listParam(params, "meta"); len(pairs) > 0 {
+		f.Meta = make(map[string]string, len(pairs))
+		for _, p := range pairs {
+			k, v, ok := strings.Cut(p, ":")
+			if !ok || k == "" {
+				return f, fmt.Errorf("meta filter %q is not key:value", p)
+			}
+			f.Meta[k] = v
+		}
+	}
+	if _, ok := deviceSortKeys[strings.TrimPrefix(f.Sort, "-")]; !ok {
+		return f, fmt.Errorf("unknown sort %q", f.Sort)
+	}
+	for i, st := range f.Statuses {
+		f.Statuses[i] = strings.ToUpper(st)
+	}
+	for name, dst := range map[string]*int{"limit": &f.Limit, "offset": &f.Offset} {
+		if v := params.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return f, fmt.Errorf("invalid %s", name)
+			}
+			*dst = n
+		}
+	}
+	if f.Limit < 1 || f.Limit > maxDeviceLimit {
+		return f, fmt.Errorf("limit must be between 1 and %d", maxDeviceLimit)
+	}
+	return f, nil
+}
+
+func (f DeviceFilter) match(d DeviceInfo) bool {
+	if len(f.IDs) > 0 && !matchAny(f.IDs, d.ID) {
+		return false
+	}
+	if len(f.Statuses) > 0 && !containsString(f.Statuses, d.Status) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !containsString(d.Tags, tag) {
+			return false
+		}
+	}
+	for k, v := range f.Meta {
+		if d.Meta[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// apply filters, sorts (ties broken by id) and pages devices, returning the
+// page and the number of matches before paging.
+func (f DeviceFilter) apply(devices []DeviceInfo) ([]DeviceInfo, int) {
+	matched := devices[:0]
+	for _, d := range devices {
+		if f.match(d) {
+			matched = append(matched, d)
+		}
+	}
+	desc := strings.HasPrefix(f.Sort, "-")
+	cmp := deviceSortKeys[strings.TrimPrefix(f.Sort, "-")]
+	sort.SliceStable(matched, func(i, j int) bool {
+		c := cmp(matched[i], matched[j])
+		if c == 0 {
+			return matched[i].ID < matched[j].ID
+		}
+		return (c < 0) != desc
+	})
+	total := len(matched)
+	if f.Offset >= total {
+		return []DeviceInfo{}, total
+	}
+	end := f.Offset + f.Limit
+	if end > total {
+		end = total
+	}
+	return matched[f.Offset:end], total
+}
+
+// registerDevicesAPI serves the read-only catalog and the decommission
+// endpoints; DELETE needs the admin token when one is set.
+func registerDevicesAPI(mux *http.ServeMux, state *State, token string) {
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	mux.HandleFunc("GET /api/devices", func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		f, err := parseDeviceFilter(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		withIfaces := params.Get("include") == "ifaces"
+		page, total := f.apply(state.DeviceList(withIfaces))
+		writeJSON(w, map[string]interface{}{
+			"total":   total,
+			"offset":  f.Offset,
+			"limit":   f.Limit,
+			"devices": page,
+		})
+	})
+
+	mux.HandleFunc("GET /api/devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		info, ok := state.DeviceInfo(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "device not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, info)
+	})
+
+	decommission := func(w http.ResponseWriter, r *http.Request, what string) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !state.Decommission(r.PathValue("id"), r.PathValue("name")) {
+			http.Error(w, what+" not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	mux.HandleFunc("DELETE /api/devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		decommission(w, r, "device")
+	})
+	mux.HandleFunc("DELETE /api/devices/{id}/ifaces/{name...}", func(w http.ResponseWriter, r *http.Request) {
+		decommission(w, r, "iface")
+	})
+
+	// iface names such as "Ethernet1/1" contain slashes, so take the rest
+	mux.HandleFunc("GET /api/devices/{id}/ifaces/{name...}", func(w http.ResponseWriter, r *http.Request) {
+		info, ok := state.IfaceInfo(r.PathValue("id"), r.PathValue("name"))
+		if !ok {
+			http.Error(w, "iface not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, info)
+	})
+}
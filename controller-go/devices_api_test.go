@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDevicesAPI(t *testing.T) {
+	state := NewState(5*time.Second, 1, nil, nil)
+	state.Ingest(Msg{DeviceID: "sw-01", Iface: "Ethernet1/1", TsUnixMs: 1000, RxBps: 10, Seq: 1})
+	state.Ingest(Msg{DeviceID: "sw-01", Iface: "Ethernet1/1", TsUnixMs: 2000, RxBps: 20, Seq: 2})
+	state.Ingest(Msg{DeviceID: "sw-02", Iface: "eth0", TsUnixMs: 1000, Drops: 500, Seq: 1})
+	state.Ingest(Msg{DeviceID: "rtr-01", Iface: "eth0", TsUnixMs: 1000, Seq: 1})
+	state.SetInventory(Inventory{Devices: map[string]DeviceInventory{"sw-02": {Site: "dc1", Tags: []string{"core"}}}})
+	state.evaluateStatuses(time.Now())
+
+	mux := http.NewServeMux()
+	registerDevicesAPI(mux, state, "secret")
+	get := func(path string, want int, v interface{}) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Fatalf("GET %s: status %d, want %d: %s", path, rec.Code, want, rec.Body)
+		}
+		if v != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+		}
+	}
+
+	var list struct {
+		Total   int          `json:"total"`
+		Devices []DeviceInfo `json:"devices"`
+	}
+	get("/api/devices?sort=-messages&limit=2", http.StatusOK, &list)
+	if list.Total != 3 || len(list.Devices) != 2 || list.Devices[0].ID != "sw-01" || list.Devices[0].Messages != 2 {
+		t.Fatalf("unexpected page: %+v", list)
+	}
+	get("/api/devices?id=sw-*&status=alert&tag=core&meta=site:dc1", http.StatusOK, &list)
+	if list.Total != 1 || list.Devices[0].ID != "sw-02" {
+		t.Fatalf("unexpected filtered list: %+v", list)
+	}
+	get("/api/devices?offset=10", http.StatusOK, &list)
+	if list.Total != 3 || len(list.Devices) != 0 {
+		t.Fatalf("offset past the end should return an empty page: %+v", list)
+	}
+	get("/api/devices?sort=bogus", http.StatusBadRequest, nil)
+	get("/api/devices?limit=0", http.StatusBadRequest, nil)
+	get("/api/devices?meta=site", http.StatusBadRequest, nil)
+
+	var dev DeviceInfo
+	get("/api/devices/sw-01", http.StatusOK, &dev)
+	if len(dev.Ifaces) != 1 || dev.LastSeen == 0 || dev.Ifaces[0].EWMA.RxBps != 0.3*20+0.7*10 {
+		t.Fatalf("unexpected device: %+v", dev)
+	}
+	var iface IfaceInfo
+	get("/api/devices/sw-01/ifaces/Ethernet1/1", http.StatusOK, &iface)
+	if iface.Last.Seq != 2 || iface.Messages != 2 {
+		t.Fatalf("unexpected iface: %+v", iface)
+	}
+	get("/api/devices/nope", http.StatusNotFound, nil)
+	get("/api/devices/sw-01/ifaces/eth9", http.StatusNotFound, nil)
+
+	del := func(path, token string, want int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("DELETE %s: status %d, want %d: %s", path, rec.Code, want, rec.Body)
+		}
+	}
+	del("/api/devices/sw-02", "", http.StatusUnauthorized)
+	del("/api/devices/sw-02", "secret", http.StatusNoContent)
+	del("/api/devices/sw-02", "secret", http.StatusNotFound)
+	get("/api/devices/sw-02", http.StatusNotFound, nil)
+	del("/api/devices/sw-01/ifaces/eth9", "secret", http.StatusNotFound)
+	del("/api/devices/sw-01/ifaces/Ethernet1/1", "secret", http.StatusNoContent)
+	get("/api/devices/sw-01", http.StatusNotFound, nil)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// runExport is the "controller export" subcommand: it writes the same CSV or
+// Parquet as /api/history/export straight from a history directory, opened
+// read-only so nothing there is migrated, rolled up or pruned. Badger
+// locks its directory, so stop the controller (or use the HTTP endpoint)
+// before exporting from a Badger store.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	backend := fs.String("history-backend", "badger", `history storage engine: "badger" or "sqlite"`)
+	dir := fs.String("history-dir", "", "history directory to export from")
+	retention := fs.Duration("history-retention", 5*time.Minute, "raw sample retention the controller runs with")
+	retention1m := fs.Duration("history-retention-1m", 24*time.Hour, "1-minute rollup retention the controller runs with")
+	retention1h := fs.Duration("history-retention-1h", 30*24*time.Hour, "1-hour rollup retention the controller runs with")
+	devices := fs.String("device", "", "device ids or globs, comma separated")
+	ifaces := fs.String("iface", "", "iface names or globs, comma separated (empty exports every iface)")
+	start := fs.String("start", "", "range start, RFC3339 or epoch ms (default: --minutes before end)")
+	end := fs.String("end", "", "range end, RFC3339 or epoch ms (default: now)")
+	minutes := fs.Int("minutes", 5, "range length when --start is omitted")
+	resolution := fs.Duration("resolution", 0, "export rollups of the coarsest tier with step <= resolution (0 exports raw samples)")
+	format := fs.String("format", "csv", "output format: csv or parquet")
+	columns := fs.String("columns", "", "columns to write, comma separated (default: all of "+strings.Join(exportColumns, ",")+")")
+	tz := fs.String("tz", "UTC", `timezone for the time column: an IANA name such as "Europe/Berlin", or "local"`)
+	out := fs.String("out", "-", "output file (- writes to stdout)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: controller export --history-dir DIR --device ID [flags]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dir == "" || *backend == "memory" {
+		log.Fatalf("export needs --history-dir and a persistent --history-backend")
+	}
+
+	// reuse the HTTP parameter parsing so both entry points agree
+	params := url.Values{}
+	params.Set("start", *start)
+	params.Set("end", *end)
+	params.Set("minutes", fmt.Sprint(*minutes))
+	e := HistoryExport{
+		Devices:    listParam(url.Values{"d": {*devices}}, "d"),
+		Ifaces:     listParam(url.Values{"i": {*ifaces}}, "i"),
+		Resolution: *resolution,
+		Format:     *format,
+		Columns:    listParam(url.Values{"c": {*columns}}, "c"),
+	}
+	var err error
+	if e.Start, e.End, err = parseRangeParams(params); err != nil {
+		log.Fatalf("export: %v", err)
+	}
+	if e.Location, err = parseExportLocation(*tz); err != nil {
+		log.Fatalf("export: %v", err)
+	}
+
+	tiers := buildTiers(*retention, map[string]time.Duration{"1m": *retention1m, "1h": *retention1h})
+	store, err := openHistoryReader(*backend, *dir, tiers)
+	if err != nil {
+		log.Fatalf("open history: %v", err)
+	}
+	defer store.Close()
+	series, err := prepareExport(store, &e, nil)
+	if err != nil {
+		log.Fatalf("export: %v", err)
+	}
+
+	w := os.Stdout
+	if *out != "-" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatalf("export: %v", err)
+		}
+	}
+	bw := bufio.NewWriterSize(w, 1<<16)
+	if err := writeHistoryExport(bw, store, series, e); err != nil {
+		log.Fatalf("export: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatalf("export: %v", err)
+	}
+	if w != os.Stdout {
+		if err := w.Close(); err != nil {
+			log.Fatalf("export: %v", err)
+		}
+	}
+	log.Printf("exported %d series to %s", len(series), *out)
+}
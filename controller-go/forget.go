@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// lastActivity is when the iface last reported, or when it was restored
+// from a checkpoint if it hasn't reported since.
+func (ifs *IfaceState) lastActivity() time.Time {
+	if ifs.Stale() {
+		return ifs.restoredAt
+	}
+	return ifs.LastSeen
+}
+
+// forgetExpired drops ifaces that haven't reported for forgetAfter, and
+// devices left without ifaces. A zero forgetAfter keeps everything.
+func (s *State) forgetExpired(now time.Time) []Event {
+	if s.forgetAfter <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	var events []Event
+	for id, d := range s.Devices {
+		var expired []string
+		for name, ifs := range d.Ifaces {
+			ifs.mu.Lock()
+			if now.Sub(ifs.lastActivity()) > s.forgetAfter {
+				expired = append(expired, name)
+			}
+			ifs.mu.Unlock()
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		s.markDirty(id)
+		if len(expired) == len(d.Ifaces) {
+			delete(s.Devices, id)
+			events = append(events, Event{Kind: "forgotten", Device: id, Reason: "expired", T: now.UnixMilli(), Tags: d.Tags, Meta: d.Meta})
+			continue
+		}
+		for _, name := range expired {
+			delete(d.Ifaces, name)
+			events = append(events, Event{Kind: "forgotten", Device: id, Iface: name, Reason: "expired", T: now.UnixMilli(), Tags: d.Tags, Meta: d.Meta})
+		}
+	}
+	s.mu.Unlock()
+	s.publishForgotten(events)
+	return events
+}
+
+// Decommission forgets a device, or one of its ifaces when iface is set,
+// right away. It reports false if there was nothing to forget. A device
+// that reports again afterwards comes back as new.
+func (s *State) Decommission(id, iface string) bool {
+	s.mu.Lock()
+	d, ok := s.Devices[id]
+	if ok && iface != "" {
+		_, ok = d.Ifaces[iface]
+	}
+	ev := Event{Kind: "forgotten", Device: id, Reason: "decommissioned"}
+	if ok {
+		ev.Tags, ev.Meta = d.Tags, d.Meta
+		s.markDirty(id)
+		if iface == "" || len(d.Ifaces) == 1 {
+			// a device without ifaces has nothing left to show
+			delete(s.Devices, id)
+			iface = ""
+		} else {
+			delete(d.Ifaces, iface)
+		}
+	}
+	s.mu.Unlock()
+	if ok {
+		ev.Iface, ev.T = iface, time.Now().UnixMilli()
+		s.publishForgotten([]Event{ev})
+	}
+	return ok
+}
+
+func (s *State) publishForgotten(events []Event) {
+	for _, ev := range events {
+		if ev.Iface != "" {
+			log.Printf("forgot iface %s/%s (%s)", ev.Device, ev.Iface, ev.Reason)
+		} else {
+			log.Printf("forgot device %s (%s)", ev.Device, ev.Reason)
+		}
+		cForgotten.WithLabelValues(ev.Reason).Inc()
+		if s.hub != nil {
+			s.hub.BroadcastEvent(ev)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestForgetExpired(t *testing.T) {
+	state := NewState(5*time.Second, 3, nil, nil)
+	state.forgetAfter = time.Hour
+	state.Ingest(Msg{DeviceID: "sw-01", Iface: "eth0", TsUnixMs: 1000, Seq: 1})
+	state.Ingest(Msg{DeviceID: "sw-01", Iface: "eth1", TsUnixMs: 1000, Seq: 1})
+	state.Ingest(Msg{DeviceID: "sw-02", Iface: "eth0", TsUnixMs: 1000, Seq: 1})
+	now := time.Now()
+	state.Devices["sw-01"].Ifaces["eth1"].LastSeen = now.Add(-2 * time.Hour)
+	state.Devices["sw-02"].Ifaces["eth0"].LastSeen = now.Add(-2 * time.Hour)
+	// restored but silent since: expiry counts from the restore
+	state.Devices["sw-01"].Ifaces["eth0"].restoredAt = now.Add(-time.Minute)
+	state.Devices["sw-01"].Ifaces["eth0"].LastSeen = now.Add(-2 * time.Hour)
+
+	events := state.forgetExpired(now)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", events)
+	}
+	if _, ok := state.Devices["sw-02"]; ok {
+		t.Fatalf("sw-02 should be forgotten")
+	}
+	d := state.Devices["sw-01"]
+	if d == nil || len(d.Ifaces) != 1 || d.Ifaces["eth0"] == nil {
+		t.Fatalf("only sw-01/eth1 should be forgotten: %+v", d)
+	}
+
+	if events := state.forgetExpired(now.Add(2 * time.Hour)); len(events) != 1 || events[0].Device != "sw-01" || events[0].Iface != "" {
+		t.Fatalf("expected sw-01 to be forgotten as a whole: %+v", events)
+	}
+}
+
+func TestGaugesDeletedForForgottenDevices(t *testing.T) {
+	newStateGauges(nil)
+	state := NewState(5*time.Second, 3, nil, nil)
+	state.Ingest(Msg{DeviceID: "sw-01", Iface: "eth0", TsUnixMs: 1000, Seq: 1})
+	state.Ingest(Msg{DeviceID: "sw-01", Iface: "eth1", TsUnixMs: 1000, Seq: 1})
+	u := newGaugeUpdater(state, nil)
+	u.update()
+	if n := testutil.CollectAndCount(gRx); n != 2 {
+		t.Fatalf("expected 2 rx series, got %d", n)
+	}
+
+	state.Decommission("sw-01", "eth1")
+	u.update()
+	if n := testutil.CollectAndCount(gRx); n != 1 {
+		t.Fatalf("expected 1 rx series after decommissioning an iface, got %d", n)
+	}
+	state.Decommission("sw-01", "")
+	u.update()
+	if n := testutil.CollectAndCount(gRx) + testutil.CollectAndCount(gStatus); n != 0 {
+		t.Fatalf("expected no series after decommissioning the device, got %d", n)
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -15,7 +21,17 @@ import (
 
 type HistoryStore interface {
 	StoreSample(device, iface string, sample Sample) error
-	FetchSamples(device, iface string, since time.Duration) ([]Sample, error)
+	// FetchSamples returns samples newer than since from the coarsest tier
+	// whose step is <= resolution (0 means raw). Rollup tiers are flattened
+	// to per-bucket averages.
+	FetchSamples(device, iface string, since, resolution time.Duration) ([]Sample, error)
+	// SampleRange is FetchSamples over the absolute range start <= ts < end.
+	SampleRange(device, iface string, start, end time.Time, resolution time.Duration) ([]Sample, error)
+	// RollupRange returns min/max/avg/last/count aggregates at step for
+	// start <= ts < end, computed from the coarsest tier that can produce it.
+	RollupRange(device, iface string, start, end time.Time, step time.Duration) ([]Rollup, error)
+	// ListSeries returns every device/iface pair with stored history.
+	ListSeries() ([]seriesID, error)
 	Enabled() bool
 	Close() error
 }
@@ -23,43 +39,337 @@ type HistoryStore interface {
 type noopHistory struct{}
 
 func (n *noopHistory) StoreSample(string, string, Sample) error { return nil }
-func (n *noopHistory) FetchSamples(string, string, time.Duration) ([]Sample, error) {
+func (n *noopHistory) FetchSamples(string, string, time.Duration, time.Duration) ([]Sample, error) {
+	return nil, errors.New("history disabled")
+}
+func (n *noopHistory) SampleRange(string, string, time.Time, time.Time, time.Duration) ([]Sample, error) {
+	return nil, errors.New("history disabled")
+}
+func (n *noopHistory) RollupRange(string, string, time.Time, time.Time, time.Duration) ([]Rollup, error) {
+	return nil, errors.New("history disabled")
+}
+func (n *noopHistory) ListSeries() ([]seriesID, error) {
 	return nil, errors.New("history disabled")
 }
 func (n *noopHistory) Enabled() bool { return false }
 func (n *noopHistory) Close() error  { return nil }
 
+const (
+	// rollups only cover buckets that closed at least this long ago so late
+	// samples still land before their bucket is summarised
+	rollupGrace    = 10 * time.Second
+	rollupInterval = 30 * time.Second
+)
+
+// Badger key layout. Everything lives under a 0x01 prefix no device id
+// starts with; unprefixed "device|iface|<ts>" keys holding one JSON Sample
+// each are the pre-chunk layout and are migrated on open.
+//
+//	\x01c|device|iface|<start>     raw samples from start for chunkSpan
+//	                               (encodeChunk; start is 8 bytes big-endian)
+//	\x01c|device|iface|<start><n>  part n of that chunk, one per write batch;
+//	                               compactChunks folds parts into the chunk
+//	                               once its span has closed
+//	\x01r|<tier>|device|iface|<ts>  Rollup (JSON)
+//	\x01s|device|iface             seriesID (JSON), one per known series
+//	\x01w|<tier>|device|iface      rollup watermark: buckets before it are done
+//	\x01v                          storage schema version
+const (
+	metaPrefix    = "\x01"
+	schemaKey     = metaPrefix + "v"
+	schemaVersion = "2"
+
+	// raw samples are grouped into chunks of this span
+	chunkSpan = 10 * time.Minute
+	// how often the parts of closed chunks are compacted
+	compactInterval = time.Minute
+)
+
+type seriesID struct {
+	Device string `json:"device"`
+	Iface  string `json:"iface"`
+}
+
+func (s seriesID) String() string { return s.Device + "|" + s.Iface }
+
 type badgerHistory struct {
+	*tieredHistory
 	db  *badger.DB
 	ttl time.Duration
+
+	mu sync.Mutex
+	// known series and when their index key was last (re)written
+	known map[string]time.Time
+
+	// orders chunk parts; seeded from the clock so parts written after a
+	// restart sort after earlier ones
+	nextPart atomic.Uint64
+}
+
+func (b *badgerHistory) chunkPrefix(s seriesID) []byte {
+	return []byte(metaPrefix + "c|" + s.String() + "|")
+}
+
+func (b *badgerHistory) chunkKey(s seriesID, start int64) []byte {
+	return binary.BigEndian.AppendUint64(b.chunkPrefix(s), uint64(start))
 }
 
-func (b *badgerHistory) key(device, iface string, ts int64) []byte {
-	return []byte(fmt.Sprintf("%s|%s|%020d", device, iface, ts))
+func (b *badgerHistory) rollupKey(tier string, s seriesID, ts int64) []byte {
+	return []byte(fmt.Sprintf("%sr|%s|%s|%s|%020d", metaPrefix, tier, s.Device, s.Iface, ts))
+}
+
+func (b *badgerHistory) seriesKey(s seriesID) []byte {
+	return []byte(metaPrefix + "s|" + s.String())
+}
+
+func (b *badgerHistory) watermarkKey(tier string, s seriesID) []byte {
+	return []byte(metaPrefix + "w|" + tier + "|" + s.String())
 }
 
 func (b *badgerHistory) StoreSample(device, iface string, sample Sample) error {
-	entryBytes, err := json.Marshal(sample)
+	return b.StoreBatch([]seriesSample{{id: seriesID{Device: device, Iface: iface}, sample: sample}})
+}
+
+// StoreBatch writes each chunk's share of the batch as a new part of that
+// chunk, through a single WriteBatch. Nothing is read back, so a write costs
+// the size of the batch rather than of the chunks it touches.
+func (b *badgerHistory) StoreBatch(batch []seriesSample) error {
+	type chunkRef struct {
+		s     seriesID
+		start int64
+	}
+	incoming := make(map[chunkRef][]Sample)
+	wb := b.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, rec := range batch {
+		if index := b.noteSample(rec.id, rec.sample.Ts); index != nil {
+			if err := wb.SetEntry(index); err != nil {
+				return err
+			}
+		}
+		ref := chunkRef{rec.id, bucketStart(rec.sample.Ts, chunkSpan)}
+		incoming[ref] = append(incoming[ref], rec.sample)
+	}
+
+	now := time.Now()
+	for ref, samples := range incoming {
+		expires := time.UnixMilli(ref.start).Add(chunkSpan + b.ttl)
+		if !expires.After(now) {
+			continue
+		}
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Ts < samples[j].Ts })
+		key := binary.BigEndian.AppendUint64(b.chunkKey(ref.s, ref.start), b.nextPart.Add(1))
+		e := badger.NewEntry(key, encodeChunk(mergeChunkSamples(nil, samples)))
+		e.ExpiresAt = uint64(expires.Unix())
+		if err := wb.SetEntry(e); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// eachChunk calls fn for every chunk of s starting in [from, to) with its
+// samples, the sealed chunk and its parts merged in write order, and the
+// keys they were read from.
+func (b *badgerHistory) eachChunk(txn *badger.Txn, s seriesID, from, to int64, fn func(start int64, samples []Sample, keys [][]byte) error) error {
+	prefix := b.chunkPrefix(s)
+	it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: prefix})
+	defer it.Close()
+	var cur int64
+	var merged []Sample
+	var keys [][]byte
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		err := fn(cur, merged, keys)
+		merged, keys = nil, nil
+		return err
+	}
+	for it.Seek(b.chunkKey(s, from)); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		rest := item.Key()[len(prefix):]
+		if len(rest) != 8 && len(rest) != 16 {
+			continue
+		}
+		start := int64(binary.BigEndian.Uint64(rest))
+		if start >= to {
+			break
+		}
+		if start != cur {
+			if err := flush(); err != nil {
+				return err
+			}
+			cur = start
+		}
+		// the sealed chunk sorts before its parts, and parts in write order,
+		// so later writes of a timestamp win
+		err := item.Value(func(val []byte) error {
+			samples, err := decodeChunk(val)
+			if err != nil {
+				return err
+			}
+			merged = mergeChunkSamples(merged, samples)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		keys = append(keys, item.KeyCopy(nil))
+	}
+	return flush()
+}
+
+// compactLoop periodically compacts closed chunks until the store closes.
+func (b *badgerHistory) compactLoop() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			if err := b.compactChunks(now); err != nil {
+				log.Printf("history compaction failed: %v", err)
+			}
+		}
+	}
+}
+
+// compactChunks rewrites every chunk that has parts and whose span closed
+// before now as a single sealed chunk. Samples arriving for it later add
+// parts again, which the next pass folds in.
+func (b *badgerHistory) compactChunks(now time.Time) error {
+	series, err := b.ListSeries()
 	if err != nil {
 		return err
 	}
-	e := badger.NewEntry(b.key(device, iface, sample.Ts), entryBytes).WithTTL(b.ttl)
-	return b.db.Update(func(txn *badger.Txn) error {
-		return txn.SetEntry(e)
+	closed := bucketStart(now.Add(-rollupGrace).UnixMilli(), chunkSpan)
+	for _, s := range series {
+		if err := b.compactSeries(s, closed, now); err != nil {
+			return fmt.Errorf("series %s: %w", s, err)
+		}
+	}
+	return nil
+}
+
+func (b *badgerHistory) compactSeries(s seriesID, closed int64, now time.Time) error {
+	prefix := b.chunkPrefix(s)
+	var pending []int64
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			rest := it.Item().Key()[len(prefix):]
+			if len(rest) != 16 {
+				continue
+			}
+			start := int64(binary.BigEndian.Uint64(rest))
+			if start >= closed {
+				break
+			}
+			if n := len(pending); n == 0 || pending[n-1] != start {
+				pending = append(pending, start)
+			}
+		}
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+	for _, start := range pending {
+		err := b.db.Update(func(txn *badger.Txn) error {
+			var samples []Sample
+			var keys [][]byte
+			err := b.eachChunk(txn, s, start, start+1, func(_ int64, merged []Sample, read [][]byte) error {
+				samples, keys = merged, read
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+			expires := time.UnixMilli(start).Add(chunkSpan + b.ttl)
+			if len(samples) == 0 || !expires.After(now) {
+				return nil
+			}
+			e := badger.NewEntry(b.chunkKey(s, start), encodeChunk(samples))
+			e.ExpiresAt = uint64(expires.Unix())
+			return txn.SetEntry(e)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (b *badgerHistory) FetchSamples(device, iface string, since time.Duration) ([]Sample, error) {
-	cutoff := time.Now().Add(-since).UnixMilli()
-	prefix := []byte(fmt.Sprintf("%s|%s|", device, iface))
-	out := make([]Sample, 0, 128)
+// noteSample marks the series dirty from ts and returns a series index entry
+// when the series is new to this process or its index key is due a refresh.
+func (b *badgerHistory) noteSample(s seriesID, ts int64) *badger.Entry {
+	key := s.String()
+	maxTTL := b.tiers[len(b.tiers)-1].ttl
+	b.markDirty(s, ts)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if last, ok := b.known[key]; ok && time.Since(last) < maxTTL/2 {
+		return nil
+	}
+	b.known[key] = time.Now()
+	val, _ := json.Marshal(s)
+	return badger.NewEntry(b.seriesKey(s), val).WithTTL(maxTTL)
+}
 
+// rangeRaw returns raw samples with start <= ts < end in time order.
+func (b *badgerHistory) rangeRaw(s seriesID, start, end int64) ([]Sample, error) {
+	// chunks expire as a whole; hide their samples that are past retention
+	if cutoff := time.Now().Add(-b.ttl).UnixMilli(); start < cutoff {
+		start = cutoff
+	}
+	out := make([]Sample, 0, 128)
 	err := b.db.View(func(txn *badger.Txn) error {
+		return b.eachChunk(txn, s, bucketStart(start, chunkSpan), end, func(_ int64, samples []Sample, _ [][]byte) error {
+			for _, smp := range samples {
+				if smp.Ts >= start && smp.Ts < end {
+					out = append(out, smp)
+				}
+			}
+			return nil
+		})
+	})
+	return out, err
+}
+
+// rangeRollups returns a tier's rollups with start <= ts < end in time order.
+func (b *badgerHistory) rangeRollups(tier string, s seriesID, start, end int64) ([]Rollup, error) {
+	prefix := []byte(fmt.Sprintf("%sr|%s|%s|%s|", metaPrefix, tier, s.Device, s.Iface))
+	out := make([]Rollup, 0, 64)
+	err := b.scan(prefix, b.rollupKey(tier, s, start), end, func(val []byte) error {
+		var r Rollup
+		if err := json.Unmarshal(val, &r); err != nil {
+			return err
+		}
+		out = append(out, r)
+		return nil
+	})
+	return out, err
+}
+
+// scan walks keys under prefix from seek while their trailing timestamp is
+// below end.
+func (b *badgerHistory) scan(prefix, seek []byte, end int64, fn func(val []byte) error) error {
+	return b.db.View(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.IteratorOptions{
 			PrefetchValues: true,
+			Prefix:         prefix,
 		})
 		defer it.Close()
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			key := string(item.Key())
 			tsPart := key[strings.LastIndex(key, "|")+1:]
@@ -67,44 +377,270 @@ func (b *badgerHistory) FetchSamples(device, iface string, since time.Duration)
 			if err != nil {
 				continue
 			}
-			if ts < cutoff {
-				continue
+			if ts >= end {
+				break
 			}
-			err = item.Value(func(val []byte) error {
-				var sample Sample
-				if err := json.Unmarshal(val, &sample); err != nil {
-					return err
-				}
-				out = append(out, sample)
-				return nil
-			})
-			if err != nil {
+			if err := item.Value(fn); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
-	return out, err
+}
+
+func (b *badgerHistory) ListSeries() ([]seriesID, error) {
+	var series []seriesID
+	err := b.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(metaPrefix + "s|")
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: prefix})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var s seriesID
+			if err := it.Item().Value(func(val []byte) error { return json.Unmarshal(val, &s) }); err != nil {
+				return err
+			}
+			series = append(series, s)
+		}
+		return nil
+	})
+	return series, err
+}
+
+// writeRollups stores rollups (expiring ttl after their bucket) and advances
+// the tier watermark to end in one batch.
+func (b *badgerHistory) writeRollups(t historyTier, s seriesID, rollups []Rollup, end int64, now time.Time) error {
+	wb := b.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, r := range rollups {
+		expires := time.UnixMilli(r.Ts).Add(t.step + t.ttl)
+		if !expires.After(now) {
+			continue
+		}
+		val, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		e := badger.NewEntry(b.rollupKey(t.name, s, r.Ts), val)
+		e.ExpiresAt = uint64(expires.Unix())
+		if err := wb.SetEntry(e); err != nil {
+			return err
+		}
+	}
+	wm := badger.NewEntry(b.watermarkKey(t.name, s), []byte(strconv.FormatInt(end, 10))).WithTTL(t.ttl)
+	if err := wb.SetEntry(wm); err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+func (b *badgerHistory) watermark(tier string, s seriesID) (int64, bool, error) {
+	var wm int64
+	found := false
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(b.watermarkKey(tier, s))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			v, err := strconv.ParseInt(string(val), 10, 64)
+			wm, found = v, err == nil
+			return nil
+		})
+	})
+	return wm, found, err
 }
 
 func (b *badgerHistory) Enabled() bool { return true }
 
+// Backup streams a full, consistent copy of the database.
+func (b *badgerHistory) Backup(w io.Writer) error {
+	_, err := b.db.Backup(w, 0)
+	return err
+}
+
 func (b *badgerHistory) Close() error {
+	b.stop()
 	return b.db.Close()
 }
 
-func openHistoryStore(dir string, ttl time.Duration) (HistoryStore, error) {
+// openHistoryStore opens the history backend: "badger" or "sqlite" under
+// dir, or "memory" keeping up to memorySamples raw samples per series.
+// tiers[0] is the raw tier; any further tiers are maintained by a
+// background rollup job.
+func openHistoryStore(backend, dir string, tiers []historyTier, memorySamples int) (HistoryStore, error) {
+	if backend == "memory" {
+		return openMemoryHistory(tiers, memorySamples)
+	}
 	if strings.TrimSpace(dir) == "" {
 		return &noopHistory{}, nil
 	}
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return nil, fmt.Errorf("creating history dir: %w", err)
 	}
+	switch backend {
+	case "badger":
+		return openBadgerHistory(dir, tiers)
+	case "sqlite":
+		return openSQLiteHistory(dir, tiers)
+	}
+	return nil, fmt.Errorf("unknown history backend %q", backend)
+}
+
+// openHistoryReader opens an existing "badger" or "sqlite" history under dir
+// for reading only: nothing is written, migrated, rolled up or pruned, and
+// no background jobs start. Expired data is still hidden on read.
+func openHistoryReader(backend, dir string, tiers []historyTier) (HistoryStore, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	switch backend {
+	case "badger":
+		return openBadgerReader(dir, tiers)
+	case "sqlite":
+		return openSQLiteReader(dir, tiers)
+	}
+	return nil, fmt.Errorf("history backend %q can't be opened read-only", backend)
+}
+
+func openBadgerHistory(dir string, tiers []historyTier) (*badgerHistory, error) {
 	opts := badger.DefaultOptions(filepath.Clean(dir))
 	opts = opts.WithLogger(nil)
 	db, err := badger.Open(opts)
 	if err != nil {
 		return nil, err
 	}
-	return &badgerHistory{db: db, ttl: ttl}, nil
+	b := &badgerHistory{
+		db:    db,
+		ttl:   tiers[0].ttl,
+		known: make(map[string]time.Time),
+	}
+	b.nextPart.Store(uint64(time.Now().UnixNano()))
+	b.tieredHistory = newTieredHistory(b, tiers)
+	if err := b.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating history: %w", err)
+	}
+	b.start()
+	b.wg.Add(1)
+	go b.compactLoop()
+	return b, nil
+}
+
+// openBadgerReader opens an existing Badger history read-only, without the
+// migration, rollup and compaction jobs; chunk parts are merged on read.
+func openBadgerReader(dir string, tiers []historyTier) (*badgerHistory, error) {
+	opts := badger.DefaultOptions(filepath.Clean(dir))
+	opts = opts.WithLogger(nil).WithReadOnly(true)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	b := &badgerHistory{
+		db:    db,
+		ttl:   tiers[0].ttl,
+		known: make(map[string]time.Time),
+	}
+	b.tieredHistory = newTieredHistory(b, tiers)
+	if version, err := b.schema(); err != nil || version != schemaVersion {
+		db.Close()
+		if err == nil {
+			err = errors.New("history predates the chunked layout; start the controller on it once to migrate")
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// schema returns the recorded schema version, "" when there is none.
+func (b *badgerHistory) schema() (string, error) {
+	var version string
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(schemaKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		version = string(val)
+		return err
+	})
+	return version, err
+}
+
+// migrate converts pre-chunk per-sample JSON keys into chunks and records
+// the schema version so later opens skip the scan.
+func (b *badgerHistory) migrate() error {
+	version, err := b.schema()
+	if err != nil || version == schemaVersion {
+		return err
+	}
+
+	const migrateBatch = 10000
+	var batch []seriesSample
+	var legacy [][]byte
+	migrated := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := b.StoreBatch(batch); err != nil {
+			return err
+		}
+		wb := b.db.NewWriteBatch()
+		defer wb.Cancel()
+		for _, k := range legacy {
+			if err := wb.Delete(k); err != nil {
+				return err
+			}
+		}
+		if err := wb.Flush(); err != nil {
+			return err
+		}
+		migrated += len(batch)
+		batch, legacy = batch[:0], legacy[:0]
+		return nil
+	}
+	err = b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		// prefixed keys sort first; legacy keys are everything after them
+		for it.Seek([]byte{metaPrefix[0] + 1}); it.Valid(); it.Next() {
+			item := it.Item()
+			key := string(item.Key())
+			parts := strings.Split(key, "|")
+			if len(parts) < 3 {
+				continue
+			}
+			var sample Sample
+			if err := item.Value(func(val []byte) error { return json.Unmarshal(val, &sample) }); err != nil {
+				log.Printf("history migration: skipping %q: %v", key, err)
+				continue
+			}
+			// device ids may contain '|'; the iface and ts are the last two parts
+			n := len(parts)
+			id := seriesID{Device: strings.Join(parts[:n-2], "|"), Iface: parts[n-2]}
+			batch = append(batch, seriesSample{id: id, sample: sample})
+			legacy = append(legacy, item.KeyCopy(nil))
+			if len(batch) >= migrateBatch {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	if migrated > 0 {
+		log.Printf("history: migrated %d samples to chunked storage", migrated)
+	}
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(schemaKey), []byte(schemaVersion))
+	})
 }
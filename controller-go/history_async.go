@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// seriesSample is one pending history write.
+type seriesSample struct {
+	id     seriesID
+	sample Sample
+}
+
+// batchStore is implemented by backends that can commit many samples at once.
+type batchStore interface {
+	StoreBatch(batch []seriesSample) error
+}
+
+var errHistoryClosed = errors.New("history store closed")
+
+// asyncHistory decouples ingest from disk: StoreSample enqueues and a single
+// writer commits batches when batchSize samples are pending or flushEvery
+// elapses. Reads go straight to the wrapped store, so samples still queued
+// are not visible yet.
+type asyncHistory struct {
+	store      HistoryStore
+	queue      chan seriesSample
+	batchSize  int
+	flushEvery time.Duration
+	block      bool         // on a full queue, wait (backpressure) instead of dropping
+	pending    atomic.Int64 // queued plus batched, not yet committed
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+}
+
+func newAsyncHistory(store HistoryStore, queueSize, batchSize int, flushEvery time.Duration, overflow string) (*asyncHistory, error) {
+	if queueSize < 1 || batchSize < 1 {
+		return nil, errors.New("history queue and batch sizes must be positive")
+	}
+	if flushEvery <= 0 {
+		return nil, errors.New("history flush interval must be positive")
+	}
+	if overflow != "drop" && overflow != "block" {
+		return nil, errors.New(`history overflow policy must be "drop" or "block"`)
+	}
+	a := &asyncHistory{
+		store:      store,
+		queue:      make(chan seriesSample, queueSize),
+		batchSize:  batchSize,
+		flushEvery: flushEvery,
+		block:      overflow == "block",
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+func (a *asyncHistory) StoreSample(device, iface string, sample Sample) error {
+	select {
+	case <-a.closing:
+		return errHistoryClosed
+	default:
+	}
+	rec := seriesSample{id: seriesID{Device: device, Iface: iface}, sample: sample}
+	// counted before the send, so the writer can't commit it first and take
+	// the gauge below zero
+	a.addPending(1)
+	if a.block {
+		select {
+		case a.queue <- rec:
+		case <-a.closing:
+			a.addPending(-1)
+			return errHistoryClosed
+		}
+	} else {
+		select {
+		case a.queue <- rec:
+		case <-a.closing:
+			a.addPending(-1)
+			return errHistoryClosed
+		default:
+			a.addPending(-1)
+			cHistoryDropped.Inc()
+		}
+	}
+	return nil
+}
+
+func (a *asyncHistory) addPending(n int64) {
+	gHistoryQueue.Set(float64(a.pending.Add(n)))
+}
+
+func (a *asyncHistory) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.flushEvery)
+	defer ticker.Stop()
+	batch := make([]seriesSample, 0, a.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		start := time.Now()
+		if err := a.commit(batch); err != nil {
+			log.Printf("history batch of %d failed: %v", len(batch), err)
+		}
+		hHistoryWrite.Observe(time.Since(start).Seconds())
+		a.addPending(-int64(len(batch)))
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case rec := <-a.queue:
+			batch = append(batch, rec)
+			if len(batch) >= a.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-a.closing:
+			// drain whatever was accepted before Close
+			for {
+				select {
+				case rec := <-a.queue:
+					batch = append(batch, rec)
+					if len(batch) >= a.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *asyncHistory) commit(batch []seriesSample) error {
+	if bs, ok := a.store.(batchStore); ok {
+		return bs.StoreBatch(batch)
+	}
+	var firstErr error
+	for _, rec := range batch {
+		if err := a.store.StoreSample(rec.id.Device, rec.id.Iface, rec.sample); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (a *asyncHistory) FetchSamples(device, iface string, since, resolution time.Duration) ([]Sample, error) {
+	return a.store.FetchSamples(device, iface, since, resolution)
+}
+
+func (a *asyncHistory) SampleRange(device, iface string, start, end time.Time, resolution time.Duration) ([]Sample, error) {
+	return a.store.SampleRange(device, iface, start, end, resolution)
+}
+
+func (a *asyncHistory) RollupRange(device, iface string, start, end time.Time, step time.Duration) ([]Rollup, error) {
+	return a.store.RollupRange(device, iface, start, end, step)
+}
+
+func (a *asyncHistory) ListSeries() ([]seriesID, error) { return a.store.ListSeries() }
+func (a *asyncHistory) Enabled() bool                   { return a.store.Enabled() }
+
+// Close flushes everything queued, then closes the wrapped store.
+func (a *asyncHistory) Close() error {
+	a.closeOnce.Do(func() { close(a.closing) })
+	<-a.done
+	return a.store.Close()
+}
+
+// withOptional returns a along with whichever optional interfaces the
+// wrapped store implements, so type assertions on the result see what the
+// backend supports rather than what the wrapper could forward.
+func (a *asyncHistory) withOptional() HistoryStore {
+	if b, ok := a.store.(historyBackup); ok {
+		return asyncBackupHistory{a, b}
+	}
+	return a
+}
+
+// asyncBackupHistory is an asyncHistory over a store that can back up.
+type asyncBackupHistory struct {
+	*asyncHistory
+	backup historyBackup
+}
+
+// Backup passes through to the wrapped store. Samples still queued are not
+// part of the backup.
+func (a asyncBackupHistory) Backup(w io.Writer) error { return a.backup.Backup(w) }
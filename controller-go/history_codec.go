@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// chunk encoding versions; the first byte of every chunk value. v2 adds
+// the link speed after latency; v1 chunks decode with speed 0.
+const (
+	chunkV1 byte = 1
+	chunkV2 byte = 2
+)
+
+// encodeChunk packs time-ordered samples into a compact chunk:
+//
+//	version byte, uvarint count, then per sample:
+//	  ts     varint delta-of-delta (first: raw ts, second: plain delta)
+//	  rx/tx/lat/speed  XOR against the previous value, stored as a control byte
+//	         (leading zero bytes << 4 | significant byte count, 0 = repeat)
+//	         followed by the significant bytes
+//	  drops/q/seq  zigzag varint delta against the previous value
+//
+// Telemetry changes slowly and arrives at a steady period, so most samples
+// shrink to a handful of bytes versus ~90 for the JSON encoding.
+func encodeChunk(samples []Sample) []byte {
+	buf := make([]byte, 0, 16+len(samples)*12)
+	buf = append(buf, chunkV2)
+	buf = binary.AppendUvarint(buf, uint64(len(samples)))
+	var prev Sample
+	var prevDelta int64
+	for i, s := range samples {
+		switch i {
+		case 0:
+			buf = binary.AppendVarint(buf, s.Ts)
+		case 1:
+			prevDelta = s.Ts - prev.Ts
+			buf = binary.AppendVarint(buf, prevDelta)
+		default:
+			delta := s.Ts - prev.Ts
+			buf = binary.AppendVarint(buf, delta-prevDelta)
+			prevDelta = delta
+		}
+		buf = appendXOR(buf, prev.Rx, s.Rx)
+		buf = appendXOR(buf, prev.Tx, s.Tx)
+		buf = appendXOR(buf, prev.Lat, s.Lat)
+		buf = appendXOR(buf, prev.Speed, s.Speed)
+		buf = binary.AppendVarint(buf, int64(s.Drops)-int64(prev.Drops))
+		buf = binary.AppendVarint(buf, int64(s.Q)-int64(prev.Q))
+		buf = binary.AppendVarint(buf, int64(s.Seq-prev.Seq))
+		prev = s
+	}
+	return buf
+}
+
+func appendXOR(buf []byte, prev, cur float64) []byte {
+	x := math.Float64bits(prev) ^ math.Float64bits(cur)
+	if x == 0 {
+		return append(buf, 0)
+	}
+	lead := bits.LeadingZeros64(x) / 8
+	trail := bits.TrailingZeros64(x) / 8
+	n := 8 - lead - trail
+	buf = append(buf, byte(lead<<4|n))
+	x >>= uint(trail * 8)
+	for i := n - 1; i >= 0; i-- {
+		buf = append(buf, byte(x>>(uint(i)*8)))
+	}
+	return buf
+}
+
+var errChunkCorrupt = errors.New("corrupt history chunk")
+
+func decodeChunk(b []byte) ([]Sample, error) {
+	if len(b) == 0 {
+		return nil, errChunkCorrupt
+	}
+	version := b[0]
+	if version != chunkV1 && version != chunkV2 {
+		return nil, fmt.Errorf("unsupported history chunk version %d", version)
+	}
+	d := chunkDecoder{b: b[1:]}
+	count := d.uvarint()
+	if d.err != nil || count > uint64(len(b)) {
+		return nil, errChunkCorrupt
+	}
+	out := make([]Sample, 0, count)
+	var prev Sample
+	var prevDelta int64
+	for i := uint64(0); i < count; i++ {
+		var s Sample
+		switch i {
+		case 0:
+			s.Ts = d.varint()
+		case 1:
+			prevDelta = d.varint()
+			s.Ts = prev.Ts + prevDelta
+		default:
+			prevDelta += d.varint()
+			s.Ts = prev.Ts + prevDelta
+		}
+		s.Rx = d.xor(prev.Rx)
+		s.Tx = d.xor(prev.Tx)
+		s.Lat = d.xor(prev.Lat)
+		if version >= chunkV2 {
+			s.Speed = d.xor(prev.Speed)
+		}
+		s.Drops = uint32(int64(prev.Drops) + d.varint())
+		s.Q = int32(int64(prev.Q) + d.varint())
+		s.Seq = prev.Seq + uint64(d.varint())
+		if d.err != nil {
+			return nil, d.err
+		}
+		out = append(out, s)
+		prev = s
+	}
+	return out, nil
+}
+
+type chunkDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *chunkDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errChunkCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *chunkDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errChunkCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *chunkDecoder) xor(prev float64) float64 {
+	if d.err != nil || len(d.b) == 0 {
+		d.err = errChunkCorrupt
+		return 0
+	}
+	ctl := d.b[0]
+	d.b = d.b[1:]
+	if ctl == 0 {
+		return prev
+	}
+	lead, n := int(ctl>>4), int(ctl&0x0f)
+	if n == 0 || lead+n > 8 || len(d.b) < n {
+		d.err = errChunkCorrupt
+		return 0
+	}
+	var x uint64
+	for i := 0; i < n; i++ {
+		x = x<<8 | uint64(d.b[i])
+	}
+	d.b = d.b[n:]
+	x <<= uint((8 - lead - n) * 8)
+	return math.Float64frombits(math.Float64bits(prev) ^ x)
+}
+
+// mergeChunkSamples merges time-ordered incoming samples into a chunk's
+// existing samples. A sample with the same timestamp replaces the old one,
+// matching the overwrite semantics of one-key-per-sample storage.
+func mergeChunkSamples(existing, incoming []Sample) []Sample {
+	out := make([]Sample, 0, len(existing)+len(incoming))
+	i, j := 0, 0
+	for i < len(existing) || j < len(incoming) {
+		switch {
+		case j == len(incoming):
+			out = append(out, existing[i])
+			i++
+		case i == len(existing):
+			out = appendOrReplace(out, incoming[j])
+			j++
+		case existing[i].Ts < incoming[j].Ts:
+			out = append(out, existing[i])
+			i++
+		case existing[i].Ts > incoming[j].Ts:
+			out = appendOrReplace(out, incoming[j])
+			j++
+		default:
+			out = append(out, incoming[j])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func appendOrReplace(out []Sample, s Sample) []Sample {
+	if n := len(out); n > 0 && out[n-1].Ts == s.Ts {
+		out[n-1] = s
+		return out
+	}
+	return append(out, s)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The conformance suite: behaviour every HistoryStore backend must share.
+// Add new backends to historyBackends.
+
+// historyBackends are the HistoryStore implementations every backend test
+// runs against.
+var historyBackends = []string{"badger", "sqlite", "memory"}
+
+// testHistory is a history backend with its rollup pass exposed.
+type testHistory interface {
+	HistoryStore
+	rollupOnce(now time.Time) error
+}
+
+func openTestHistory(t *testing.T, backend string, tiers []historyTier) testHistory {
+	t.Helper()
+	store, err := openHistoryStore(backend, t.TempDir(), tiers, 10000)
+	if err != nil {
+		t.Fatalf("open %s history: %v", backend, err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store.(testHistory)
+}
+
+// forEachBackend runs fn as a subtest against every backend.
+func forEachBackend(t *testing.T, fn func(t *testing.T, backend string)) {
+	for _, backend := range historyBackends {
+		t.Run(backend, func(t *testing.T) { fn(t, backend) })
+	}
+}
+
+func TestHistoryConformance(t *testing.T) {
+	cases := map[string]func(t *testing.T, backend string){
+		"ordering":          testConformanceOrdering,
+		"prefix isolation":  testConformancePrefixIsolation,
+		"retention":         testConformanceRetention,
+		"concurrent writes": testConformanceConcurrentWriters,
+		"range boundaries":  testConformanceRangeBoundaries,
+	}
+	for name, fn := range cases {
+		t.Run(name, func(t *testing.T) { forEachBackend(t, fn) })
+	}
+}
+
+func fetchAll(t *testing.T, h HistoryStore, device, iface string) []Sample {
+	t.Helper()
+	samples, err := h.SampleRange(device, iface, time.UnixMilli(0), time.Now().Add(time.Hour), 0)
+	if err != nil {
+		t.Fatalf("range %s/%s: %v", device, iface, err)
+	}
+	return samples
+}
+
+func assertAscending(t *testing.T, samples []Sample) {
+	t.Helper()
+	for i := 1; i < len(samples); i++ {
+		if samples[i].Ts <= samples[i-1].Ts {
+			t.Fatalf("samples out of order at %d: %d after %d", i, samples[i].Ts, samples[i-1].Ts)
+		}
+	}
+}
+
+func testConformanceOrdering(t *testing.T, backend string) {
+	h := openTestHistory(t, backend, buildTiers(time.Hour, nil))
+	base := time.Now().Add(-time.Minute).UnixMilli()
+	rng := rand.New(rand.NewSource(1))
+	for _, i := range rng.Perm(50) {
+		if err := h.StoreSample("sw-1", "eth0", Sample{Ts: base + int64(i)*1000, Rx: float64(i)}); err != nil {
+			t.Fatalf("store: %v", err)
+		}
+	}
+	// rewriting a timestamp replaces the sample rather than duplicating it
+	if err := h.StoreSample("sw-1", "eth0", Sample{Ts: base + 7000, Rx: 700}); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	got := fetchAll(t, h, "sw-1", "eth0")
+	if len(got) != 50 {
+		t.Fatalf("expected 50 samples, got %d", len(got))
+	}
+	assertAscending(t, got)
+	if got[7].Rx != 700 || got[8].Rx != 8 {
+		t.Fatalf("expected the rewrite of sample 7 to win, got %+v %+v", got[7], got[8])
+	}
+}
+
+func testConformancePrefixIsolation(t *testing.T, backend string) {
+	h := openTestHistory(t, backend, buildTiers(time.Hour, nil))
+	ts := time.Now().Add(-time.Second).UnixMilli()
+	series := []seriesID{
+		{"sw-1", "eth0"}, {"sw-10", "eth0"}, {"sw-1", "eth01"}, {"sw-1", "eth0.100"}, {"sw", "1|eth0"},
+	}
+	for i, s := range series {
+		if err := h.StoreSample(s.Device, s.Iface, Sample{Ts: ts, Rx: float64(i)}); err != nil {
+			t.Fatalf("store %s: %v", s, err)
+		}
+	}
+	for i, s := range series {
+		got := fetchAll(t, h, s.Device, s.Iface)
+		if len(got) != 1 || got[0].Rx != float64(i) {
+			t.Fatalf("%s: expected only its own sample, got %+v", s, got)
+		}
+	}
+	if got := fetchAll(t, h, "sw-100", "eth0"); len(got) != 0 {
+		t.Fatalf("unknown series returned %+v", got)
+	}
+	listed, err := h.ListSeries()
+	if err != nil {
+		t.Fatalf("list series: %v", err)
+	}
+	if len(listed) != len(series) {
+		t.Fatalf("expected %d series, got %v", len(series), listed)
+	}
+}
+
+func testConformanceRetention(t *testing.T, backend string) {
+	t.Parallel()
+	ttl := 2 * time.Second
+	h := openTestHistory(t, backend, buildTiers(ttl, nil))
+	now := time.Now()
+	for _, ts := range []time.Time{now.Add(-time.Minute), now.Add(-ttl - time.Millisecond), now.Add(-500 * time.Millisecond)} {
+		if err := h.StoreSample("sw-1", "eth0", Sample{Ts: ts.UnixMilli()}); err != nil {
+			t.Fatalf("store: %v", err)
+		}
+	}
+	got, err := h.FetchSamples("sw-1", "eth0", time.Hour, 0)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected only the sample inside retention, got %+v", got)
+	}
+	time.Sleep(ttl)
+	if got := fetchAll(t, h, "sw-1", "eth0"); len(got) != 0 {
+		t.Fatalf("expected the sample to age out, got %+v", got)
+	}
+}
+
+func testConformanceConcurrentWriters(t *testing.T, backend string) {
+	h := openTestHistory(t, backend, buildTiers(time.Hour, nil))
+	const writers, perWriter = 8, 100
+	base := time.Now().Add(-time.Minute).UnixMilli()
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				// interleaved timestamps on a shared series plus one of its own
+				s := Sample{Ts: base + int64(i*writers+w), Rx: float64(w)}
+				if err := h.StoreSample("sw-1", "eth0", s); err != nil {
+					t.Errorf("store shared: %v", err)
+					return
+				}
+				if err := h.StoreSample("sw-1", "eth"+string(rune('a'+w)), s); err != nil {
+					t.Errorf("store own: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	got := fetchAll(t, h, "sw-1", "eth0")
+	if len(got) != writers*perWriter {
+		t.Fatalf("expected %d samples on the shared series, got %d", writers*perWriter, len(got))
+	}
+	assertAscending(t, got)
+	for w := 0; w < writers; w++ {
+		if got := fetchAll(t, h, "sw-1", "eth"+string(rune('a'+w))); len(got) != perWriter {
+			t.Fatalf("writer %d: expected %d samples, got %d", w, perWriter, len(got))
+		}
+	}
+}
+
+func testConformanceRangeBoundaries(t *testing.T, backend string) {
+	h := openTestHistory(t, backend, buildTiers(time.Hour, nil))
+	// straddle a Badger chunk boundary so ranges have to span two chunks
+	base := bucketStart(time.Now().UnixMilli(), chunkSpan) - 5000
+	for i := int64(0); i < 10; i++ {
+		if err := h.StoreSample("sw-1", "eth0", Sample{Ts: base + i*1000, Rx: float64(i)}); err != nil {
+			t.Fatalf("store: %v", err)
+		}
+	}
+	rangeTs := func(start, end int64) []int64 {
+		t.Helper()
+		samples, err := h.SampleRange("sw-1", "eth0", time.UnixMilli(start), time.UnixMilli(end), 0)
+		if err != nil {
+			t.Fatalf("range: %v", err)
+		}
+		out := make([]int64, 0, len(samples))
+		for _, s := range samples {
+			out = append(out, s.Ts-base)
+		}
+		return out
+	}
+	cases := []struct {
+		start, end int64
+		want       []int64
+	}{
+		{2000, 5000, []int64{2000, 3000, 4000}},             // start inclusive, end exclusive
+		{3000, 7001, []int64{3000, 4000, 5000, 6000, 7000}}, // across the chunk boundary
+		{4500, 5000, []int64{}},                             // between samples
+		{9001, 20000, []int64{}},                            // after the last sample
+		{-5000, 1, []int64{0}},                              // before the first sample
+	}
+	for _, c := range cases {
+		got := rangeTs(base+c.start, base+c.end)
+		if len(got) != len(c.want) {
+			t.Fatalf("[%d, %d): got %v, want %v", c.start, c.end, got, c.want)
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Fatalf("[%d, %d): got %v, want %v", c.start, c.end, got, c.want)
+			}
+		}
+	}
+
+	rollups, err := h.RollupRange("sw-1", "eth0", time.UnixMilli(base), time.UnixMilli(base+10_000), 5*time.Second)
+	if err != nil {
+		t.Fatalf("rollup range: %v", err)
+	}
+	if len(rollups) != 2 || rollups[0].Ts != base || rollups[0].Count != 5 || rollups[1].Rx.Min != 5 {
+		t.Fatalf("expected two 5s buckets of 5 samples, got %+v", rollups)
+	}
+}
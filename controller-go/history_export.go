@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	// exportWindow bounds how much of one series is read into memory at once;
+	// every rollup step must divide it
+	exportWindow = time.Hour
+	// parquet row groups are flushed at this size, bounding the writer's buffer
+	exportRowGroupBytes = 8 << 20
+)
+
+// exportColumns are the selectable export columns. time is the sample
+// timestamp as RFC3339 text in the requested zone; ts is Unix epoch ms.
+var exportColumns = []string{"time", "ts", "device", "iface", "rx_bps", "tx_bps", "drops", "queue_depth", "latency_ms", "seq", "speed_bps", "rx_util_pct", "tx_util_pct"}
+
+// HistoryExport selects what to export and how to encode it.
+type HistoryExport struct {
+	Devices, Ifaces []string // as in HistoryQuery, globs allowed
+	Tags            []string // as in HistoryQuery
+	Start, End      time.Time
+	Resolution      time.Duration // tier choice; 0 exports raw samples
+	Format          string        // csv or parquet
+	Columns         []string      // subset of exportColumns, in output order
+	Location        *time.Location
+}
+
+func (e *HistoryExport) validate() error {
+	if len(e.Devices) == 0 && len(e.Tags) > 0 {
+		e.Devices = []string{"*"}
+	}
+	if len(e.Devices) == 0 {
+		return fmt.Errorf("%w: device or tag is required", errInvalidQuery)
+	}
+	if !e.End.After(e.Start) {
+		return fmt.Errorf("%w: end must be after start", errInvalidQuery)
+	}
+	switch e.Format {
+	case "":
+		e.Format = "csv"
+	case "csv", "parquet":
+	default:
+		return fmt.Errorf("%w: unknown format %q", errInvalidQuery, e.Format)
+	}
+	if len(e.Columns) == 0 {
+		e.Columns = exportColumns
+	}
+	seen := make(map[string]bool, len(e.Columns))
+	for _, c := range e.Columns {
+		if !isExportColumn(c) {
+			return fmt.Errorf("%w: unknown column %q", errInvalidQuery, c)
+		}
+		if seen[c] {
+			return fmt.Errorf("%w: duplicate column %q", errInvalidQuery, c)
+		}
+		seen[c] = true
+	}
+	if e.Location == nil {
+		e.Location = time.UTC
+	}
+	return nil
+}
+
+func isExportColumn(c string) bool {
+	for _, known := range exportColumns {
+		if c == known {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExportLocation accepts an IANA zone name or "local"; empty means UTC.
+func parseExportLocation(name string) (*time.Location, error) {
+	switch name {
+	case "", "UTC", "utc":
+		return time.UTC, nil
+	case "local":
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown timezone %q", errInvalidQuery, name)
+	}
+	return loc, nil
+}
+
+// exportSink receives rows one at a time.
+type exportSink interface {
+	writeRow(s seriesID, smp Sample) error
+	// flush pushes buffered rows towards the client between windows
+	flush() error
+	close() error
+}
+
+// prepareExport validates e and resolves its series so callers can report
+// bad requests before any output is written. keep, when set, further
+// narrows the series by device (see State.taggedFilter).
+func prepareExport(store HistoryStore, e *HistoryExport, keep func(device string) bool) ([]seriesID, error) {
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	series, err := resolveSeries(store, e.Devices, e.Ifaces)
+	if err != nil {
+		return nil, err
+	}
+	series = filterSeries(series, keep)
+	if len(series) > maxQuerySeries {
+		return nil, fmt.Errorf("%w: export matches %d series, limit is %d", errInvalidQuery, len(series), maxQuerySeries)
+	}
+	return series, nil
+}
+
+// writeHistoryExport streams series to w one window at a time, so memory
+// use doesn't grow with the range. e must have been through prepareExport.
+func writeHistoryExport(w io.Writer, store HistoryStore, series []seriesID, e HistoryExport) error {
+	var sink exportSink
+	var err error
+	if e.Format == "parquet" {
+		sink, err = newParquetSink(w, e)
+	} else {
+		sink, err = newCSVSink(w, e)
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range series {
+		// windows after the first start on exportWindow boundaries, which
+		// every rollup step divides, so no bucket is split between two reads
+		for from := e.Start; from.Before(e.End); {
+			to := time.UnixMilli(bucketStart(from.UnixMilli(), exportWindow)).Add(exportWindow)
+			if to.After(e.End) {
+				to = e.End
+			}
+			samples, err := store.SampleRange(s.Device, s.Iface, from, to, e.Resolution)
+			if err != nil {
+				return fmt.Errorf("%s: %w", s, err)
+			}
+			for _, smp := range samples {
+				if err := sink.writeRow(s, smp); err != nil {
+					return err
+				}
+			}
+			if err := sink.flush(); err != nil {
+				return err
+			}
+			from = to
+		}
+	}
+	return sink.close()
+}
+
+// exportValue returns a column's value as the Go type its encoders expect:
+// string, int64 or float64.
+func exportValue(col string, s seriesID, smp Sample, loc *time.Location) interface{} {
+	switch col {
+	case "time":
+		return time.UnixMilli(smp.Ts).In(loc).Format("2006-01-02T15:04:05.000Z07:00")
+	case "ts":
+		return smp.Ts
+	case "device":
+		return s.Device
+	case "iface":
+		return s.Iface
+	case "drops":
+		return int64(smp.Drops)
+	case "queue_depth":
+		return int64(smp.Q)
+	case "seq":
+		return int64(smp.Seq)
+	case "speed_bps":
+		return smp.Speed
+	}
+	return sampleValue(smp, col)
+}
+
+type csvSink struct {
+	w      *csv.Writer
+	out    io.Writer
+	cols   []string
+	loc    *time.Location
+	record []string
+}
+
+func newCSVSink(w io.Writer, e HistoryExport) (*csvSink, error) {
+	c := &csvSink{w: csv.NewWriter(w), out: w, cols: e.Columns, loc: e.Location, record: make([]string, len(e.Columns))}
+	return c, c.w.Write(e.Columns)
+}
+
+func (c *csvSink) writeRow(s seriesID, smp Sample) error {
+	for i, col := range c.cols {
+		switch v := exportValue(col, s, smp, c.loc).(type) {
+		case string:
+			c.record[i] = v
+		case int64:
+			c.record[i] = strconv.FormatInt(v, 10)
+		case float64:
+			c.record[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *csvSink) flush() error {
+	c.w.Flush()
+	if f, ok := c.out.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+	return c.w.Error()
+}
+
+func (c *csvSink) close() error { return c.flush() }
+
+type parquetSink struct {
+	pw   *writer.CSVWriter
+	cols []string
+	loc  *time.Location
+}
+
+func newParquetSink(w io.Writer, e HistoryExport) (*parquetSink, error) {
+	md := make([]string, 0, len(e.Columns))
+	for _, col := range e.Columns {
+		switch col {
+		case "time", "device", "iface":
+			md = append(md, "name="+col+", type=BYTE_ARRAY, convertedtype=UTF8")
+		case "ts":
+			md = append(md, "name=ts, type=INT64, convertedtype=TIMESTAMP_MILLIS")
+		case "drops", "queue_depth", "seq":
+			md = append(md, "name="+col+", type=INT64")
+		default:
+			md = append(md, "name="+col+", type=DOUBLE")
+		}
+	}
+	pw, err := writer.NewCSVWriterFromWriter(md, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.RowGroupSize = exportRowGroupBytes
+	return &parquetSink{pw: pw, cols: e.Columns, loc: e.Location}, nil
+}
+
+func (p *parquetSink) writeRow(s seriesID, smp Sample) error {
+	row := make([]interface{}, len(p.cols))
+	for i, col := range p.cols {
+		row[i] = exportValue(col, s, smp, p.loc)
+	}
+	return p.pw.Write(row)
+}
+
+// flush is a no-op: parquet rows leave in whole row groups.
+func (p *parquetSink) flush() error { return nil }
+
+func (p *parquetSink) close() error { return p.pw.WriteStop() }
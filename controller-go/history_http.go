@@ -2,8 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -26,33 +30,193 @@ func registerHistoryAPI(mux *http.ServeMux, state *State) {
 			return
 		}
 
-		device := r.URL.Query().Get("device")
-		iface := r.URL.Query().Get("iface")
+		params := r.URL.Query()
+		devices := listParam(params, "device")
+		ifaces := listParam(params, "iface")
+		if isRangeQuery(params, devices, ifaces) {
+			serveHistoryQuery(w, state, params, devices, ifaces)
+			return
+		}
+
+		device := params.Get("device")
+		iface := params.Get("iface")
 		if device == "" || iface == "" {
 			http.Error(w, "device and iface are required", http.StatusBadRequest)
 			return
 		}
 
-		minutesStr := r.URL.Query().Get("minutes")
+		minutesStr := params.Get("minutes")
 		minutes := 5
 		if minutesStr != "" {
 			if v, err := strconv.Atoi(minutesStr); err == nil && v > 0 {
 				minutes = v
 			}
 		}
-		samples, err := state.FetchHistory(device, iface, time.Duration(minutes)*time.Minute)
+		// resolution selects a rollup tier (e.g. 1m, 1h); omitted means raw
+		var resolution time.Duration
+		if resStr := params.Get("resolution"); resStr != "" {
+			v, err := time.ParseDuration(resStr)
+			if err != nil || v < 0 {
+				http.Error(w, "invalid resolution", http.StatusBadRequest)
+				return
+			}
+			resolution = v
+		}
+		samples, err := state.FetchHistory(device, iface, time.Duration(minutes)*time.Minute, resolution)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		resp := map[string]interface{}{
-			"device":  device,
-			"iface":   iface,
-			"minutes": minutes,
-			"samples": samples,
+			"device":     device,
+			"iface":      iface,
+			"minutes":    minutes,
+			"resolution": resolution.String(),
+			"samples":    samples,
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	})
+
+	mux.HandleFunc("/api/history/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !state.historyEnabled() {
+			http.Error(w, "history disabled", http.StatusNotFound)
+			return
+		}
+		params := r.URL.Query()
+		e := HistoryExport{
+			Devices: listParam(params, "device"),
+			Ifaces:  listParam(params, "iface"),
+			Tags:    listParam(params, "tag"),
+			Format:  params.Get("format"),
+			Columns: listParam(params, "columns"),
+		}
+		var err error
+		if e.Start, e.End, err = parseRangeParams(params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v := params.Get("resolution"); v != "" {
+			if e.Resolution, err = time.ParseDuration(v); err != nil || e.Resolution < 0 {
+				http.Error(w, "invalid resolution", http.StatusBadRequest)
+				return
+			}
+		}
+		if e.Location, err = parseExportLocation(params.Get("tz")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series, err := prepareExport(state.history, &e, state.taggedFilter(e.Tags))
+		if errors.Is(err, errInvalidQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		name := "history-" + e.Start.UTC().Format("20060102T150405") + "." + e.Format
+		if e.Format == "parquet" {
+			w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+		} else {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		// the status is already sent, so a failure can only cut the body short
+		if err := writeHistoryExport(w, state.history, series, e); err != nil {
+			log.Printf("history export failed: %v", err)
+		}
+	})
+}
+
+// listParam collects a repeatable, comma-separated query parameter.
+func listParam(params url.Values, name string) []string {
+	var out []string
+	for _, v := range params[name] {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+// isRangeQuery reports whether the request uses the range/aggregation form
+// rather than the original single-series "minutes back from now" form.
+func isRangeQuery(params url.Values, devices, ifaces []string) bool {
+	for _, p := range []string{"start", "end", "step", "agg", "fields", "tag"} {
+		if params.Has(p) {
+			return true
+		}
+	}
+	if len(devices) != 1 || len(ifaces) != 1 {
+		return true
+	}
+	return hasGlob(devices[0]) || hasGlob(ifaces[0])
+}
+
+// parseRangeParams reads start/end (RFC3339 or epoch ms). end defaults to
+// now and start to "minutes" (default 5) before end.
+func parseRangeParams(params url.Values) (start, end time.Time, err error) {
+	end = time.Now()
+	if v := params.Get("end"); v != "" {
+		if end, err = parseQueryTime(v); err != nil {
+			return
+		}
+	}
+	start = end.Add(-5 * time.Minute)
+	if v := params.Get("start"); v != "" {
+		start, err = parseQueryTime(v)
+	} else if v, convErr := strconv.Atoi(params.Get("minutes")); convErr == nil && v > 0 {
+		start = end.Add(-time.Duration(v) * time.Minute)
+	}
+	return
+}
+
+func serveHistoryQuery(w http.ResponseWriter, state *State, params url.Values, devices, ifaces []string) {
+	q := HistoryQuery{Devices: devices, Ifaces: ifaces, Tags: listParam(params, "tag"), Agg: params.Get("agg"), Fields: listParam(params, "fields")}
+	var err error
+	if q.Start, q.End, err = parseRangeParams(params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for name, dst := range map[string]*time.Duration{"step": &q.Step, "resolution": &q.Resolution} {
+		if v := params.Get(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*dst = d
+		}
+	}
+
+	series, err := state.QueryHistory(q)
+	if errors.Is(err, errInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]interface{}{
+		"start":  q.Start.UnixMilli(),
+		"end":    q.End.UnixMilli(),
+		"step":   q.Step.String(),
+		"series": series,
+	}
+	if q.Step > 0 {
+		resp["agg"] = q.Agg
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryHistory keeps history in process memory: raw samples in a fixed-size
+// ring per series (the oldest are overwritten once it is full) and rollups in
+// per-tier slices. Nothing survives a restart; it suits tests and small
+// deployments that only need recent history.
+type memoryHistory struct {
+	*tieredHistory
+	ttl      time.Duration
+	capacity int
+
+	mu         sync.RWMutex
+	raw        map[seriesID]*sampleRing
+	rollups    map[string]map[seriesID][]Rollup // tier -> series -> by ts
+	watermarks map[string]map[seriesID]int64
+	lastSeen   map[seriesID]int64
+}
+
+func openMemoryHistory(tiers []historyTier, capacity int) (*memoryHistory, error) {
+	if capacity < 1 {
+		return nil, errors.New("history memory capacity must be positive")
+	}
+	h := &memoryHistory{
+		ttl:        tiers[0].ttl,
+		capacity:   capacity,
+		raw:        make(map[seriesID]*sampleRing),
+		rollups:    make(map[string]map[seriesID][]Rollup),
+		watermarks: make(map[string]map[seriesID]int64),
+		lastSeen:   make(map[seriesID]int64),
+	}
+	for _, t := range tiers[1:] {
+		h.rollups[t.name] = make(map[seriesID][]Rollup)
+		h.watermarks[t.name] = make(map[seriesID]int64)
+	}
+	h.tieredHistory = newTieredHistory(h, tiers)
+	h.start()
+	h.wg.Add(1)
+	go h.pruneLoop()
+	return h, nil
+}
+
+func (h *memoryHistory) StoreSample(device, iface string, sample Sample) error {
+	return h.StoreBatch([]seriesSample{{id: seriesID{Device: device, Iface: iface}, sample: sample}})
+}
+
+func (h *memoryHistory) StoreBatch(batch []seriesSample) error {
+	cutoff := time.Now().Add(-h.ttl).UnixMilli()
+	h.mu.Lock()
+	for _, rec := range batch {
+		if rec.sample.Ts < cutoff {
+			continue
+		}
+		ring, ok := h.raw[rec.id]
+		if !ok {
+			ring = newSampleRing(h.capacity)
+			h.raw[rec.id] = ring
+		}
+		ring.insert(rec.sample)
+		if rec.sample.Ts > h.lastSeen[rec.id] {
+			h.lastSeen[rec.id] = rec.sample.Ts
+		}
+	}
+	h.mu.Unlock()
+	for _, rec := range batch {
+		if rec.sample.Ts >= cutoff {
+			h.markDirty(rec.id, rec.sample.Ts)
+		}
+	}
+	return nil
+}
+
+func (h *memoryHistory) rangeRaw(s seriesID, start, end int64) ([]Sample, error) {
+	if cutoff := time.Now().Add(-h.ttl).UnixMilli(); start < cutoff {
+		start = cutoff
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ring, ok := h.raw[s]
+	if !ok {
+		return []Sample{}, nil
+	}
+	return ring.between(start, end), nil
+}
+
+func (h *memoryHistory) rangeRollups(tier string, s seriesID, start, end int64) ([]Rollup, error) {
+	var t historyTier
+	for _, candidate := range h.tiers {
+		if candidate.name == tier {
+			t = candidate
+		}
+	}
+	// a bucket expires ttl after it closes, as in the other backends
+	if cutoff := time.Now().Add(-t.ttl - t.step).UnixMilli(); start <= cutoff {
+		start = cutoff + 1
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	stored := h.rollups[tier][s]
+	lo := sort.Search(len(stored), func(i int) bool { return stored[i].Ts >= start })
+	hi := sort.Search(len(stored), func(i int) bool { return stored[i].Ts >= end })
+	if lo >= hi {
+		return []Rollup{}, nil
+	}
+	return append([]Rollup(nil), stored[lo:hi]...), nil
+}
+
+func (h *memoryHistory) watermark(tier string, s seriesID) (int64, bool, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	wm, ok := h.watermarks[tier][s]
+	return wm, ok, nil
+}
+
+func (h *memoryHistory) writeRollups(t historyTier, s seriesID, rollups []Rollup, end int64, now time.Time) error {
+	expired := now.Add(-t.step - t.ttl).UnixMilli()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stored := h.rollups[t.name][s]
+	for _, r := range rollups {
+		i := sort.Search(len(stored), func(i int) bool { return stored[i].Ts >= r.Ts })
+		if i < len(stored) && stored[i].Ts == r.Ts {
+			stored[i] = r
+			continue
+		}
+		stored = append(stored, Rollup{})
+		copy(stored[i+1:], stored[i:])
+		stored[i] = r
+	}
+	// drop buckets past retention from the front
+	drop := sort.Search(len(stored), func(i int) bool { return stored[i].Ts > expired })
+	h.rollups[t.name][s] = append([]Rollup(nil), stored[drop:]...)
+	h.watermarks[t.name][s] = end
+	return nil
+}
+
+func (h *memoryHistory) ListSeries() ([]seriesID, error) {
+	cutoff := time.Now().Add(-h.tiers[len(h.tiers)-1].ttl).UnixMilli()
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	series := make([]seriesID, 0, len(h.lastSeen))
+	for s, last := range h.lastSeen {
+		if last >= cutoff {
+			series = append(series, s)
+		}
+	}
+	return series, nil
+}
+
+func (h *memoryHistory) pruneLoop() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			h.prune(now)
+		}
+	}
+}
+
+// prune forgets series whose newest sample is past every tier's retention,
+// such as those of forgotten or renamed devices.
+func (h *memoryHistory) prune(now time.Time) {
+	var keep time.Duration
+	for _, t := range h.tiers {
+		keep = max(keep, t.step+t.ttl)
+	}
+	cutoff := now.Add(-keep).UnixMilli()
+	var gone []seriesID
+	h.mu.Lock()
+	for s, last := range h.lastSeen {
+		if last >= cutoff {
+			continue
+		}
+		delete(h.raw, s)
+		delete(h.lastSeen, s)
+		for tier := range h.rollups {
+			delete(h.rollups[tier], s)
+			delete(h.watermarks[tier], s)
+		}
+		gone = append(gone, s)
+	}
+	h.mu.Unlock()
+	h.tieredHistory.mu.Lock()
+	for _, s := range gone {
+		delete(h.dirty, s.String())
+	}
+	h.tieredHistory.mu.Unlock()
+}
+
+func (h *memoryHistory) Enabled() bool { return true }
+
+func (h *memoryHistory) Close() error {
+	h.stop()
+	return nil
+}
+
+// sampleRing is a fixed-capacity ring of samples kept in time order. Once
+// full, inserting overwrites the oldest sample.
+type sampleRing struct {
+	buf  []Sample
+	head int // index of the oldest sample
+	n    int
+}
+
+func newSampleRing(capacity int) *sampleRing {
+	return &sampleRing{buf: make([]Sample, capacity)}
+}
+
+func (r *sampleRing) at(i int) *Sample { return &r.buf[(r.head+i)%len(r.buf)] }
+
+// insert adds s in time order; a sample with the same ts is replaced and one
+// older than everything in a full ring is dropped.
+func (r *sampleRing) insert(s Sample) {
+	i := sort.Search(r.n, func(i int) bool { return r.at(i).Ts >= s.Ts })
+	if i < r.n && r.at(i).Ts == s.Ts {
+		*r.at(i) = s
+		return
+	}
+	if r.n == len(r.buf) {
+		if i == 0 {
+			return
+		}
+		// evict the oldest; everything shifts down one logical slot
+		r.head = (r.head + 1) % len(r.buf)
+		r.n--
+		i--
+	}
+	r.n++
+	for j := r.n - 1; j > i; j-- {
+		*r.at(j) = *r.at(j - 1)
+	}
+	*r.at(i) = s
+}
+
+// between returns samples with start <= ts < end in time order.
+func (r *sampleRing) between(start, end int64) []Sample {
+	lo := sort.Search(r.n, func(i int) bool { return r.at(i).Ts >= start })
+	hi := sort.Search(r.n, func(i int) bool { return r.at(i).Ts >= end })
+	out := make([]Sample, 0, max(hi-lo, 0))
+	for i := lo; i < hi; i++ {
+		out = append(out, *r.at(i))
+	}
+	return out
+}
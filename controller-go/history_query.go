@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxQuerySeries = 500
+	maxQueryPoints = 10000
+)
+
+// queryFields are the selectable sample fields, named as in agent messages.
+var queryFields = []string{"rx_bps", "tx_bps", "drops", "queue_depth", "latency_ms", "rx_util_pct", "tx_util_pct"}
+
+// HistoryQuery selects one or more series over an absolute time range,
+// optionally bucketed by Step and reduced with Agg.
+type HistoryQuery struct {
+	Devices    []string // ids or path.Match globs
+	Ifaces     []string // names or globs; empty matches every iface
+	Tags       []string // devices must carry every tag; alone, matches all devices
+	Start, End time.Time
+	Step       time.Duration // 0 returns samples as stored
+	Resolution time.Duration // tier choice when Step is 0
+	Agg        string        // avg, min, max, sum, p95
+	Fields     []string
+}
+
+// errInvalidQuery wraps query validation failures so HTTP handlers can
+// answer 400 instead of 500.
+var errInvalidQuery = errors.New("invalid query")
+
+type HistoryPoint struct {
+	Ts     int64              `json:"ts"`
+	Values map[string]float64 `json:"values"`
+}
+
+type SeriesResult struct {
+	Device string         `json:"device"`
+	Iface  string         `json:"iface"`
+	Points []HistoryPoint `json:"points"`
+}
+
+func (q *HistoryQuery) validate() error {
+	if len(q.Devices) == 0 && len(q.Tags) > 0 {
+		q.Devices = []string{"*"}
+	}
+	if len(q.Devices) == 0 {
+		return fmt.Errorf("%w: device or tag is required", errInvalidQuery)
+	}
+	if !q.End.After(q.Start) {
+		return fmt.Errorf("%w: end must be after start", errInvalidQuery)
+	}
+	if q.Step < 0 {
+		return fmt.Errorf("%w: step must be positive", errInvalidQuery)
+	}
+	if q.Step > 0 && q.End.Sub(q.Start)/q.Step > maxQueryPoints {
+		return fmt.Errorf("%w: range/step exceeds %d points", errInvalidQuery, maxQueryPoints)
+	}
+	switch q.Agg {
+	case "":
+		q.Agg = "avg"
+	case "avg", "min", "max", "sum", "p95":
+	default:
+		return fmt.Errorf("%w: unknown agg %q", errInvalidQuery, q.Agg)
+	}
+	if len(q.Fields) == 0 {
+		q.Fields = queryFields
+	}
+	for _, f := range q.Fields {
+		if !isQueryField(f) {
+			return fmt.Errorf("%w: unknown field %q", errInvalidQuery, f)
+		}
+	}
+	return nil
+}
+
+func isQueryField(f string) bool {
+	for _, known := range queryFields {
+		if f == known {
+			return true
+		}
+	}
+	return false
+}
+
+func hasGlob(s string) bool { return strings.ContainsAny(s, "*?[") }
+
+// resolveSeries expands device/iface globs against the store's series list.
+// Exact device+iface pairs are returned without consulting the index.
+func resolveSeries(store HistoryStore, devices, ifaces []string) ([]seriesID, error) {
+	needIndex := len(ifaces) == 0
+	for _, p := range append(append([]string{}, devices...), ifaces...) {
+		if hasGlob(p) {
+			needIndex = true
+		}
+	}
+	if !needIndex {
+		out := make([]seriesID, 0, len(devices)*len(ifaces))
+		for _, d := range devices {
+			for _, i := range ifaces {
+				out = append(out, seriesID{Device: d, Iface: i})
+			}
+		}
+		return out, nil
+	}
+	all, err := store.ListSeries()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]seriesID, 0)
+	for _, s := range all {
+		if matchAny(devices, s.Device) && (len(ifaces) == 0 || matchAny(ifaces, s.Iface)) {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Device != out[j].Device {
+			return out[i].Device < out[j].Device
+		}
+		return out[i].Iface < out[j].Iface
+	})
+	return out, nil
+}
+
+// filterSeries keeps the series whose device passes keep; a nil keep keeps
+// everything.
+func filterSeries(series []seriesID, keep func(device string) bool) []seriesID {
+	if keep == nil {
+		return series
+	}
+	out := series[:0]
+	for _, s := range series {
+		if keep(s.Device) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// taggedFilter returns a filterSeries predicate for devices carrying every
+// tag in tags, or nil when tags is empty.
+func (s *State) taggedFilter(tags []string) func(string) bool {
+	if len(tags) == 0 {
+		return nil
+	}
+	return func(device string) bool { return s.hasTags(device, tags) }
+}
+
+func matchAny(patterns []string, v string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State) QueryHistory(q HistoryQuery) ([]SeriesResult, error) {
+	if !s.historyEnabled() {
+		return nil, errors.New("history disabled")
+	}
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	series, err := resolveSeries(s.history, q.Devices, q.Ifaces)
+	if err != nil {
+		return nil, err
+	}
+	series = filterSeries(series, s.taggedFilter(q.Tags))
+	if len(series) > maxQuerySeries {
+		return nil, fmt.Errorf("%w: query matches %d series, limit is %d", errInvalidQuery, len(series), maxQuerySeries)
+	}
+	out := make([]SeriesResult, 0, len(series))
+	for _, id := range series {
+		points, err := queryPoints(s.history, id, q)
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", id.Device, id.Iface, err)
+		}
+		out = append(out, SeriesResult{Device: id.Device, Iface: id.Iface, Points: points})
+	}
+	return out, nil
+}
+
+func queryPoints(store HistoryStore, id seriesID, q HistoryQuery) ([]HistoryPoint, error) {
+	switch {
+	case q.Step == 0:
+		samples, err := store.SampleRange(id.Device, id.Iface, q.Start, q.End, q.Resolution)
+		if err != nil {
+			return nil, err
+		}
+		points := make([]HistoryPoint, 0, len(samples))
+		for _, smp := range samples {
+			points = append(points, samplePoint(smp, q.Fields))
+		}
+		return points, nil
+
+	case q.Agg == "p95":
+		// percentiles can't be derived from rollups, so this reads raw
+		// samples and only covers the raw retention window
+		samples, err := store.SampleRange(id.Device, id.Iface, q.Start, q.End, 0)
+		if err != nil {
+			return nil, err
+		}
+		return percentilePoints(samples, q.Step, q.Fields, 0.95), nil
+
+	default:
+		rollups, err := store.RollupRange(id.Device, id.Iface, q.Start, q.End, q.Step)
+		if err != nil {
+			return nil, err
+		}
+		points := make([]HistoryPoint, 0, len(rollups))
+		for _, r := range rollups {
+			p := HistoryPoint{Ts: r.Ts, Values: make(map[string]float64, len(q.Fields))}
+			for _, f := range q.Fields {
+				p.Values[f] = rollupValue(r, f, q.Agg)
+			}
+			points = append(points, p)
+		}
+		return points, nil
+	}
+}
+
+func sampleValue(s Sample, field string) float64 {
+	switch field {
+	case "rx_bps":
+		return s.Rx
+	case "tx_bps":
+		return s.Tx
+	case "drops":
+		return float64(s.Drops)
+	case "queue_depth":
+		return float64(s.Q)
+	case "latency_ms":
+		return s.Lat
+	case "rx_util_pct":
+		return s.RxUtilPct()
+	case "tx_util_pct":
+		return s.TxUtilPct()
+	}
+	return 0
+}
+
+func samplePoint(s Sample, fields []string) HistoryPoint {
+	p := HistoryPoint{Ts: s.Ts, Values: make(map[string]float64, len(fields))}
+	for _, f := range fields {
+		p.Values[f] = sampleValue(s, f)
+	}
+	return p
+}
+
+// rollupField returns a field's aggregate and the number of samples it
+// covers.
+func rollupField(r Rollup, field string) (FieldAgg, int) {
+	for i, f := range r.fields() {
+		if queryFields[i] != field {
+			continue
+		}
+		if field == "rx_util_pct" || field == "tx_util_pct" {
+			return *f, r.UtilCount
+		}
+		return *f, r.Count
+	}
+	return FieldAgg{}, 0
+}
+
+func rollupValue(r Rollup, field, agg string) float64 {
+	f, count := rollupField(r, field)
+	switch agg {
+	case "min":
+		return f.Min
+	case "max":
+		return f.Max
+	case "sum":
+		return f.Sum
+	}
+	return f.Avg(count)
+}
+
+// percentilePoints buckets time-ordered samples by step and reports the
+// nearest-rank percentile of each field per bucket.
+func percentilePoints(samples []Sample, step time.Duration, fields []string, pct float64) []HistoryPoint {
+	points := make([]HistoryPoint, 0)
+	for i := 0; i < len(samples); {
+		b := bucketStart(samples[i].Ts, step)
+		j := i
+		for j < len(samples) && bucketStart(samples[j].Ts, step) == b {
+			j++
+		}
+		p := HistoryPoint{Ts: b, Values: make(map[string]float64, len(fields))}
+		vals := make([]float64, j-i)
+		for _, f := range fields {
+			for k, s := range samples[i:j] {
+				vals[k] = sampleValue(s, f)
+			}
+			p.Values[f] = percentile(vals, pct)
+		}
+		points = append(points, p)
+		i = j
+	}
+	return points
+}
+
+func percentile(vals []float64, pct float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), vals...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(pct*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// parseQueryTime accepts RFC3339 timestamps or Unix epoch milliseconds.
+func parseQueryTime(v string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: want RFC3339 or epoch ms", v)
+	}
+	return t, nil
+}
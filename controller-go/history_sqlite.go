@@ -0,0 +1,431 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// pruneInterval is how often the SQLite backend deletes expired rows. Reads
+// filter by retention themselves, so this only bounds the file size.
+const pruneInterval = time.Minute
+
+// sqliteHistory keeps history in plain tables so it can be queried with any
+// SQLite client. Retention is enforced on read and by a periodic prune.
+type sqliteHistory struct {
+	*tieredHistory
+	db   *sql.DB
+	path string
+	ttl  time.Duration
+
+	// one writer at a time; readers run concurrently under WAL
+	writeMu sync.Mutex
+}
+
+// rollupAggCols are the per-field rollup columns, e.g. rx_bps_min, in the
+// order of Rollup.fields.
+var rollupAggCols = func() []string {
+	var cols []string
+	for _, f := range queryFields {
+		cols = append(cols, f+"_min", f+"_max", f+"_sum", f+"_last")
+	}
+	return cols
+}()
+
+// rollupCols are every stored rollup value column, in scan order.
+var rollupCols = append(append([]string{}, rollupAggCols...), "util_count", "speed_bps")
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS samples (
+		device      TEXT    NOT NULL,
+		iface       TEXT    NOT NULL,
+		ts          INTEGER NOT NULL, -- unix ms
+		rx_bps      REAL    NOT NULL,
+		tx_bps      REAL    NOT NULL,
+		drops       INTEGER NOT NULL,
+		queue_depth INTEGER NOT NULL,
+		latency_ms  REAL    NOT NULL,
+		seq         INTEGER NOT NULL,
+		speed_bps   REAL    NOT NULL DEFAULT 0, -- 0 when unknown
+		PRIMARY KEY (device, iface, ts)
+	) WITHOUT ROWID`,
+	`CREATE INDEX IF NOT EXISTS samples_ts ON samples (ts)`,
+	`CREATE TABLE IF NOT EXISTS rollups (
+		tier   TEXT    NOT NULL,
+		device TEXT    NOT NULL,
+		iface  TEXT    NOT NULL,
+		ts     INTEGER NOT NULL, -- bucket start, unix ms
+		count  INTEGER NOT NULL,
+		` + strings.Join(rollupAggCols, " REAL NOT NULL DEFAULT 0,\n\t\t") + ` REAL NOT NULL DEFAULT 0,
+		util_count INTEGER NOT NULL DEFAULT 0, -- samples with a known speed
+		speed_bps  REAL    NOT NULL DEFAULT 0,
+		PRIMARY KEY (tier, device, iface, ts)
+	) WITHOUT ROWID`,
+	`CREATE INDEX IF NOT EXISTS rollups_ts ON rollups (tier, ts)`,
+	`CREATE TABLE IF NOT EXISTS watermarks (
+		tier   TEXT    NOT NULL,
+		device TEXT    NOT NULL,
+		iface  TEXT    NOT NULL,
+		ts     INTEGER NOT NULL,
+		PRIMARY KEY (tier, device, iface)
+	) WITHOUT ROWID`,
+	`CREATE TABLE IF NOT EXISTS series (
+		device    TEXT    NOT NULL,
+		iface     TEXT    NOT NULL,
+		last_seen INTEGER NOT NULL, -- unix ms of the newest stored sample
+		PRIMARY KEY (device, iface)
+	) WITHOUT ROWID`,
+}
+
+func openSQLiteHistory(dir string, tiers []historyTier) (*sqliteHistory, error) {
+	path := filepath.Join(filepath.Clean(dir), "history.db")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating history schema: %w", err)
+		}
+	}
+	if err := addSQLiteColumns(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("upgrading history schema: %w", err)
+	}
+	h := &sqliteHistory{db: db, path: path, ttl: tiers[0].ttl}
+	h.tieredHistory = newTieredHistory(h, tiers)
+	h.start()
+	h.wg.Add(1)
+	go h.pruneLoop()
+	return h, nil
+}
+
+// openSQLiteReader opens an existing SQLite history read-only, without the
+// rollup and prune jobs. The schema is left as it is.
+func openSQLiteReader(dir string, tiers []historyTier) (*sqliteHistory, error) {
+	path := filepath.Join(filepath.Clean(dir), "history.db")
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	h := &sqliteHistory{db: db, path: path, ttl: tiers[0].ttl}
+	h.tieredHistory = newTieredHistory(h, tiers)
+	return h, nil
+}
+
+// checkSQLiteFile runs SQLite's quick_check on the database at path, so a
+// truncated or corrupt file is caught before it replaces a good one.
+func checkSQLiteFile(path string) error {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var res string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&res); err != nil {
+		return err
+	}
+	if res != "ok" {
+		return fmt.Errorf("quick_check: %s", res)
+	}
+	return nil
+}
+
+// addSQLiteColumns adds columns introduced after a database was created.
+// They all default to 0, which reads as "speed unknown".
+func addSQLiteColumns(db *sql.DB) error {
+	want := map[string][]string{
+		"samples": {"speed_bps REAL"},
+		"rollups": {"util_count INTEGER", "speed_bps REAL"},
+	}
+	for _, f := range []string{"rx_util_pct", "tx_util_pct"} {
+		for _, agg := range []string{"_min", "_max", "_sum", "_last"} {
+			want["rollups"] = append(want["rollups"], f+agg+" REAL")
+		}
+	}
+	for table, cols := range want {
+		have := make(map[string]bool)
+		rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			have[name] = true
+		}
+		rows.Close()
+		for _, col := range cols {
+			if have[strings.Fields(col)[0]] {
+				continue
+			}
+			if _, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + col + ` NOT NULL DEFAULT 0`); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *sqliteHistory) StoreSample(device, iface string, sample Sample) error {
+	return h.StoreBatch([]seriesSample{{id: seriesID{Device: device, Iface: iface}, sample: sample}})
+}
+
+// StoreBatch inserts samples in one transaction. A sample with the same
+// timestamp replaces the stored one.
+func (h *sqliteHistory) StoreBatch(batch []seriesSample) error {
+	cutoff := time.Now().Add(-h.ttl).UnixMilli()
+	newest := make(map[seriesID]int64)
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	ins, err := tx.Prepare(`INSERT OR REPLACE INTO samples
+		(device, iface, ts, rx_bps, tx_bps, drops, queue_depth, latency_ms, seq, speed_bps)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+	for _, rec := range batch {
+		smp := rec.sample
+		if smp.Ts < cutoff {
+			continue
+		}
+		if _, err := ins.Exec(rec.id.Device, rec.id.Iface, smp.Ts, smp.Rx, smp.Tx, smp.Drops, smp.Q, smp.Lat, int64(smp.Seq), smp.Speed); err != nil {
+			return err
+		}
+		if smp.Ts > newest[rec.id] {
+			newest[rec.id] = smp.Ts
+		}
+	}
+	for s, ts := range newest {
+		_, err := tx.Exec(`INSERT INTO series (device, iface, last_seen) VALUES (?, ?, ?)
+			ON CONFLICT (device, iface) DO UPDATE SET last_seen = max(last_seen, excluded.last_seen)`,
+			s.Device, s.Iface, ts)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, rec := range batch {
+		if rec.sample.Ts >= cutoff {
+			h.markDirty(rec.id, rec.sample.Ts)
+		}
+	}
+	return nil
+}
+
+func (h *sqliteHistory) rangeRaw(s seriesID, start, end int64) ([]Sample, error) {
+	if cutoff := time.Now().Add(-h.ttl).UnixMilli(); start < cutoff {
+		start = cutoff
+	}
+	rows, err := h.db.Query(`SELECT ts, rx_bps, tx_bps, drops, queue_depth, latency_ms, seq, speed_bps
+		FROM samples WHERE device = ? AND iface = ? AND ts >= ? AND ts < ? ORDER BY ts`,
+		s.Device, s.Iface, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Sample, 0, 128)
+	for rows.Next() {
+		var smp Sample
+		var seq int64
+		if err := rows.Scan(&smp.Ts, &smp.Rx, &smp.Tx, &smp.Drops, &smp.Q, &smp.Lat, &seq, &smp.Speed); err != nil {
+			return nil, err
+		}
+		smp.Seq = uint64(seq)
+		out = append(out, smp)
+	}
+	return out, rows.Err()
+}
+
+func (h *sqliteHistory) tier(name string) historyTier {
+	for _, t := range h.tiers {
+		if t.name == name {
+			return t
+		}
+	}
+	return historyTier{}
+}
+
+func (h *sqliteHistory) rangeRollups(tier string, s seriesID, start, end int64) ([]Rollup, error) {
+	t := h.tier(tier)
+	// a bucket expires ttl after it closes, as in the Badger backend
+	if cutoff := time.Now().Add(-t.ttl - t.step).UnixMilli(); start <= cutoff {
+		start = cutoff + 1
+	}
+	rows, err := h.db.Query(`SELECT ts, count, `+strings.Join(rollupCols, ", ")+`
+		FROM rollups WHERE tier = ? AND device = ? AND iface = ? AND ts >= ? AND ts < ? ORDER BY ts`,
+		tier, s.Device, s.Iface, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Rollup, 0, 64)
+	for rows.Next() {
+		var r Rollup
+		dest := []interface{}{&r.Ts, &r.Count}
+		for _, f := range r.fields() {
+			dest = append(dest, &f.Min, &f.Max, &f.Sum, &f.Last)
+		}
+		dest = append(dest, &r.UtilCount, &r.Speed)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (h *sqliteHistory) watermark(tier string, s seriesID) (int64, bool, error) {
+	var wm int64
+	err := h.db.QueryRow(`SELECT ts FROM watermarks WHERE tier = ? AND device = ? AND iface = ?`,
+		tier, s.Device, s.Iface).Scan(&wm)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return wm, err == nil, err
+}
+
+func (h *sqliteHistory) writeRollups(t historyTier, s seriesID, rollups []Rollup, end int64, now time.Time) error {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	ins, err := tx.Prepare(`INSERT OR REPLACE INTO rollups (tier, device, iface, ts, count, ` +
+		strings.Join(rollupCols, ", ") + `) VALUES (?, ?, ?, ?, ?` + strings.Repeat(", ?", len(rollupCols)) + `)`)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+	for _, r := range rollups {
+		if !time.UnixMilli(r.Ts).Add(t.step + t.ttl).After(now) {
+			continue
+		}
+		args := []interface{}{t.name, s.Device, s.Iface, r.Ts, r.Count}
+		for _, f := range r.fields() {
+			args = append(args, f.Min, f.Max, f.Sum, f.Last)
+		}
+		args = append(args, r.UtilCount, r.Speed)
+		if _, err := ins.Exec(args...); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO watermarks (tier, device, iface, ts) VALUES (?, ?, ?, ?)`,
+		t.name, s.Device, s.Iface, end)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (h *sqliteHistory) ListSeries() ([]seriesID, error) {
+	maxTTL := h.tiers[len(h.tiers)-1].ttl
+	rows, err := h.db.Query(`SELECT device, iface FROM series WHERE last_seen >= ? ORDER BY device, iface`,
+		time.Now().Add(-maxTTL).UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var series []seriesID
+	for rows.Next() {
+		var s seriesID
+		if err := rows.Scan(&s.Device, &s.Iface); err != nil {
+			return nil, err
+		}
+		series = append(series, s)
+	}
+	return series, rows.Err()
+}
+
+func (h *sqliteHistory) pruneLoop() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			if err := h.prune(now); err != nil {
+				log.Printf("history prune failed: %v", err)
+			}
+		}
+	}
+}
+
+// prune deletes samples, rollups, watermarks and series past retention.
+func (h *sqliteHistory) prune(now time.Time) error {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM samples WHERE ts < ?`, now.Add(-h.ttl).UnixMilli()); err != nil {
+		return err
+	}
+	for _, t := range h.tiers[1:] {
+		if _, err := tx.Exec(`DELETE FROM rollups WHERE tier = ? AND ts <= ?`, t.name, now.Add(-t.ttl-t.step).UnixMilli()); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM watermarks WHERE tier = ? AND ts < ?`, t.name, now.Add(-t.ttl).UnixMilli()); err != nil {
+			return err
+		}
+	}
+	maxTTL := h.tiers[len(h.tiers)-1].ttl
+	if _, err := tx.Exec(`DELETE FROM series WHERE last_seen < ?`, now.Add(-maxTTL).UnixMilli()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (h *sqliteHistory) Enabled() bool { return true }
+
+// Backup copies the database with VACUUM INTO, which is consistent while
+// writers carry on, then streams the copy to w.
+func (h *sqliteHistory) Backup(w io.Writer) error {
+	tmp := h.path + ".backup"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	if _, err := h.db.Exec(`VACUUM INTO ?`, tmp); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (h *sqliteHistory) Close() error {
+	h.stop()
+	return h.db.Close()
+}
@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestSelectTierPicksCoarsestSatisfyingStep(t *testing.T) {
+	tiers := buildTiers(time.Hour, map[string]time.Duration{"1m": 24 * time.Hour, "1h": 720 * time.Hour})
+	cases := map[time.Duration]string{0: "raw", 30 * time.Second: "raw", time.Minute: "1m", 15 * time.Minute: "1m", 2 * time.Hour: "1h"}
+	for res, want := range cases {
+		if got := tiers[selectTier(tiers, res)].name; got != want {
+			t.Errorf("resolution %s: expected tier %s, got %s", res, want, got)
+		}
+	}
+	if got := selectTier(buildTiers(time.Hour, nil), time.Hour); got != 0 {
+		t.Errorf("expected raw when rollups are disabled, got tier %d", got)
+	}
+}
+
+func TestRollupUtilizationSkipsUnknownSpeed(t *testing.T) {
+	rollups := rollupSamples([]Sample{
+		{Ts: 0, Rx: 5e8, Speed: 1e9},
+		{Ts: 1000, Rx: 9e8, Speed: 1e9},
+		{Ts: 2000, Rx: 1e9}, // speed unknown: counts for rx, not utilization
+	}, time.Minute)
+	if len(rollups) != 1 || rollups[0].Count != 3 || rollups[0].UtilCount != 2 {
+		t.Fatalf("unexpected rollups: %+v", rollups)
+	}
+	r := mergeRollups(rollups, time.Hour)[0]
+	if got := rollupValue(r, "rx_util_pct", "avg"); got != 70 {
+		t.Fatalf("avg rx utilization = %v, want 70", got)
+	}
+	if got := rollupValue(r, "rx_util_pct", "max"); got != 90 {
+		t.Fatalf("max rx utilization = %v, want 90", got)
+	}
+	if got := r.Sample().Speed; got != 1e9 {
+		t.Fatalf("flattened speed = %v, want 1e9", got)
+	}
+}
+
+func TestHistoryRollupTiers(t *testing.T) {
+	forEachBackend(t, testHistoryRollupTiers)
+}
+
+func testHistoryRollupTiers(t *testing.T, backend string) {
+	now := time.Now()
+	tiers := buildTiers(time.Hour, map[string]time.Duration{"1m": 24 * time.Hour, "1h": 720 * time.Hour})
+	b := openTestHistory(t, backend, tiers)
+
+	base := bucketStart(now.Add(-10*time.Minute).UnixMilli(), time.Minute)
+	// three full minutes, one sample every 10s with rx = 0..5 each minute
+	for m := int64(0); m < 3; m++ {
+		for i := int64(0); i < 6; i++ {
+			s := Sample{Ts: base + m*60_000 + i*10_000, Rx: float64(i), Drops: uint32(m)}
+			if err := b.StoreSample("sw-1", "eth0", s); err != nil {
+				t.Fatalf("store: %v", err)
+			}
+		}
+	}
+	if err := b.rollupOnce(now); err != nil {
+		t.Fatalf("rollup: %v", err)
+	}
+
+	rollups, err := b.RollupRange("sw-1", "eth0", now.Add(-15*time.Minute), now, time.Minute)
+	if err != nil {
+		t.Fatalf("fetch rollups: %v", err)
+	}
+	if len(rollups) != 3 {
+		t.Fatalf("expected 3 one-minute rollups, got %d", len(rollups))
+	}
+	for i, r := range rollups {
+		if r.Ts != base+int64(i)*60_000 || r.Count != 6 {
+			t.Fatalf("rollup %d: unexpected bucket %+v", i, r)
+		}
+		if r.Rx.Min != 0 || r.Rx.Max != 5 || r.Rx.Last != 5 || r.Rx.Avg(r.Count) != 2.5 {
+			t.Fatalf("rollup %d: unexpected rx agg %+v", i, r.Rx)
+		}
+	}
+
+	samples, err := b.FetchSamples("sw-1", "eth0", 15*time.Minute, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("fetch samples: %v", err)
+	}
+	if len(samples) != 3 || samples[0].Rx != 2.5 {
+		t.Fatalf("expected 3 averaged samples from the 1m tier, got %+v", samples)
+	}
+
+	// a backfilled sample for an already rolled minute re-opens that bucket
+	if err := b.StoreSample("sw-1", "eth0", Sample{Ts: base + 5_000, Rx: 100}); err != nil {
+		t.Fatalf("store backfill: %v", err)
+	}
+	if err := b.rollupOnce(now); err != nil {
+		t.Fatalf("rollup after backfill: %v", err)
+	}
+	rollups, _ = b.RollupRange("sw-1", "eth0", now.Add(-15*time.Minute), now, time.Minute)
+	if rollups[0].Count != 7 || rollups[0].Rx.Max != 100 {
+		t.Fatalf("expected backfill merged into first bucket, got %+v", rollups[0])
+	}
+
+	// the current hour isn't rolled up yet; it is filled in from finer tiers
+	hourly, err := b.RollupRange("sw-1", "eth0", now.Add(-2*time.Hour), now, time.Hour)
+	if err != nil {
+		t.Fatalf("fetch hourly: %v", err)
+	}
+	total := 0
+	for _, r := range hourly {
+		total += r.Count
+	}
+	if total != 19 {
+		t.Fatalf("expected all 19 samples in the hourly view, got %d across %+v", total, hourly)
+	}
+}
+
+func TestHistoryBackfillKeepsRollupsPastRawRetention(t *testing.T) {
+	forEachBackend(t, testHistoryBackfillKeepsRollupsPastRawRetention)
+}
+
+func testHistoryBackfillKeepsRollupsPastRawRetention(t *testing.T, backend string) {
+	now := time.Now()
+	tiers := buildTiers(5*time.Minute, map[string]time.Duration{"1m": 24 * time.Hour, "1h": 0})
+	b := openTestHistory(t, backend, tiers)
+	s := seriesID{Device: "sw-1", Iface: "eth0"}
+
+	// a minute rolled up while its raw samples were still retained, which
+	// now straddles the raw retention cutoff
+	cut := now.Add(-5 * time.Minute).UnixMilli()
+	edge := bucketStart(cut, time.Minute)
+	rolled := Rollup{Ts: edge, Count: 60}
+	if err := b.(tierStorage).writeRollups(tiers[1], s, []Rollup{rolled}, bucketStart(now.UnixMilli(), time.Minute), now); err != nil {
+		t.Fatalf("write rollups: %v", err)
+	}
+	// a late sample in the retained part of that minute, and one long gone
+	for _, ts := range []int64{(cut + edge + 60_000) / 2, now.Add(-30 * time.Minute).UnixMilli()} {
+		if err := b.StoreSample("sw-1", "eth0", Sample{Ts: ts, Rx: 1}); err != nil {
+			t.Fatalf("store: %v", err)
+		}
+	}
+	if err := b.rollupOnce(now); err != nil {
+		t.Fatalf("rollup: %v", err)
+	}
+	rollups, err := b.RollupRange("sw-1", "eth0", time.UnixMilli(edge), time.UnixMilli(edge+60_000), time.Minute)
+	if err != nil {
+		t.Fatalf("fetch rollups: %v", err)
+	}
+	if len(rollups) != 1 || rollups[0].Count != 60 {
+		t.Fatalf("rollup past raw retention was rebuilt from partial data: %+v", rollups)
+	}
+}
+
+func TestQueryHistoryGlobAndAggregates(t *testing.T) {
+	forEachBackend(t, testQueryHistoryGlobAndAggregates)
+}
+
+func testQueryHistoryGlobAndAggregates(t *testing.T, backend string) {
+	// a fixed, 20s-aligned start keeps the buckets independent of the clock;
+	// raw retention reaches back far enough to cover it
+	b := openTestHistory(t, backend, buildTiers(100*365*24*time.Hour, nil))
+	state := NewState(5*time.Second, 3, nil, b)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	for _, dev := range []string{"sw-1", "sw-10", "core-1"} {
+		for i := int64(0); i < 20; i++ {
+			// latency 1..20 within one 20s window
+			s := Sample{Ts: start + i*1000, Lat: float64(i + 1), Rx: 10}
+			if err := b.StoreSample(dev, "eth0", s); err != nil {
+				t.Fatalf("store: %v", err)
+			}
+		}
+	}
+
+	series, err := state.QueryHistory(HistoryQuery{
+		Devices: []string{"sw-*"},
+		Start:   time.UnixMilli(start),
+		End:     time.UnixMilli(start + 20_000),
+		Step:    20 * time.Second,
+		Agg:     "p95",
+		Fields:  []string{"latency_ms"},
+	})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if len(series) != 2 || series[0].Device != "sw-1" || series[1].Device != "sw-10" {
+		t.Fatalf("expected sw-1 and sw-10, got %+v", series)
+	}
+	pts := series[0].Points
+	if len(pts) != 1 || pts[0].Values["latency_ms"] != 19 {
+		t.Fatalf("expected a single p95 bucket of 19, got %+v", pts)
+	}
+	if _, ok := pts[0].Values["rx_bps"]; ok {
+		t.Fatalf("unselected field returned: %+v", pts[0].Values)
+	}
+
+	series, err = state.QueryHistory(HistoryQuery{
+		Devices: []string{"core-1"},
+		Ifaces:  []string{"eth0"},
+		Start:   time.UnixMilli(start),
+		End:     time.UnixMilli(start + 20_000),
+		Step:    10 * time.Second,
+		Agg:     "sum",
+		Fields:  []string{"rx_bps"},
+	})
+	if err != nil {
+		t.Fatalf("query sum: %v", err)
+	}
+	if got := series[0].Points; len(got) != 2 || got[0].Values["rx_bps"] != 100 {
+		t.Fatalf("expected two 10s buckets summing to 100, got %+v", got)
+	}
+
+	_, err = state.QueryHistory(HistoryQuery{Devices: []string{"sw-1"}, Start: time.Now(), End: time.Now().Add(-time.Second)})
+	if !errors.Is(err, errInvalidQuery) {
+		t.Fatalf("expected invalid query error, got %v", err)
+	}
+}
+
+func TestAsyncHistoryDropsWhenFullAndFlushesOnClose(t *testing.T) {
+	inner := &recordingHistory{}
+	// a long flush interval and large batch keep everything queued until Close
+	a, err := newAsyncHistory(inner, 2, 100, time.Hour, "drop")
+	if err != nil {
+		t.Fatalf("new async history: %v", err)
+	}
+	before := a.pending.Load()
+	for i := 0; i < 50; i++ {
+		if err := a.StoreSample("sw-1", "eth0", Sample{Ts: int64(i)}); err != nil {
+			t.Fatalf("store: %v", err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// the writer may have moved some samples from the queue into its batch,
+	// but never more than the queue could hold on top of that
+	if n := len(inner.samples); n < 2 || n >= 50 {
+		t.Fatalf("expected a bounded number of flushed samples, got %d", n)
+	}
+	if a.pending.Load() != before {
+		t.Fatalf("pending not drained: %d", a.pending.Load())
+	}
+	if _, ok := a.withOptional().(historyBackup); ok {
+		t.Fatalf("async wrapper claims backups its store can't take")
+	}
+	if err := a.StoreSample("sw-1", "eth0", Sample{}); !errors.Is(err, errHistoryClosed) {
+		t.Fatalf("expected errHistoryClosed after close, got %v", err)
+	}
+	for i := 1; i < len(inner.samples); i++ {
+		if inner.samples[i].Ts <= inner.samples[i-1].Ts {
+			t.Fatalf("samples committed out of order: %+v", inner.samples)
+		}
+	}
+	if _, err := newAsyncHistory(inner, 2, 100, 0, "drop"); err == nil {
+		t.Fatalf("expected a zero flush interval to be rejected")
+	}
+}
+
+// pendingCheckHistory fails commits the async wrapper hasn't counted yet.
+type pendingCheckHistory struct {
+	recordingHistory
+	async     *asyncHistory
+	uncounted atomic.Int64
+}
+
+func (p *pendingCheckHistory) StoreSample(device, iface string, s Sample) error {
+	if p.async.pending.Load() < 1 {
+		p.uncounted.Add(1)
+	}
+	return p.recordingHistory.StoreSample(device, iface, s)
+}
+
+func TestAsyncHistoryCountsBeforeEnqueue(t *testing.T) {
+	inner := &pendingCheckHistory{}
+	// single-sample batches commit as soon as the writer receives them
+	a, err := newAsyncHistory(inner, 1, 1, time.Hour, "block")
+	if err != nil {
+		t.Fatalf("new async history: %v", err)
+	}
+	inner.async = a
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				a.StoreSample("sw-1", "eth0", Sample{Ts: int64(i)})
+			}
+		}()
+	}
+	wg.Wait()
+	if err := a.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if n := inner.uncounted.Load(); n > 0 {
+		t.Fatalf("%d samples committed before they were counted as pending", n)
+	}
+	if n := a.pending.Load(); n != 0 {
+		t.Fatalf("pending not drained: %d", n)
+	}
+}
+
+func TestChunkCodecRoundTrip(t *testing.T) {
+	samples := []Sample{
+		{Ts: 1700000000000, Rx: 1.5e6, Tx: 2.25e5, Drops: 3, Q: 12, Lat: 4.2, Seq: 1, Speed: 1e10},
+		{Ts: 1700000001000, Rx: 1.5e6, Tx: 2.3e5, Drops: 0, Q: 9, Lat: 4.2, Seq: 2, Speed: 1e10},
+		{Ts: 1700000002003, Rx: 0, Tx: math.MaxFloat64, Drops: 4000000000, Q: -1, Lat: math.Inf(1), Seq: 3},
+		{Ts: 1700000001500, Rx: -7, Tx: 1e-300, Drops: 1, Q: 0, Lat: 0.001, Seq: 1},
+	}
+	buf := encodeChunk(samples)
+	got, err := decodeChunk(buf)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != len(samples) {
+		t.Fatalf("decoded %d samples, want %d", len(got), len(samples))
+	}
+	for i := range samples {
+		if got[i] != samples[i] {
+			t.Fatalf("sample %d = %+v, want %+v", i, got[i], samples[i])
+		}
+	}
+	if _, err := decodeChunk(buf[:len(buf)-1]); err == nil {
+		t.Fatal("truncated chunk decoded without error")
+	}
+
+	// v1 chunks predate the speed field
+	v1 := []byte{chunkV1, 1, 0x0a, 0, 0, 0, 0, 0, 2}
+	if got, err := decodeChunk(v1); err != nil || len(got) != 1 || got[0] != (Sample{Ts: 5, Seq: 1}) {
+		t.Fatalf("v1 chunk decoded to %+v, %v", got, err)
+	}
+}
+
+func TestBadgerMigratesLegacyKeys(t *testing.T) {
+	dir := t.TempDir()
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("open badger: %v", err)
+	}
+	now := time.Now().UnixMilli()
+	err = db.Update(func(txn *badger.Txn) error {
+		for i := 0; i < 30; i++ {
+			val, _ := json.Marshal(Sample{Ts: now - int64(i)*1000, Rx: float64(i), Seq: uint64(i)})
+			key := fmt.Sprintf("%s|%s|%020d", "sw-1", "eth0", now-int64(i)*1000)
+			if err := txn.SetEntry(badger.NewEntry([]byte(key), val).WithTTL(time.Hour)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("seed legacy keys: %v", err)
+	}
+	db.Close()
+
+	store, err := openHistoryStore("badger", dir, buildTiers(time.Hour, nil), 0)
+	if err != nil {
+		t.Fatalf("open history: %v", err)
+	}
+	defer store.Close()
+	got, err := store.FetchSamples("sw-1", "eth0", time.Minute, 0)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if len(got) != 30 || got[0].Rx != 29 || got[29].Rx != 0 {
+		t.Fatalf("migrated samples = %d (first %+v)", len(got), got[0])
+	}
+	series, _ := store.ListSeries()
+	if len(series) != 1 || series[0] != (seriesID{Device: "sw-1", Iface: "eth0"}) {
+		t.Fatalf("series after migration = %v", series)
+	}
+	legacy := 0
+	store.(*badgerHistory).db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek([]byte{metaPrefix[0] + 1}); it.Valid(); it.Next() {
+			legacy++
+		}
+		return nil
+	})
+	if legacy != 0 {
+		t.Fatalf("%d legacy keys left after migration", legacy)
+	}
+}
+
+func TestBadgerCompactsChunkParts(t *testing.T) {
+	store, err := openHistoryStore("badger", t.TempDir(), buildTiers(time.Hour, nil), 0)
+	if err != nil {
+		t.Fatalf("open history: %v", err)
+	}
+	defer store.Close()
+	b := store.(*badgerHistory)
+	now := time.Now()
+	closed := bucketStart(now.Add(-30*time.Minute).UnixMilli(), chunkSpan)
+	open := bucketStart(now.UnixMilli(), chunkSpan)
+	// one part per batch; the last batch rewrites a sample of the first
+	for i := int64(0); i < 20; i++ {
+		batch := []seriesSample{
+			{id: seriesID{"sw-1", "eth0"}, sample: Sample{Ts: closed + i*1000, Rx: float64(i)}},
+			{id: seriesID{"sw-1", "eth0"}, sample: Sample{Ts: open + i, Rx: float64(i)}},
+		}
+		if err := b.StoreBatch(batch); err != nil {
+			t.Fatalf("store: %v", err)
+		}
+	}
+	if err := b.StoreBatch([]seriesSample{{id: seriesID{"sw-1", "eth0"}, sample: Sample{Ts: closed, Rx: 100}}}); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	keys := func(start int64) int {
+		n := 0
+		b.db.View(func(txn *badger.Txn) error {
+			return b.eachChunk(txn, seriesID{"sw-1", "eth0"}, start, start+1, func(_ int64, _ []Sample, k [][]byte) error {
+				n = len(k)
+				return nil
+			})
+		})
+		return n
+	}
+	if keys(closed) != 21 || keys(open) != 20 {
+		t.Fatalf("expected a part per batch, got %d and %d", keys(closed), keys(open))
+	}
+	before, _ := b.rangeRaw(seriesID{"sw-1", "eth0"}, 0, math.MaxInt64)
+
+	if err := b.compactChunks(now); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if keys(closed) != 1 || keys(open) != 20 {
+		t.Fatalf("expected the closed chunk sealed and the open one left, got %d and %d keys", keys(closed), keys(open))
+	}
+	after, _ := b.rangeRaw(seriesID{"sw-1", "eth0"}, 0, math.MaxInt64)
+	if len(after) != 40 || !reflect.DeepEqual(before, after) || after[0].Rx != 100 {
+		t.Fatalf("compaction changed samples: %d before, %d after, first %+v", len(before), len(after), after[0])
+	}
+
+	// a late sample for a sealed chunk is a new part until the next pass
+	if err := b.StoreSample("sw-1", "eth0", Sample{Ts: closed + 500, Rx: 7}); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if err := b.compactChunks(now); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if got, _ := b.rangeRaw(seriesID{"sw-1", "eth0"}, closed, closed+1000); keys(closed) != 1 || len(got) != 2 || got[1].Rx != 7 {
+		t.Fatalf("late sample not folded in: %d keys, %+v", keys(closed), got)
+	}
+}
+
+func TestSampleRingEvictsOldestAndKeepsOrder(t *testing.T) {
+	r := newSampleRing(4)
+	for _, ts := range []int64{10, 30, 20, 40, 50, 5, 30} {
+		r.insert(Sample{Ts: ts, Rx: float64(ts)})
+	}
+	got := r.between(0, 100)
+	want := []int64{20, 30, 40, 50}
+	if len(got) != len(want) {
+		t.Fatalf("ring holds %+v, want ts %v", got, want)
+	}
+	for i, s := range got {
+		if s.Ts != want[i] {
+			t.Fatalf("ring holds %+v, want ts %v", got, want)
+		}
+	}
+	if got := r.between(30, 50); len(got) != 2 || got[0].Ts != 30 {
+		t.Fatalf("between(30, 50) = %+v", got)
+	}
+}
+
+func TestMemoryHistoryPrunesStaleSeries(t *testing.T) {
+	h, err := openMemoryHistory(buildTiers(time.Minute, map[string]time.Duration{"1m": time.Hour}), 16)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer h.Close()
+	now := time.Now()
+	for _, dev := range []string{"gone", "kept"} {
+		if err := h.StoreSample(dev, "eth0", Sample{Ts: now.UnixMilli(), Rx: 1}); err != nil {
+			t.Fatalf("store: %v", err)
+		}
+	}
+	h.rollupOnce(now.Add(2 * time.Minute))
+	later := now.Add(2 * time.Hour)
+	if err := h.StoreSample("kept", "eth0", Sample{Ts: later.UnixMilli(), Rx: 2}); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	h.prune(later)
+	gone := seriesID{Device: "gone", Iface: "eth0"}
+	h.mu.RLock()
+	_, raw := h.raw[gone]
+	_, rollups := h.rollups["1m"][gone]
+	_, watermark := h.watermarks["1m"][gone]
+	kept := len(h.lastSeen)
+	h.mu.RUnlock()
+	if raw || rollups || watermark || kept != 1 {
+		t.Fatalf("stale series not evicted: raw=%v rollups=%v watermark=%v series=%d", raw, rollups, watermark, kept)
+	}
+	h.tieredHistory.mu.Lock()
+	_, dirty := h.dirty[gone.String()]
+	h.tieredHistory.mu.Unlock()
+	if dirty {
+		t.Fatalf("stale series still dirty")
+	}
+}
+
+func TestHistoryExportCSVAndParquet(t *testing.T) {
+	h := openTestHistory(t, "memory", buildTiers(24*time.Hour, nil))
+	start := time.Now().Add(-3 * time.Hour).Truncate(time.Hour)
+	// samples every 10 minutes over 3h so the export crosses several windows
+	for i := 0; i < 18; i++ {
+		ts := start.Add(time.Duration(i) * 10 * time.Minute).UnixMilli()
+		for _, dev := range []string{"sw-1", "sw-2"} {
+			if err := h.StoreSample(dev, "eth0", Sample{Ts: ts, Rx: float64(i), Drops: uint32(i)}); err != nil {
+				t.Fatalf("store: %v", err)
+			}
+		}
+	}
+	berlin, err := parseExportLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	e := HistoryExport{
+		Devices:  []string{"sw-*"},
+		Start:    start,
+		End:      start.Add(3 * time.Hour),
+		Columns:  []string{"time", "device", "rx_bps", "drops"},
+		Location: berlin,
+	}
+	series, err := prepareExport(h, &e, nil)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := writeHistoryExport(&buf, h, series, e); err != nil {
+		t.Fatalf("export csv: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1+2*18 || lines[0] != "time,device,rx_bps,drops" {
+		t.Fatalf("unexpected csv: %d lines, header %q", len(lines), lines[0])
+	}
+	want := start.In(berlin).Format("2006-01-02T15:04:05.000Z07:00") + ",sw-1,0,0"
+	if lines[1] != want || !strings.HasSuffix(lines[18], ",sw-1,17,17") || !strings.Contains(lines[19], ",sw-2,0,0") {
+		t.Fatalf("unexpected rows: %q ... %q %q", lines[1], lines[18], lines[19])
+	}
+
+	e.Format = "parquet"
+	buf.Reset()
+	if err := writeHistoryExport(&buf, h, series, e); err != nil {
+		t.Fatalf("export parquet: %v", err)
+	}
+	pf, _ := buffer.NewBufferFile(buf.Bytes())
+	pr, err := reader.NewParquetReader(pf, nil, 1)
+	if err != nil {
+		t.Fatalf("read parquet: %v", err)
+	}
+	defer pr.ReadStop()
+	if n := pr.GetNumRows(); n != 36 {
+		t.Fatalf("expected 36 parquet rows, got %d", n)
+	}
+
+	e.Columns = []string{"rx_bps", "bogus"}
+	if _, err := prepareExport(h, &e, nil); !errors.Is(err, errInvalidQuery) {
+		t.Fatalf("expected invalid column error, got %v", err)
+	}
+}
+
+func TestHistoryExportKeepsBucketsWhole(t *testing.T) {
+	h := openTestHistory(t, "memory", buildTiers(24*time.Hour, map[string]time.Duration{"1m": 24 * time.Hour}))
+	base := time.Now().Add(-4 * time.Hour).Truncate(time.Hour)
+	for i := 0; i < 2*360+30; i++ {
+		ts := base.Add(time.Duration(i) * 10 * time.Second).UnixMilli()
+		if err := h.StoreSample("sw-1", "eth0", Sample{Ts: ts, Rx: float64(i)}); err != nil {
+			t.Fatalf("store: %v", err)
+		}
+	}
+	// an unaligned start puts start+1h inside a 1m bucket
+	e := HistoryExport{
+		Devices:    []string{"sw-1"},
+		Start:      base.Add(30 * time.Second),
+		End:        base.Add(2*time.Hour + 30*time.Second),
+		Resolution: time.Minute,
+		Columns:    []string{"ts", "rx_bps"},
+	}
+	series, err := prepareExport(h, &e, nil)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := writeHistoryExport(&buf, h, series, e); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	want, err := h.SampleRange("sw-1", "eth0", e.Start, e.End, e.Resolution)
+	if err != nil {
+		t.Fatalf("range: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")[1:]
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d buckets, got %d", len(want), len(lines))
+	}
+	for i, smp := range want {
+		if row := fmt.Sprintf("%d,%g", smp.Ts, smp.Rx); lines[i] != row {
+			t.Fatalf("bucket %d: got %q, want %q", i, lines[i], row)
+		}
+	}
+}
+
+func TestHistoryBackupAndRestore(t *testing.T) {
+	for _, backend := range []string{"badger", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			tiers := buildTiers(time.Hour, nil)
+			src, err := openHistoryStore(backend, t.TempDir(), tiers, 0)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			now := time.Now().UnixMilli()
+			for i := int64(0); i < 20; i++ {
+				if err := src.StoreSample("sw-1", "eth0", Sample{Ts: now - i*1000, Rx: float64(i)}); err != nil {
+					t.Fatalf("store: %v", err)
+				}
+			}
+			m, err := NewBackupManager(src, backend, t.TempDir(), 0, 1)
+			if err != nil {
+				t.Fatalf("backup manager: %v", err)
+			}
+			status, err := m.Snapshot()
+			if err != nil || status.Bytes == 0 {
+				t.Fatalf("snapshot: %+v %v", status, err)
+			}
+			// back to back, within the same second: a second file, not a replacement
+			again, err := m.Snapshot()
+			if err != nil || again.File <= status.File {
+				t.Fatalf("second snapshot %q after %q: %v", again.File, status.File, err)
+			}
+			if _, err := os.Stat(status.File); !os.IsNotExist(err) {
+				t.Fatalf("keep=1 left the older snapshot behind: %v", err)
+			}
+			status = again
+			// written while the source keeps taking samples
+			src.StoreSample("sw-1", "eth0", Sample{Ts: now + 1000})
+			src.Close()
+
+			dir := t.TempDir()
+			if err := restoreHistory(backend, dir, status.File); err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+			check := func(when string) {
+				t.Helper()
+				dst, err := openHistoryStore(backend, dir, tiers, 0)
+				if err != nil {
+					t.Fatalf("open %s: %v", when, err)
+				}
+				defer dst.Close()
+				if got := fetchAll(t, dst, "sw-1", "eth0"); len(got) != 20 {
+					t.Fatalf("%s: expected the 20 samples in the backup, got %d", when, len(got))
+				}
+			}
+			check("restored")
+
+			// a truncated backup fails and leaves the restored history intact
+			data, err := os.ReadFile(status.File)
+			if err != nil {
+				t.Fatalf("read backup: %v", err)
+			}
+			truncated := filepath.Join(t.TempDir(), "truncated")
+			if err := os.WriteFile(truncated, data[:len(data)/2], 0o644); err != nil {
+				t.Fatalf("write truncated: %v", err)
+			}
+			if err := restoreHistory(backend, dir, truncated); err == nil {
+				t.Fatalf("restoring a truncated backup succeeded")
+			}
+			check("after failed restore")
+		})
+	}
+
+	mem := openTestHistory(t, "memory", buildTiers(time.Hour, nil))
+	if _, err := NewBackupManager(mem, "memory", t.TempDir(), 0, 1); !errors.Is(err, errBackupUnsupported) {
+		t.Fatalf("expected memory backups to be unsupported, got %v", err)
+	}
+}
+
+func TestAdminSnapshotAPI(t *testing.T) {
+	post := func(mux *http.ServeMux, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/snapshot", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	mem := openTestHistory(t, "memory", buildTiers(time.Hour, nil))
+	open := http.NewServeMux()
+	registerAdminAPI(open, nil, mem, "")
+	if code := post(open, ""); code != http.StatusUnauthorized {
+		t.Fatalf("without --admin-token: status %d, want 401", code)
+	}
+	mux := http.NewServeMux()
+	registerAdminAPI(mux, nil, mem, "secret")
+	if code := post(mux, "secret"); code != http.StatusNotImplemented {
+		t.Fatalf("memory backend: status %d, want 501", code)
+	}
+
+	store := openTestHistory(t, "badger", buildTiers(time.Hour, nil))
+	mux = http.NewServeMux()
+	registerAdminAPI(mux, nil, store, "secret")
+	if code := post(mux, "secret"); code != http.StatusNotFound {
+		t.Fatalf("backups not configured: status %d, want 404", code)
+	}
+	m, err := NewBackupManager(store, "badger", t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("backup manager: %v", err)
+	}
+	mux = http.NewServeMux()
+	registerAdminAPI(mux, m, store, "secret")
+	if code := post(mux, "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: status %d, want 401", code)
+	}
+	if code := post(mux, "secret"); code != http.StatusOK {
+		t.Fatalf("snapshot: status %d, want 200", code)
+	}
+}
+
+func TestHistoryReaderOpensWithoutWriting(t *testing.T) {
+	for _, backend := range []string{"badger", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			tiers := buildTiers(time.Hour, map[string]time.Duration{"1m": 24 * time.Hour})
+			src, err := openHistoryStore(backend, dir, tiers, 0)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			now := time.Now().Add(-10 * time.Minute).UnixMilli()
+			for i := int64(0); i < 20; i++ {
+				if err := src.StoreSample("sw-1", "eth0", Sample{Ts: now + i*1000, Rx: float64(i)}); err != nil {
+					t.Fatalf("store: %v", err)
+				}
+			}
+			src.Close()
+
+			r, err := openHistoryReader(backend, dir, tiers)
+			if err != nil {
+				t.Fatalf("open read-only: %v", err)
+			}
+			defer r.Close()
+			if got := fetchAll(t, r, "sw-1", "eth0"); len(got) != 20 {
+				t.Fatalf("expected 20 samples, got %d", len(got))
+			}
+			if err := r.StoreSample("sw-1", "eth0", Sample{Ts: now + 30000}); err == nil {
+				t.Fatalf("read-only %s history accepted a write", backend)
+			}
+		})
+	}
+	if _, err := openHistoryReader("badger", t.TempDir()+"/missing", buildTiers(time.Hour, nil)); err == nil {
+		t.Fatalf("opened a missing history directory")
+	}
+}
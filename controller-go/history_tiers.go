@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// tierStorage is what a history backend provides so tieredHistory can serve
+// tiered reads and run the rollup job on top of it.
+type tierStorage interface {
+	// rangeRaw returns raw samples with start <= ts < end in time order.
+	rangeRaw(s seriesID, start, end int64) ([]Sample, error)
+	// rangeRollups returns a tier's rollups with start <= ts < end in time order.
+	rangeRollups(tier string, s seriesID, start, end int64) ([]Rollup, error)
+	// watermark reports where the tier's rollups for s are complete up to.
+	watermark(tier string, s seriesID) (int64, bool, error)
+	// writeRollups stores rollups and advances the tier watermark to end.
+	writeRollups(t historyTier, s seriesID, rollups []Rollup, end int64, now time.Time) error
+	ListSeries() ([]seriesID, error)
+}
+
+// tieredHistory implements the read side of HistoryStore and the background
+// rollup job for any tierStorage. Backends embed it and call markDirty for
+// every sample they store.
+type tieredHistory struct {
+	store tierStorage
+	tiers []historyTier
+
+	mu sync.Mutex
+	// oldest sample ts stored per series since the last rollup pass; lets
+	// backfilled samples re-open buckets that were already rolled up
+	dirty map[string]int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newTieredHistory(store tierStorage, tiers []historyTier) *tieredHistory {
+	return &tieredHistory{
+		store: store,
+		tiers: tiers,
+		dirty: make(map[string]int64),
+		done:  make(chan struct{}),
+	}
+}
+
+// start launches the rollup job when there are rollup tiers.
+func (h *tieredHistory) start() {
+	if len(h.tiers) > 1 {
+		h.wg.Add(1)
+		go h.rollupLoop()
+	}
+}
+
+// stop ends the rollup job and waits for a pass in progress.
+func (h *tieredHistory) stop() {
+	close(h.done)
+	h.wg.Wait()
+}
+
+// markDirty notes a stored sample so the next rollup pass covers its bucket.
+func (h *tieredHistory) markDirty(s seriesID, ts int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if d, ok := h.dirty[s.String()]; !ok || ts < d {
+		h.dirty[s.String()] = ts
+	}
+}
+
+func (h *tieredHistory) FetchSamples(device, iface string, since, resolution time.Duration) ([]Sample, error) {
+	return h.SampleRange(device, iface, time.Now().Add(-since), time.UnixMilli(math.MaxInt64), resolution)
+}
+
+func (h *tieredHistory) SampleRange(device, iface string, start, end time.Time, resolution time.Duration) ([]Sample, error) {
+	s := seriesID{Device: device, Iface: iface}
+	idx := selectTier(h.tiers, resolution)
+	if idx == 0 {
+		return h.store.rangeRaw(s, start.UnixMilli(), end.UnixMilli())
+	}
+	step := h.tiers[idx].step
+	rollups, err := h.rollupsFrom(idx, s, bucketStart(start.UnixMilli(), step), end.UnixMilli(), step)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Sample, 0, len(rollups))
+	for _, r := range rollups {
+		out = append(out, r.Sample())
+	}
+	return out, nil
+}
+
+func (h *tieredHistory) RollupRange(device, iface string, start, end time.Time, step time.Duration) ([]Rollup, error) {
+	if step <= 0 {
+		return nil, errors.New("rollup step must be positive")
+	}
+	s := seriesID{Device: device, Iface: iface}
+	return h.rollupsFrom(selectTier(h.tiers, step), s, bucketStart(start.UnixMilli(), step), end.UnixMilli(), step)
+}
+
+// rollupsFrom aggregates a series at step over [start, end) from tier idx
+// onwards. Buckets the tier hasn't rolled yet (after its watermark, e.g. the
+// current hour) are filled in from the next finer tier, down to raw samples.
+func (h *tieredHistory) rollupsFrom(idx int, s seriesID, start, end int64, step time.Duration) ([]Rollup, error) {
+	t := h.tiers[idx]
+	if t.step == 0 {
+		samples, err := h.store.rangeRaw(s, start, end)
+		if err != nil {
+			return nil, err
+		}
+		return rollupSamples(samples, step), nil
+	}
+	wm, ok, err := h.store.watermark(t.name, s)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || wm < start {
+		wm = start
+	}
+	if wm > end {
+		wm = end
+	}
+	stored, err := h.store.rangeRollups(t.name, s, start, wm)
+	if err != nil {
+		return nil, err
+	}
+	if wm == end {
+		return mergeRollups(stored, step), nil
+	}
+	tail, err := h.rollupsFrom(idx-1, s, wm, end, step)
+	if err != nil {
+		return nil, err
+	}
+	// the bucket straddling wm may appear in both halves; merging joins it
+	return mergeRollups(append(stored, tail...), step), nil
+}
+
+func (h *tieredHistory) rollupLoop() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			if err := h.rollupOnce(now); err != nil {
+				log.Printf("history rollup failed: %v", err)
+			}
+		}
+	}
+}
+
+// rollupOnce summarises every closed, not yet rolled bucket of every series
+// into each rollup tier, cascading raw -> 1m -> 1h.
+func (h *tieredHistory) rollupOnce(now time.Time) error {
+	series, err := h.store.ListSeries()
+	if err != nil {
+		return err
+	}
+	for _, s := range series {
+		if err := h.rollupSeries(s, now); err != nil {
+			return fmt.Errorf("series %s: %w", s, err)
+		}
+	}
+	return nil
+}
+
+func (h *tieredHistory) rollupSeries(s seriesID, now time.Time) error {
+	h.mu.Lock()
+	dirty, isDirty := h.dirty[s.String()]
+	delete(h.dirty, s.String())
+	h.mu.Unlock()
+
+	src := h.tiers[0]
+	for _, t := range h.tiers[1:] {
+		end := bucketStart(now.Add(-rollupGrace).UnixMilli(), t.step)
+		start, ok, err := h.store.watermark(t.name, s)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// first pass: cover whatever the source tier still retains
+			start = bucketStart(now.Add(-src.ttl).UnixMilli(), t.step)
+		}
+		if isDirty {
+			// only rebuild buckets the source tier still holds in full; older
+			// ones would be overwritten with what is left of them
+			redo := bucketStart(dirty, t.step)
+			if kept := now.Add(-src.ttl).UnixMilli(); redo < kept {
+				redo = bucketStart(kept+t.step.Milliseconds()-1, t.step)
+			}
+			if redo < start {
+				start = redo
+			}
+		}
+		if start < end {
+			var rollups []Rollup
+			if src.step == 0 {
+				samples, err := h.store.rangeRaw(s, start, end)
+				if err != nil {
+					return err
+				}
+				rollups = rollupSamples(samples, t.step)
+			} else {
+				fine, err := h.store.rangeRollups(src.name, s, start, end)
+				if err != nil {
+					return err
+				}
+				rollups = mergeRollups(fine, t.step)
+			}
+			if err := h.store.writeRollups(t, s, rollups, end, now); err != nil {
+				return err
+			}
+		}
+		src = t
+	}
+	return nil
+}
@@ -18,10 +18,12 @@ type Msg struct {
 	Q        int32   `json:"queue_depth"`
 	LatMs    float64 `json:"latency_ms"`
 	Seq      uint64  `json:"seq"`
+	SpeedBps float64 `json:"speed_bps,omitempty"` // link speed reported by the agent
+	Backfill bool    `json:"backfill,omitempty"`  // replayed after an outage; history only
 	Sig      string  `json:"sig,omitempty"`
 }
 
-func startUDPListener(addr string, state *State, secret []byte, limiter *RateLimiter) {
+func startUDPListener(addr string, state *State, secret []byte, limiter *RateLimiter, registry *Registry, recorder *Recorder) {
 	pc, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		log.Fatalf("udp listen failed: %v", err)
@@ -31,31 +33,49 @@ func startUDPListener(addr string, state *State, secret []byte, limiter *RateLim
 
 	buf := make([]byte, 2048)
 	for {
-		n, _, err := pc.ReadFrom(buf)
+		n, src, err := pc.ReadFrom(buf)
 		if err != nil {
 			log.Printf("udp read error: %v", err)
 			continue
 		}
+		recv := time.Now()
 		var m Msg
 		if err := json.Unmarshal(buf[:n], &m); err != nil {
 			log.Printf("json unmarshal failed: %v", err)
+			recorder.Record(recv, src, buf[:n], captureInvalidJSON)
 			continue
 		}
-		if limiter != nil && !limiter.Allow(m.DeviceID, time.Now()) {
+		if limiter != nil && !limiter.Allow(m.DeviceID, recv) {
 			log.Printf("rate limit exceeded for device %s", m.DeviceID)
+			recorder.Record(recv, src, buf[:n], captureRateLimited)
 			continue
 		}
 		if len(secret) > 0 {
 			if m.Sig == "" {
 				log.Printf("missing signature for device %s iface %s", m.DeviceID, m.Iface)
+				recorder.Record(recv, src, buf[:n], captureMissingSignature)
 				continue
 			}
 			expected := computeSignature(m, secret)
 			if !hmac.Equal([]byte(expected), []byte(m.Sig)) {
 				log.Printf("invalid signature for device %s iface %s", m.DeviceID, m.Iface)
+				recorder.Record(recv, src, buf[:n], captureInvalidSignature)
 				continue
 			}
 		}
-		state.Ingest(m)
+		ip := addrIP(src)
+		if !state.SourceAllowed(m.DeviceID, ip) {
+			log.Printf("device %s not allowed to report from %s", m.DeviceID, ip)
+			cSourceRejected.Inc()
+			recorder.Record(recv, src, buf[:n], captureSourceNotAllowed)
+			continue
+		}
+		// after the signature check, so forged datagrams can't enroll devices
+		if !registry.Admit(m.DeviceID, src, recv) {
+			recorder.Record(recv, src, buf[:n], captureUnregistered)
+			continue
+		}
+		recorder.Record(recv, src, buf[:n], captureAccepted)
+		state.IngestFrom(m, ip)
 	}
 }
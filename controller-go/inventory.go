@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Inventory attaches operator-maintained metadata and tags to devices and
+// their ifaces, keyed by device id. Entries for devices that haven't
+// reported yet are applied when they first do.
+type Inventory struct {
+	Devices map[string]DeviceInventory `json:"devices" yaml:"devices"`
+}
+
+type DeviceInventory struct {
+	Site   string                    `json:"site,omitempty" yaml:"site,omitempty"`
+	Rack   string                    `json:"rack,omitempty" yaml:"rack,omitempty"`
+	Role   string                    `json:"role,omitempty" yaml:"role,omitempty"`
+	Vendor string                    `json:"vendor,omitempty" yaml:"vendor,omitempty"`
+	Owner  string                    `json:"owner,omitempty" yaml:"owner,omitempty"` // owning team
+	Tags   []string                  `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Meta   map[string]string         `json:"meta,omitempty" yaml:"meta,omitempty"` // free-form extras
+	Ifaces map[string]IfaceInventory `json:"ifaces,omitempty" yaml:"ifaces,omitempty"`
+	// CIDRs the device may report from; overrides --source-allow
+	AllowedSources []string `json:"allowed_sources,omitempty" yaml:"allowed_sources,omitempty"`
+}
+
+type IfaceInventory struct {
+	SpeedBps    float64           `json:"speed_bps,omitempty" yaml:"speed_bps,omitempty"`
+	Description string            `json:"description,omitempty" yaml:"description,omitempty"`
+	Tags        []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty" yaml:"meta,omitempty"`
+}
+
+// meta flattens the well-known fields and the free-form extras into the
+// map carried by Device.Meta; the named fields win over extras.
+func (e DeviceInventory) meta() map[string]string {
+	out := make(map[string]string, len(e.Meta)+5)
+	for k, v := range e.Meta {
+		out[k] = v
+	}
+	for k, v := range map[string]string{"site": e.Site, "rack": e.Rack, "role": e.Role, "vendor": e.Vendor, "owner": e.Owner} {
+		if v != "" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func (inv Inventory) validate() error {
+	for id, d := range inv.Devices {
+		if strings.TrimSpace(id) == "" {
+			return errors.New("inventory has an empty device id")
+		}
+		if _, err := parseCIDRs(strings.Join(d.AllowedSources, ",")); err != nil {
+			return fmt.Errorf("inventory %s: allowed_sources: %w", id, err)
+		}
+		for name, ifc := range d.Ifaces {
+			if ifc.SpeedBps < 0 {
+				return fmt.Errorf("inventory %s/%s: negative speed_bps", id, name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseInventory reads YAML, which also accepts JSON inventories.
+func parseInventory(data []byte) (Inventory, error) {
+	var inv Inventory
+	if err := yaml.Unmarshal(data, &inv); err != nil {
+		return inv, err
+	}
+	if inv.Devices == nil {
+		inv.Devices = make(map[string]DeviceInventory)
+	}
+	return inv, inv.validate()
+}
+
+// applyDeviceInventory sets d's tags and metadata from its inventory entry,
+// clearing them when there is none; s.mu must be held for writing.
+func applyDeviceInventory(d *Device, e DeviceInventory) {
+	d.Tags = append([]string(nil), e.Tags...)
+	d.Meta = e.meta()
+	for name, ifs := range d.Ifaces {
+		applyIfaceInventory(ifs, e.Ifaces[name])
+	}
+}
+
+func applyIfaceInventory(ifs *IfaceState, e IfaceInventory) {
+	ifs.mu.Lock()
+	defer ifs.mu.Unlock()
+	ifs.SpeedBps = e.SpeedBps
+	ifs.Description = e.Description
+	ifs.Tags = append([]string(nil), e.Tags...)
+	ifs.Meta = make(map[string]string, len(e.Meta))
+	for k, v := range e.Meta {
+		ifs.Meta[k] = v
+	}
+}
+
+// SetInventory replaces the inventory and re-applies it to every known
+// device.
+func (s *State) SetInventory(inv Inventory) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inventory = inv
+	s.sourcePins = make(map[string][]*net.IPNet)
+	for id, e := range inv.Devices {
+		if len(e.AllowedSources) > 0 {
+			// validated when the inventory was loaded
+			s.sourcePins[id], _ = parseCIDRs(strings.Join(e.AllowedSources, ","))
+		}
+	}
+	for id, d := range s.Devices {
+		applyDeviceInventory(d, inv.Devices[id])
+	}
+	s.markAllDirtyLocked()
+}
+
+// deviceTags returns the tags of a live device, falling back to the
+// inventory for devices that haven't reported since startup.
+func (s *State) deviceTags(id string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if d, ok := s.Devices[id]; ok {
+		return d.Tags
+	}
+	return s.inventory.Devices[id].Tags
+}
+
+// hasTags reports whether device id carries every tag in tags.
+func (s *State) hasTags(id string, tags []string) bool {
+	have := s.deviceTags(id)
+	for _, t := range tags {
+		if !containsString(have, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// InventoryManager holds the inventory, loading it from a file when one is
+// configured and writing API changes back to it. Without a file the
+// inventory lives in memory and is managed through the API only.
+type InventoryManager struct {
+	state   *State
+	path    string
+	mu      sync.Mutex
+	inv     Inventory
+	modTime time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewInventoryManager loads path, if set, and reloads it every interval when
+// its modification time changes.
+func NewInventoryManager(state *State, path string, interval time.Duration) (*InventoryManager, error) {
+	m := &InventoryManager{state: state, path: strings.TrimSpace(path), inv: Inventory{Devices: make(map[string]DeviceInventory)}, done: make(chan struct{})}
+	if m.path == "" {
+		return m, nil
+	}
+	if _, err := m.reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		m.wg.Add(1)
+		go m.loop(interval)
+	}
+	return m, nil
+}
+
+func (m *InventoryManager) loop(interval time.Duration) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			changed, err := m.reload()
+			if err != nil {
+				// keep serving the last good inventory
+				log.Printf("inventory reload failed: %v", err)
+			} else if changed {
+				log.Printf("inventory reloaded from %s", m.path)
+			}
+		}
+	}
+}
+
+// reload reads the file if it changed since the last load.
+func (m *InventoryManager) reload() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fi, err := os.Stat(m.path)
+	if err != nil {
+		return false, err
+	}
+	if fi.ModTime().Equal(m.modTime) {
+		return false, nil
+	}
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return false, err
+	}
+	inv, err := parseInventory(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", m.path, err)
+	}
+	m.inv = inv
+	m.modTime = fi.ModTime()
+	m.state.SetInventory(inv)
+	return true, nil
+}
+
+// Inventory returns a copy of the current inventory.
+func (m *InventoryManager) Inventory() Inventory {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.inv.clone()
+}
+
+func (inv Inventory) clone() Inventory {
+	out := Inventory{Devices: make(map[string]DeviceInventory, len(inv.Devices))}
+	for id, d := range inv.Devices {
+		out.Devices[id] = d
+	}
+	return out
+}
+
+// update applies fn to a copy of the inventory, then persists and applies
+// the result.
+func (m *InventoryManager) update(fn func(inv *Inventory)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inv := m.inv.clone()
+	fn(&inv)
+	if err := inv.validate(); err != nil {
+		return err
+	}
+	if m.path != "" {
+		if err := m.save(inv); err != nil {
+			return err
+		}
+	}
+	m.inv = inv
+	m.state.SetInventory(inv)
+	return nil
+}
+
+// save writes inv to the inventory file atomically, as JSON for a .json
+// file and YAML otherwise. Comments in a hand-edited file are not kept.
+func (m *InventoryManager) save(inv Inventory) error {
+	var data []byte
+	var err error
+	if strings.EqualFold(filepath.Ext(m.path), ".json") {
+		data, err = json.MarshalIndent(inv, "", "  ")
+	} else {
+		data, err = yaml.Marshal(inv)
+	}
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(m.path); err == nil {
+		// our own write shouldn't trigger a reload
+		m.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+func (m *InventoryManager) Close() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+// registerInventoryAPI serves /api/inventory (GET the whole inventory, PUT
+// to replace it) and /api/inventory/devices/{id} (GET, PUT, DELETE one
+// entry). Writes need the admin token when one is set.
+func registerInventoryAPI(mux *http.ServeMux, m *InventoryManager, token string) {
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	readBody := func(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+		data, err := io.ReadAll(io.LimitReader(r.Body, 16<<20))
+		if err == nil {
+			err = yaml.Unmarshal(data, v)
+		}
+		if err != nil {
+			http.Error(w, "invalid inventory: "+err.Error(), http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+	update := func(w http.ResponseWriter, fn func(inv *Inventory)) bool {
+		if err := m.update(fn); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+
+	mux.HandleFunc("/api/inventory", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, m.Inventory())
+		case http.MethodPut:
+			if !authorized(r, token) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			var inv Inventory
+			if !readBody(w, r, &inv) {
+				return
+			}
+			if inv.Devices == nil {
+				inv.Devices = make(map[string]DeviceInventory)
+			}
+			if update(w, func(cur *Inventory) { *cur = inv }) {
+				writeJSON(w, m.Inventory())
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/inventory/devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		id := r.PathValue("id")
+		if r.Method != http.MethodGet && !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			e, ok := m.Inventory().Devices[id]
+			if !ok {
+				http.Error(w, "device not in inventory", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, e)
+		case http.MethodPut:
+			var e DeviceInventory
+			if !readBody(w, r, &e) {
+				return
+			}
+			if update(w, func(inv *Inventory) { inv.Devices[id] = e }) {
+				writeJSON(w, e)
+			}
+		case http.MethodDelete:
+			if update(w, func(inv *Inventory) { delete(inv.Devices, id) }) {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
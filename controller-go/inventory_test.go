@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInventoryAppliesToLiveAndNewDevices(t *testing.T) {
+	path := t.TempDir() + "/inventory.yaml"
+	err := os.WriteFile(path, []byte(`
+devices:
+  sw-01:
+    site: dc1
+    role: leaf
+    tags: [core]
+    meta: {rack: ignored-by-named-field}
+    rack: r12
+    ifaces:
+      eth0: {speed_bps: 10e9, description: uplink, tags: [wan]}
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewState(5*time.Second, 1, nil, nil)
+	state.Ingest(Msg{DeviceID: "sw-02", Iface: "eth0", TsUnixMs: 1000})
+	m, err := NewInventoryManager(state, path, 0)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer m.Close()
+
+	state.Ingest(Msg{DeviceID: "sw-01", Iface: "eth0", TsUnixMs: 1000})
+	d := state.Devices["sw-01"]
+	if d.Meta["site"] != "dc1" || d.Meta["rack"] != "r12" || !containsString(d.Tags, "core") {
+		t.Fatalf("inventory not applied to new device: %+v", d)
+	}
+	if ifs := d.Ifaces["eth0"]; ifs.SpeedBps != 10e9 || ifs.Description != "uplink" || !containsString(ifs.Tags, "wan") {
+		t.Fatalf("inventory not applied to new iface: %+v", ifs)
+	}
+	if !state.hasTags("sw-01", []string{"core"}) || state.hasTags("sw-02", []string{"core"}) {
+		t.Fatalf("unexpected tag matches")
+	}
+
+	// API writes need the token, apply to live devices and persist
+	mux := http.NewServeMux()
+	registerInventoryAPI(mux, m, "secret")
+	put := func(token string) int {
+		req := httptest.NewRequest(http.MethodPut, "/api/inventory/devices/sw-02", strings.NewReader(`{"site":"dc2","tags":["edge"]}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := put(""); code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated write: status %d", code)
+	}
+	if code := put("secret"); code != http.StatusOK {
+		t.Fatalf("write: status %d", code)
+	}
+	state.evaluateStatuses(time.Now())
+	snap := state.Snapshot()
+	for _, ds := range snap.Devices {
+		if ds.ID == "sw-02" && (ds.Meta["site"] != "dc2" || !containsString(ds.Tags, "edge")) {
+			t.Fatalf("snapshot lacks updated metadata: %+v", ds)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "dc2") || !strings.Contains(string(data), "uplink") {
+		t.Fatalf("inventory file not updated: %v\n%s", err, data)
+	}
+
+	// removing an entry clears the device's metadata
+	req := httptest.NewRequest(http.MethodDelete, "/api/inventory/devices/sw-01", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || len(state.Devices["sw-01"].Tags) != 0 || state.Devices["sw-01"].Ifaces["eth0"].SpeedBps != 0 {
+		t.Fatalf("delete: status %d, device %+v", rec.Code, state.Devices["sw-01"])
+	}
+}
+
+func TestEventsCarryInventoryTags(t *testing.T) {
+	hub := NewHub() // not running: events stay on hub.broadcast
+	state := NewState(time.Hour, 3, hub, nil)
+	state.SetInventory(Inventory{Devices: map[string]DeviceInventory{
+		"sw-01": {Site: "dc1", Tags: []string{"core"}},
+	}})
+	next := func() Event {
+		t.Helper()
+		for {
+			select {
+			case msg := <-hub.broadcast:
+				if ev, ok := msg.(Event); ok {
+					return ev
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("no event published")
+			}
+		}
+	}
+	msg := Msg{DeviceID: "sw-01", Iface: "eth0", TsUnixMs: 1000, Seq: 1}
+	state.IngestFrom(msg, net.ParseIP("10.0.0.1"))
+	state.IngestFrom(msg, net.ParseIP("10.0.0.2"))
+	if ev := next(); ev.Kind != "source_changed" || !containsString(ev.Tags, "core") || ev.Meta["site"] != "dc1" {
+		t.Fatalf("source change event without inventory: %+v", ev)
+	}
+	state.Decommission("sw-01", "")
+	ev := next()
+	if ev.Kind != "forgotten" || !containsString(ev.Tags, "core") || ev.Meta["site"] != "dc1" {
+		t.Fatalf("forgotten event without inventory: %+v", ev)
+	}
+	b, _ := json.Marshal(ev)
+	if !strings.Contains(string(b), `"tags":["core"]`) || !strings.Contains(string(b), `"site":"dc1"`) {
+		t.Fatalf("unexpected event json %s", b)
+	}
+
+	// devices without inventory leave both fields out
+	state.Ingest(Msg{DeviceID: "sw-02", Iface: "eth0", TsUnixMs: 1000, Seq: 1})
+	state.Decommission("sw-02", "")
+	b, _ = json.Marshal(next())
+	if strings.Contains(string(b), "tags") || strings.Contains(string(b), "meta") {
+		t.Fatalf("expected no tags or meta, got %s", b)
+	}
+}
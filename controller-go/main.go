@@ -1,49 +1,191 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		runExport(os.Args[2:])
+		return
+	}
 	udpAddr := flag.String("udp", ":9000", "UDP listen address")
 	httpAddr := flag.String("http", ":8080", "HTTP listen address")
 	metricsAddr := flag.String("metrics", ":9090", "Prometheus metrics address")
 	offlineAfter := flag.Duration("offline-after", 5*time.Second, "offline after duration")
+	forgetAfter := flag.Duration("forget-after", 0, "forget devices and ifaces that haven't reported for this long (0 keeps them; must exceed --offline-after)")
 	alertConsec := flag.Int("alert-consecutive", 3, "consecutive breached samples required before alerting")
+	alertUtilPct := flag.Float64("alert-util-pct", 0, "count rx or tx link utilization at or above this percentage as a breach (0 disables; needs a known iface speed)")
 	maxIngest := flag.Int("max-ingest-per-sec", 0, "max ingest messages per device per second (0 disables rate limiting)")
 	hmacSecret := flag.String("hmac-secret", "", "shared HMAC secret for agent messages (empty disables verification)")
 	historyDir := flag.String("history-dir", "", "directory for persisted history (empty disables)")
+	historyBackend := flag.String("history-backend", "badger", `history storage engine: "badger" or "sqlite" (both need --history-dir), or "memory"`)
+	historyRestore := flag.String("history-restore", "", "backup file to restore into --history-dir before starting (replaces existing history)")
+	backupDir := flag.String("backup-dir", "", "directory for history backups (empty disables backups and the snapshot endpoint)")
+	backupInterval := flag.Duration("backup-interval", 0, "take a history backup this often (0 only backs up on demand)")
+	backupKeep := flag.Int("backup-keep", 7, "history backups to keep (0 keeps all)")
+	adminToken := flag.String("admin-token", "", "bearer token for /api/admin, device removal, inventory writes and the registry API (empty disables them)")
+	historyMemorySamples := flag.Int("history-memory-samples", 3600, "raw samples kept per series by the memory history backend")
 	historyRetention := flag.Duration("history-retention", 5*time.Minute, "duration to retain persisted samples")
+	historyRetention1m := flag.Duration("history-retention-1m", 24*time.Hour, "duration to retain 1-minute rollups (0 disables the tier)")
+	historyRetention1h := flag.Duration("history-retention-1h", 30*24*time.Hour, "duration to retain 1-hour rollups (0 disables the tier)")
+	historyQueue := flag.Int("history-queue", 10000, "samples buffered for asynchronous history writes")
+	historyBatch := flag.Int("history-batch", 256, "max samples committed per history write batch")
+	historyFlush := flag.Duration("history-flush-interval", 250*time.Millisecond, "max time a queued sample waits before its batch is committed")
+	historyOverflow := flag.String("history-overflow", "drop", `what to do when the history queue is full: "drop" new samples or "block" ingest`)
 	staticDir := flag.String("static-dir", "../web-dashboard/dist", "path to built dashboard assets (empty to disable)")
+	stateFile := flag.String("state-file", "", "checkpoint live device state to this file and restore it at startup (empty disables)")
+	stateInterval := flag.Duration("state-checkpoint-interval", 30*time.Second, "how often to checkpoint live device state")
+	inventoryFile := flag.String("inventory", "", "YAML or JSON inventory of device/iface metadata and tags (empty keeps the inventory in memory, managed via /api/inventory)")
+	inventoryReload := flag.Duration("inventory-reload", 30*time.Second, "check the inventory file for changes this often (0 disables)")
+	metricsMetaLabels := flag.String("metrics-meta-labels", "", "comma-separated inventory metadata keys to add as Prometheus labels, e.g. site,role")
+	registryFile := flag.String("registry", "", "JSON file holding the device registry (enrollments and approvals); empty keeps it in memory")
+	registryStrict := flag.Bool("registry-strict", false, "only ingest devices approved in the registry; unknown devices enroll as pending")
+	registryAutoApprove := flag.String("registry-auto-approve", "", "comma-separated CIDRs whose devices are approved on first contact, e.g. 10.0.0.0/8")
+	registryMaxPending := flag.Int("registry-max-pending", 1000, "pending enrollments to track at most (0 is unlimited)")
+	registryMaxAuto := flag.Int("registry-max-auto", 1000, "devices to auto-approve at most; later ones enroll as pending (0 is unlimited)")
+	sourceAllow := flag.String("source-allow", "", "comma-separated CIDRs every device must report from (inventory allowed_sources override it per device; empty allows any)")
+	sourceChangeAlert := flag.Duration("source-change-alert", 0, "keep a device ALERT this long after it reports from a new address (0 only logs and emits an event)")
+	publishRate := flag.Float64("publish-rate", 10, "max state snapshots per second published to WebSocket and SSE clients; changes in between are coalesced")
+	sseHeartbeat := flag.Duration("sse-heartbeat", 15*time.Second, "heartbeat comment interval on idle /api/stream connections")
+	wsQueue := flag.Int("ws-queue", 32, "messages queued per WebSocket client")
+	wsWriteTimeout := flag.Duration("ws-write-timeout", 10*time.Second, "deadline for writing one message to a WebSocket client")
+	wsPingInterval := flag.Duration("ws-ping-interval", 30*time.Second, "ping WebSocket clients this often; clients that don't answer within twice this are dropped")
+	wsSlowTimeout := flag.Duration("ws-slow-timeout", 30*time.Second, "disconnect WebSocket clients whose queue stays full this long")
+	captureDir := flag.String("capture-dir", "", "directory for NDJSON captures of received datagrams (empty disables)")
+	captureRejected := flag.Bool("capture-rejected", false, "also capture datagrams rejected by parsing, rate limiting or signature checks")
+	captureMaxBytes := flag.Int64("capture-max-bytes", 64<<20, "rotate capture files after this many bytes")
+	captureKeep := flag.Int("capture-keep", 10, "capture files to keep (0 keeps all)")
 	flag.Parse()
 
-	historyStore, err := openHistoryStore(*historyDir, *historyRetention)
+	metaLabels, err := parseMetricsMetaLabels(*metricsMetaLabels)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *forgetAfter < 0 || (*forgetAfter > 0 && *forgetAfter <= *offlineAfter) {
+		log.Fatalf("--forget-after must be 0 or longer than --offline-after (%s)", *offlineAfter)
+	}
+
+	autoApprove, err := parseCIDRs(*registryAutoApprove)
+	if err != nil {
+		log.Fatalf("--registry-auto-approve: %v", err)
+	}
+	allowedSources, err := parseCIDRs(*sourceAllow)
+	if err != nil {
+		log.Fatalf("--source-allow: %v", err)
+	}
+	if len(allowedSources) > 0 && *hmacSecret == "" {
+		log.Printf("--source-allow without --hmac-secret: source addresses can be forged, so pinning only filters misconfigured agents")
+	}
+	if (*registryFile != "" || *registryStrict) && *adminToken == "" {
+		// pending devices could never be approved, nor entries inspected
+		log.Fatalf("--registry and --registry-strict need --admin-token for the registry API")
+	}
+	registry, err := NewRegistry(*registryFile, *registryStrict, autoApprove, *registryMaxPending, *registryMaxAuto)
+	if err != nil {
+		log.Fatalf("registry load failed: %v", err)
+	}
+	defer registry.Close()
+	if registry != nil {
+		log.Printf("device registry enabled (strict=%t, %d devices)", *registryStrict, len(registry.List("")))
+	} else if len(autoApprove) > 0 {
+		log.Fatalf("--registry-auto-approve needs --registry or --registry-strict")
+	}
+
+	tiers := buildTiers(*historyRetention, map[string]time.Duration{"1m": *historyRetention1m, "1h": *historyRetention1h})
+	if *historyRestore != "" {
+		if err := restoreHistory(*historyBackend, *historyDir, *historyRestore); err != nil {
+			log.Fatalf("history restore failed: %v", err)
+		}
+		log.Printf("restored history from %s", *historyRestore)
+	}
+	historyStore, err := openHistoryStore(*historyBackend, *historyDir, tiers, *historyMemorySamples)
 	if err != nil {
 		log.Fatalf("history store init failed: %v", err)
 	}
-	defer historyStore.Close()
 	if historyStore.Enabled() {
-		log.Printf("history persistence enabled at %s (retention %s)", *historyDir, historyRetention.String())
+		if *historyBackend == "memory" {
+			log.Printf("in-memory history enabled (%d samples per series, retention raw=%s 1m=%s 1h=%s)", *historyMemorySamples, historyRetention, historyRetention1m, historyRetention1h)
+		} else {
+			log.Printf("history persistence enabled at %s using %s (retention raw=%s 1m=%s 1h=%s)", *historyDir, *historyBackend, historyRetention, historyRetention1m, historyRetention1h)
+		}
+		async, err := newAsyncHistory(historyStore, *historyQueue, *historyBatch, *historyFlush, *historyOverflow)
+		if err != nil {
+			log.Fatalf("history store init failed: %v", err)
+		}
+		historyStore = async.withOptional()
+	}
+	defer historyStore.Close()
+
+	backups, err := NewBackupManager(historyStore, *historyBackend, *backupDir, *backupInterval, *backupKeep)
+	if err != nil {
+		log.Fatalf("backup init failed: %v", err)
+	}
+	defer backups.Close()
+	if backups != nil {
+		log.Printf("history backups to %s (interval=%s keep=%d)", *backupDir, *backupInterval, *backupKeep)
+	}
+
+	recorder, err := NewRecorder(*captureDir, *captureMaxBytes, *captureKeep, *captureRejected)
+	if err != nil {
+		log.Fatalf("capture init failed: %v", err)
+	}
+	defer recorder.Close()
+	if recorder != nil {
+		log.Printf("capturing datagrams to %s (rejected=%t)", *captureDir, *captureRejected)
 	}
 
 	hub := NewHub()
+	if *publishRate <= 0 {
+		log.Fatalf("--publish-rate must be positive")
+	}
+	if *sseHeartbeat <= 0 {
+		log.Fatalf("--sse-heartbeat must be positive")
+	}
+	hub.sseHeartbeat = *sseHeartbeat
+	if *wsQueue < 1 || *wsWriteTimeout <= 0 || *wsPingInterval <= 0 || *wsSlowTimeout <= 0 {
+		log.Fatalf("--ws-queue, --ws-write-timeout, --ws-ping-interval and --ws-slow-timeout must be positive")
+	}
+	hub.wsQueue, hub.wsWriteTimeout, hub.wsPingInterval, hub.wsSlowTimeout = *wsQueue, *wsWriteTimeout, *wsPingInterval, *wsSlowTimeout
 	go hub.Run()
 
 	state := NewState(*offlineAfter, *alertConsec, hub, historyStore)
+	state.utilAlertPct = *alertUtilPct
+	state.forgetAfter = *forgetAfter
+	state.sourceAllow = allowedSources
+	state.sourceChangeAlert = *sourceChangeAlert
+	inventory, err := NewInventoryManager(state, *inventoryFile, *inventoryReload)
+	if err != nil {
+		log.Fatalf("inventory load failed: %v", err)
+	}
+	defer inventory.Close()
+	if *inventoryFile != "" {
+		log.Printf("loaded inventory for %d devices from %s", len(inventory.Inventory().Devices), *inventoryFile)
+	}
+	checkpoints, err := NewCheckpointer(state, *stateFile, *stateInterval)
+	if err != nil {
+		log.Fatalf("state checkpoint init failed: %v", err)
+	}
+	defer checkpoints.Close()
 
-	go startUDPListener(*udpAddr, state, []byte(*hmacSecret), NewRateLimiter(*maxIngest, time.Second))
+	go startUDPListener(*udpAddr, state, []byte(*hmacSecret), NewRateLimiter(*maxIngest, time.Second), registry, recorder)
 	go startDetector(state)
+	go state.publishLoop(time.Duration(float64(time.Second) / *publishRate), nil)
 
 	// metrics on separate port
 	go func() {
 		mux := http.NewServeMux()
-		registerMetrics(mux, state)
+		registerMetrics(mux, state, metaLabels)
 		log.Printf("metrics listening %s", *metricsAddr)
 		if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
 			log.Fatalf("metrics server failed: %v", err)
@@ -53,7 +195,19 @@ func main() {
 	// HTTP (WS + static)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", hub.ServeWS)
+	mux.HandleFunc("GET /api/stream", hub.ServeSSE)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
 	registerHistoryAPI(mux, state)
+	if *adminToken == "" {
+		log.Printf("no --admin-token: admin and write endpoints are disabled")
+	}
+	registerDevicesAPI(mux, state, *adminToken)
+	registerAdminAPI(mux, backups, historyStore, *adminToken)
+	registerInventoryAPI(mux, inventory, *adminToken)
+	registerRegistryAPI(mux, registry, state, *adminToken)
 
 	staticRegistered := false
 	if *staticDir != "" {
@@ -79,10 +233,22 @@ func main() {
 		})
 	}
 
-	log.Printf("http listening %s", *httpAddr)
-	if err := http.ListenAndServe(*httpAddr, mux); err != nil {
-		log.Fatalf("http server failed: %v", err)
-	}
+	srv := &http.Server{Addr: *httpAddr, Handler: mux}
+	go func() {
+		log.Printf("http listening %s", *httpAddr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("http server failed: %v", err)
+		}
+	}()
+
+	// wait for a shutdown signal so deferred closes flush history and captures
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	log.Printf("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
 }
 
 func spaHandler(root string, fs http.Handler) http.Handler {
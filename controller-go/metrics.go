@@ -1,45 +1,192 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// per-device and per-iface gauges, built by newStateGauges once the opt-in
+// metadata labels are known
+var gRx, gTx, gDrops, gStatus, gIfaceStatus, gSpeed, gRxUtil, gTxUtil *prometheus.GaugeVec
+
 var (
-	gRx          = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_rx_bps", Help: "rx bps"}, []string{"device", "iface"})
-	gTx          = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_tx_bps", Help: "tx bps"}, []string{"device", "iface"})
-	gDrops       = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_drops_total", Help: "drops"}, []string{"device", "iface"})
-	gStatus      = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_device_status", Help: "device status (1=OK,0=ALERT,-1=OFFLINE)"}, []string{"device"})
-	gIfaceStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_iface_status", Help: "iface status (1=OK,0=ALERT,-1=OFFLINE)"}, []string{"device", "iface"})
+	cForgotten = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "etherwatch_forgotten_total", Help: "devices and ifaces forgotten, by reason (expired, decommissioned)"}, []string{"reason"})
+	cBackfill  = prometheus.NewCounter(prometheus.CounterOpts{Name: "etherwatch_backfill_samples_total", Help: "backfilled samples accepted from agents"})
+
+	cSourceChanges  = prometheus.NewCounter(prometheus.CounterOpts{Name: "etherwatch_source_changes_total", Help: "times a device started reporting from a new address"})
+	cSourceRejected = prometheus.NewCounter(prometheus.CounterOpts{Name: "etherwatch_source_rejected_total", Help: "datagrams dropped because their source isn't allowed for the device"})
+
+	cSnapshotsPublished = prometheus.NewCounter(prometheus.CounterOpts{Name: "etherwatch_snapshots_published_total", Help: "state snapshots published to WebSocket and SSE clients"})
+	hSnapshotBuild      = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "etherwatch_snapshot_build_seconds", Help: "time spent rebuilding dirty devices for a published snapshot", Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14)})
+
+	gStreamClients = prometheus.NewGauge(prometheus.GaugeOpts{Name: "etherwatch_sse_clients", Help: "connected /api/stream clients"})
+
+	gWSClients         = prometheus.NewGauge(prometheus.GaugeOpts{Name: "etherwatch_ws_clients", Help: "connected WebSocket clients"})
+	cWSDropped         = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "etherwatch_ws_dropped_total", Help: "WebSocket messages a client's full queue couldn't take: events lost, or state updates coalesced into a later delta"}, []string{"kind"})
+	cWSSlowDisconnects = prometheus.NewCounter(prometheus.CounterOpts{Name: "etherwatch_ws_slow_disconnects_total", Help: "WebSocket clients disconnected for staying behind"})
+
+	gRegistryDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_registry_devices", Help: "devices in the registry by status"}, []string{"status"})
+	cRegistryUnknown = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "etherwatch_registry_unapproved_messages_total", Help: "datagrams from devices that aren't approved, by registry status (pending, rejected, untracked)"}, []string{"status"})
+
+	gHistoryQueue   = prometheus.NewGauge(prometheus.GaugeOpts{Name: "etherwatch_history_queue_depth", Help: "samples waiting to be written to history"})
+	cHistoryDropped = prometheus.NewCounter(prometheus.CounterOpts{Name: "etherwatch_history_dropped_total", Help: "samples dropped because the history queue was full"})
+	hHistoryWrite   = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "etherwatch_history_write_seconds", Help: "history batch commit latency", Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14)})
+
+	gBackupLast  = prometheus.NewGauge(prometheus.GaugeOpts{Name: "etherwatch_history_last_backup_timestamp_seconds", Help: "unix time of the last successful history backup"})
+	gBackupBytes = prometheus.NewGauge(prometheus.GaugeOpts{Name: "etherwatch_history_last_backup_bytes", Help: "size of the last successful history backup"})
+	cBackups     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "etherwatch_history_backups_total", Help: "history backups by result"}, []string{"result"})
 )
 
-func registerMetrics(mux *http.ServeMux, s *State) {
-	prometheus.MustRegister(gRx, gTx, gDrops, gStatus, gIfaceStatus)
+// newStateGauges builds the per-device and per-iface gauges. metaLabels are
+// inventory metadata keys added as labels after device and iface; they are
+// opt-in because every distinct value is a new series.
+func newStateGauges(metaLabels []string) {
+	deviceLabels := append([]string{"device"}, metaLabels...)
+	ifaceLabels := append([]string{"device", "iface"}, metaLabels...)
+	gRx = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_rx_bps", Help: "rx bps"}, ifaceLabels)
+	gTx = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_tx_bps", Help: "tx bps"}, ifaceLabels)
+	gDrops = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_drops_total", Help: "drops"}, ifaceLabels)
+	gStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_device_status", Help: "device status (1=OK,0=ALERT,-1=OFFLINE)"}, deviceLabels)
+	gIfaceStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_iface_status", Help: "iface status (1=OK,0=ALERT,-1=OFFLINE)"}, ifaceLabels)
+	// exported only for ifaces with a known link speed
+	gSpeed = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_iface_speed_bps", Help: "iface link speed"}, ifaceLabels)
+	gRxUtil = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_rx_utilization_percent", Help: "rx link utilization"}, ifaceLabels)
+	gTxUtil = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "etherwatch_tx_utilization_percent", Help: "tx link utilization"}, ifaceLabels)
+}
+
+var metricLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseMetricsMetaLabels validates the --metrics-meta-labels list.
+func parseMetricsMetaLabels(v string) ([]string, error) {
+	var labels []string
+	for _, l := range strings.Split(v, ",") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		if !metricLabelName.MatchString(l) || strings.HasPrefix(l, "__") {
+			return nil, fmt.Errorf("invalid metrics label %q", l)
+		}
+		if l == "device" || l == "iface" || containsString(labels, l) {
+			return nil, fmt.Errorf("duplicate metrics label %q", l)
+		}
+		labels = append(labels, l)
+	}
+	return labels, nil
+}
+
+func registerMetrics(mux *http.ServeMux, s *State, metaLabels []string) {
+	newStateGauges(metaLabels)
+	prometheus.MustRegister(gRx, gTx, gDrops, gStatus, gIfaceStatus, gSpeed, gRxUtil, gTxUtil, cForgotten, cBackfill, gRegistryDevices, cRegistryUnknown, cSourceChanges, cSourceRejected, cSnapshotsPublished, hSnapshotBuild, gStreamClients, gWSClients, cWSDropped, cWSSlowDisconnects, gHistoryQueue, cHistoryDropped, hHistoryWrite, gBackupLast, gBackupBytes, cBackups)
 	mux.Handle("/metrics", promhttp.Handler())
 
 	// simple background updater
 	go func() {
+		u := newGaugeUpdater(s, metaLabels)
 		ticker := time.NewTicker(2 * time.Second)
 		for range ticker.C {
-			s.mu.RLock()
-			for _, d := range s.Devices {
-				for name, ifs := range d.Ifaces {
-					ifs.mu.Lock()
-					gRx.WithLabelValues(d.ID, name).Set(ifs.Last.Rx)
-					gTx.WithLabelValues(d.ID, name).Set(ifs.Last.Tx)
-					gDrops.WithLabelValues(d.ID, name).Set(float64(ifs.Last.Drops))
-					gIfaceStatus.WithLabelValues(d.ID, name).Set(statusValue(ifs.Status))
-					ifs.mu.Unlock()
+			u.update()
+		}
+	}()
+}
+
+// gaugeUpdater copies live state into the per-device and per-iface gauges.
+// It remembers the label values it last set per series, so series whose
+// metadata changed, or whose device or iface was forgotten, are deleted
+// rather than left behind.
+type gaugeUpdater struct {
+	state      *State
+	metaLabels []string
+	prevIface  map[seriesID][]string
+	prevDevice map[string][]string
+}
+
+func newGaugeUpdater(s *State, metaLabels []string) *gaugeUpdater {
+	return &gaugeUpdater{state: s, metaLabels: metaLabels, prevIface: make(map[seriesID][]string), prevDevice: make(map[string][]string)}
+}
+
+func ifaceGauges() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{gRx, gTx, gDrops, gIfaceStatus, gSpeed, gRxUtil, gTxUtil}
+}
+
+func (u *gaugeUpdater) update() {
+	s, metaLabels := u.state, u.metaLabels
+	prevIface, prevDevice := u.prevIface, u.prevDevice
+	seenIface := make(map[seriesID]bool)
+	seenDevice := make(map[string]bool)
+	s.mu.RLock()
+	for _, d := range s.Devices {
+		seenDevice[d.ID] = true
+		for name, ifs := range d.Ifaces {
+			seenIface[seriesID{d.ID, name}] = true
+			ifs.mu.Lock()
+			labels := append([]string{d.ID, name}, metaLabelValues(metaLabels, ifs.Meta, d.Meta)...)
+			if old, ok := prevIface[seriesID{d.ID, name}]; ok && !slices.Equal(old, labels) {
+				for _, g := range ifaceGauges() {
+					g.DeleteLabelValues(old...)
 				}
-				// status mapping
-				gStatus.WithLabelValues(d.ID).Set(statusValue(d.Status))
 			}
-			s.mu.RUnlock()
+			prevIface[seriesID{d.ID, name}] = labels
+			gRx.WithLabelValues(labels...).Set(ifs.Last.Rx)
+			gTx.WithLabelValues(labels...).Set(ifs.Last.Tx)
+			gDrops.WithLabelValues(labels...).Set(float64(ifs.Last.Drops))
+			gIfaceStatus.WithLabelValues(labels...).Set(statusValue(ifs.Status))
+			if ifs.Last.Speed > 0 {
+				gSpeed.WithLabelValues(labels...).Set(ifs.Last.Speed)
+				gRxUtil.WithLabelValues(labels...).Set(ifs.Last.RxUtilPct())
+				gTxUtil.WithLabelValues(labels...).Set(ifs.Last.TxUtilPct())
+			} else {
+				for _, g := range []*prometheus.GaugeVec{gSpeed, gRxUtil, gTxUtil} {
+					g.DeleteLabelValues(labels...)
+				}
+			}
+			ifs.mu.Unlock()
 		}
-	}()
+		// status mapping
+		labels := append([]string{d.ID}, metaLabelValues(metaLabels, nil, d.Meta)...)
+		if old, ok := prevDevice[d.ID]; ok && !slices.Equal(old, labels) {
+			gStatus.DeleteLabelValues(old...)
+		}
+		prevDevice[d.ID] = labels
+		gStatus.WithLabelValues(labels...).Set(statusValue(d.Status))
+	}
+	s.mu.RUnlock()
+
+	// forgotten devices and ifaces
+	for id, labels := range prevIface {
+		if !seenIface[id] {
+			for _, g := range ifaceGauges() {
+				g.DeleteLabelValues(labels...)
+			}
+			delete(prevIface, id)
+		}
+	}
+	for id, labels := range prevDevice {
+		if !seenDevice[id] {
+			gStatus.DeleteLabelValues(labels...)
+			delete(prevDevice, id)
+		}
+	}
+}
+
+// metaLabelValues looks each label up in the iface metadata, then the
+// device's; missing keys give empty values.
+func metaLabelValues(labels []string, ifaceMeta, deviceMeta map[string]string) []string {
+	out := make([]string, len(labels))
+	for i, l := range labels {
+		if v, ok := ifaceMeta[l]; ok {
+			out[i] = v
+		} else {
+			out[i] = deviceMeta[l]
+		}
+	}
+	return out
 }
 
 func statusValue(status string) float64 {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"time"
+)
+
+// Snapshots for WebSocket and SSE clients are published from a loop of
+// their own rather than from ingest. Ingest, the detector and everything
+// else that changes a device only mark it dirty; publishLoop rebuilds the
+// dirty devices, at most once per interval, and broadcasts the result. Each
+// device is read under its own short hold of s.mu, so a large fleet doesn't
+// stall ingest while a snapshot is built.
+
+// markDirty queues device id for the next published snapshot. It may be
+// called with or without s.mu held.
+func (s *State) markDirty(id string) {
+	s.dirtyMu.Lock()
+	s.dirty[id] = true
+	s.dirtyMu.Unlock()
+	select {
+	case s.dirtyC <- struct{}{}:
+	default:
+		// a publish is already due
+	}
+}
+
+// markAllDirtyLocked queues every known device; s.mu must be held.
+func (s *State) markAllDirtyLocked() {
+	for id := range s.Devices {
+		s.markDirty(id)
+	}
+}
+
+// deviceSnapshotLocked returns what clients see of d; s.mu must be held.
+func deviceSnapshotLocked(d *Device) DeviceSnapshot {
+	ds := DeviceSnapshot{ID: d.ID, Status: d.Status, Tags: d.Tags, Meta: d.Meta, Ifaces: make([]IfaceSnapshot, 0, len(d.Ifaces)), Stale: len(d.Ifaces) > 0}
+	for name, ifs := range d.Ifaces {
+		ifs.mu.Lock()
+		is := IfaceSnapshot{Name: name, RxBps: ifs.Last.Rx, TxBps: ifs.Last.Tx, Drops: int64(ifs.Last.Drops), Q: int(ifs.Last.Q), LatMs: ifs.Last.Lat, Status: ifs.Status, Stale: ifs.Stale(),
+			SpeedBps: ifs.Last.Speed, RxUtilPct: ifs.Last.RxUtilPct(), TxUtilPct: ifs.Last.TxUtilPct(), Description: ifs.Description, Tags: ifs.Tags, Meta: ifs.Meta}
+		ifs.mu.Unlock()
+		ds.Stale = ds.Stale && is.Stale
+		ds.Ifaces = append(ds.Ifaces, is)
+	}
+	return ds
+}
+
+// deviceSnapshot returns device id as clients see it, and false once it is
+// gone.
+func (s *State) deviceSnapshot(id string) (DeviceSnapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.Devices[id]
+	if !ok {
+		return DeviceSnapshot{}, false
+	}
+	return deviceSnapshotLocked(d), true
+}
+
+// Snapshot returns the current state of every device. It holds s.mu for
+// one device at a time, so it doesn't see the fleet at a single instant.
+func (s *State) Snapshot() StateSnapshot {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.Devices))
+	for id := range s.Devices {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+	snap := StateSnapshot{T: time.Now().UnixMilli(), Devices: make([]DeviceSnapshot, 0, len(ids))}
+	for _, id := range ids {
+		if ds, ok := s.deviceSnapshot(id); ok {
+			snap.Devices = append(snap.Devices, ds)
+		}
+	}
+	return snap
+}
+
+// publishLoop broadcasts a snapshot at startup, so clients have one even
+// before any device reports, and then whenever devices are dirty, but no
+// more than once per interval; changes arriving in between go out together.
+// It returns when stop is closed.
+func (s *State) publishLoop(interval time.Duration, stop <-chan struct{}) {
+	if s.hub == nil {
+		return
+	}
+	devices := make(map[string]DeviceSnapshot) // as last published
+	s.publishDirty(devices, true)
+	last := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.dirtyC:
+		}
+		if wait := interval - time.Since(last); wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+		last = time.Now()
+		s.publishDirty(devices, false)
+	}
+}
+
+// publishDirty rebuilds the dirty devices in devices, drops the ones that
+// are gone and broadcasts the result. Without dirty devices it only
+// broadcasts when always is set.
+func (s *State) publishDirty(devices map[string]DeviceSnapshot, always bool) {
+	s.dirtyMu.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[string]bool)
+	s.dirtyMu.Unlock()
+	if len(dirty) == 0 && !always {
+		return
+	}
+	start := time.Now()
+	for id := range dirty {
+		if ds, ok := s.deviceSnapshot(id); ok {
+			devices[id] = ds
+		} else {
+			delete(devices, id)
+		}
+	}
+	snap := StateSnapshot{T: time.Now().UnixMilli(), Devices: make([]DeviceSnapshot, 0, len(devices))}
+	for _, ds := range devices {
+		snap.Devices = append(snap.Devices, ds)
+	}
+	hSnapshotBuild.Observe(time.Since(start).Seconds())
+	cSnapshotsPublished.Inc()
+	s.hub.BroadcastState(snap)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPublishCoalescesIngest(t *testing.T) {
+	hub := NewHub() // not running: snapshots stay on hub.broadcast
+	state := NewState(5*time.Second, 3, hub, nil)
+	stop := make(chan struct{})
+	defer close(stop)
+	go state.publishLoop(100*time.Millisecond, stop)
+	next := func() StateSnapshot {
+		t.Helper()
+		for {
+			select {
+			case msg := <-hub.broadcast:
+				if snap, ok := msg.(StateSnapshot); ok {
+					return snap
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("no snapshot published")
+			}
+		}
+	}
+	// every device at its last sample: sw-NN last saw 990+NN, sw-00 1000
+	final := func(snap StateSnapshot) bool {
+		for _, ds := range snap.Devices {
+			var i int
+			fmt.Sscanf(ds.ID, "sw-%d", &i)
+			want := float64(990 + i)
+			if i == 0 {
+				want = 1000
+			}
+			if ds.Ifaces[0].RxBps != want {
+				return false
+			}
+		}
+		return len(snap.Devices) == 10
+	}
+	if snap := next(); len(snap.Devices) != 0 {
+		t.Fatalf("expected an empty snapshot at startup, got %+v", snap)
+	}
+
+	start := time.Now()
+	for i := 1; i <= 1000; i++ {
+		state.Ingest(Msg{DeviceID: fmt.Sprintf("sw-%02d", i%10), Iface: "eth0", TsUnixMs: int64(i), RxBps: float64(i), Seq: uint64(i)})
+	}
+	elapsed := time.Since(start)
+	var snap StateSnapshot
+	published := 0
+	for !final(snap) {
+		snap = next()
+		published++
+	}
+	if max := int(elapsed/(100*time.Millisecond)) + 2; published > max {
+		t.Fatalf("1000 messages in %s published %d snapshots, want at most %d", elapsed, published, max)
+	}
+	select {
+	case msg := <-hub.broadcast:
+		t.Fatalf("published again without changes: %+v", msg)
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	state.Decommission("sw-03", "")
+	snap = next()
+	if len(snap.Devices) != 9 {
+		t.Fatalf("decommissioned device still published: %d devices", len(snap.Devices))
+	}
+	for _, ds := range snap.Devices {
+		if ds.ID == "sw-03" {
+			t.Fatalf("decommissioned device still published")
+		}
+	}
+}
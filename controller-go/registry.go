@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registry statuses
+const (
+	registryPending  = "pending"
+	registryApproved = "approved"
+	registryRejected = "rejected"
+)
+
+// RegistryEntry is one device known to the registry. Times are Unix epoch
+// ms.
+type RegistryEntry struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// source address of the most recent datagram while not approved
+	Source    string `json:"source,omitempty"`
+	FirstSeen int64  `json:"first_seen,omitempty"`
+	LastSeen  int64  `json:"last_seen,omitempty"`
+	// datagrams received while pending or rejected
+	Attempts   uint64 `json:"attempts"`
+	UpdatedAt  int64  `json:"updated_at"`
+	ApprovedBy string `json:"approved_by,omitempty"` // "api" or the matching auto-approve CIDR
+}
+
+type registryFile struct {
+	Devices []RegistryEntry `json:"devices"`
+}
+
+// Registry tracks which device ids may report. Unknown ids are enrolled as
+// pending until approved through the API, or approved at once when their
+// source address is in an auto-approve CIDR. In strict mode only approved
+// devices are ingested; otherwise pending devices are ingested too and the
+// registry only records them. Rejected devices are always dropped. A nil
+// *Registry admits everything.
+//
+// Changes made while ingesting are written to the file by a background
+// saver, so the UDP read path never waits on the disk; changes made through
+// the API are written before the request returns.
+type Registry struct {
+	path        string
+	strict      bool
+	autoApprove []*net.IPNet
+	maxPending  int
+	maxAuto     int
+
+	mu      sync.Mutex
+	devices map[string]*RegistryEntry
+	pending int
+	auto    int // approved through an auto-approve CIDR
+
+	saveMu sync.Mutex    // one file write at a time
+	saveC  chan struct{} // a save is due
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// parseCIDRs parses a comma-separated CIDR list; bare addresses are taken
+// as single hosts.
+func parseCIDRs(v string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, c := range strings.Split(v, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", c)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			c = fmt.Sprintf("%s/%d", c, bits)
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// NewRegistry loads path, if set; a missing file starts an empty registry
+// that is written on the first change. It returns nil when neither strict
+// mode nor a file is configured. At most maxPending devices are tracked as
+// pending and maxAuto approved by CIDR (0 is unlimited).
+func NewRegistry(path string, strict bool, autoApprove []*net.IPNet, maxPending, maxAuto int) (*Registry, error) {
+	path = strings.TrimSpace(path)
+	if path == "" && !strict {
+		return nil, nil
+	}
+	r := &Registry{path: path, strict: strict, autoApprove: autoApprove, maxPending: maxPending, maxAuto: maxAuto, devices: make(map[string]*RegistryEntry)}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			var f registryFile
+			if err := json.Unmarshal(data, &f); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			for i := range f.Devices {
+				e := f.Devices[i]
+				switch e.Status {
+				case registryPending, registryApproved, registryRejected:
+				default:
+					return nil, fmt.Errorf("%s: device %q has unknown status %q", path, e.ID, e.Status)
+				}
+				r.devices[e.ID] = &e
+			}
+		}
+	}
+	r.updateGaugesLocked()
+	if path != "" {
+		r.saveC = make(chan struct{}, 1)
+		r.done = make(chan struct{})
+		r.wg.Add(1)
+		go r.saveLoop()
+	}
+	return r, nil
+}
+
+// Admit reports whether a datagram from device id, received from src, may
+// be ingested, enrolling unknown devices on the way.
+func (r *Registry) Admit(id string, src net.Addr, now time.Time) bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.devices[id]
+	if ok && e.Status == registryApproved {
+		return true
+	}
+	ip := addrIP(src)
+	if ok {
+		e.Attempts++
+		e.LastSeen = now.UnixMilli()
+		e.Source = addrString(src)
+		cRegistryUnknown.WithLabelValues(e.Status).Inc()
+		if e.Status == registryRejected {
+			return false
+		}
+		// the auto-approve list may have grown since the device enrolled
+		if cidr := r.autoApproveMatchLocked(ip); cidr != "" {
+			r.setStatusLocked(e, registryApproved, cidr, now)
+			r.saveLater()
+			return true
+		}
+		return !r.strict
+	}
+
+	if cidr := r.autoApproveMatchLocked(ip); cidr != "" {
+		e = &RegistryEntry{ID: id, Source: addrString(src), FirstSeen: now.UnixMilli(), LastSeen: now.UnixMilli()}
+		r.devices[id] = e
+		r.setStatusLocked(e, registryApproved, cidr, now)
+		r.saveLater()
+		log.Printf("registry: auto-approved device %s from %s (%s)", id, e.Source, cidr)
+		return true
+	}
+	if r.maxPending > 0 && r.pending >= r.maxPending {
+		// too many enrollments outstanding to track another
+		cRegistryUnknown.WithLabelValues("untracked").Inc()
+		return !r.strict
+	}
+	e = &RegistryEntry{ID: id, Source: addrString(src), FirstSeen: now.UnixMilli(), LastSeen: now.UnixMilli(), Attempts: 1}
+	r.devices[id] = e
+	r.setStatusLocked(e, registryPending, "", now)
+	r.saveLater()
+	cRegistryUnknown.WithLabelValues(registryPending).Inc()
+	if r.matchCIDR(ip) != "" {
+		log.Printf("registry: device %s from %s awaiting approval (auto-approve limit of %d reached)", id, e.Source, r.maxAuto)
+	} else {
+		log.Printf("registry: device %s from %s awaiting approval", id, e.Source)
+	}
+	return !r.strict
+}
+
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+// autoApproveMatchLocked returns the auto-approve CIDR containing ip, or ""
+// when there is none or maxAuto devices are auto-approved already; r.mu must
+// be held.
+func (r *Registry) autoApproveMatchLocked(ip net.IP) string {
+	if r.maxAuto > 0 && r.auto >= r.maxAuto {
+		return ""
+	}
+	return r.matchCIDR(ip)
+}
+
+func (r *Registry) matchCIDR(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	for _, n := range r.autoApprove {
+		if n.Contains(ip) {
+			return n.String()
+		}
+	}
+	return ""
+}
+
+// setStatusLocked changes e's status; r.mu must be held. The caller saves.
+func (r *Registry) setStatusLocked(e *RegistryEntry, status, approvedBy string, now time.Time) {
+	e.Status = status
+	e.UpdatedAt = now.UnixMilli()
+	e.ApprovedBy = approvedBy
+	r.updateGaugesLocked()
+}
+
+func (r *Registry) updateGaugesLocked() {
+	counts := map[string]int{registryPending: 0, registryApproved: 0, registryRejected: 0}
+	r.auto = 0
+	for _, e := range r.devices {
+		counts[e.Status]++
+		if e.Status == registryApproved && e.ApprovedBy != "" && e.ApprovedBy != "api" {
+			r.auto++
+		}
+	}
+	r.pending = counts[registryPending]
+	for status, n := range counts {
+		gRegistryDevices.WithLabelValues(status).Set(float64(n))
+	}
+}
+
+// saveLater asks the background saver to write the registry file.
+func (r *Registry) saveLater() {
+	if r.saveC == nil {
+		return
+	}
+	select {
+	case r.saveC <- struct{}{}:
+	default:
+		// a save is already due and will include this change
+	}
+}
+
+func (r *Registry) saveLoop() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.saveC:
+			if err := r.save(); err != nil {
+				log.Printf("registry save failed: %v", err)
+			}
+		}
+	}
+}
+
+// save writes the registry file atomically. r.mu is held only while the
+// entries are copied, not during the write.
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.mu.Lock()
+	f := registryFile{Devices: r.listLocked("")}
+	r.mu.Unlock()
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+func (r *Registry) listLocked(status string) []RegistryEntry {
+	out := make([]RegistryEntry, 0, len(r.devices))
+	for _, e := range r.devices {
+		if status == "" || e.Status == status {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// List returns the entries with the given status, or all of them, by id.
+func (r *Registry) List(status string) []RegistryEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.listLocked(status)
+}
+
+func (r *Registry) Get(id string) (RegistryEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.devices[id]
+	if !ok {
+		return RegistryEntry{}, false
+	}
+	return *e, true
+}
+
+// Set approves or rejects id, registering it first when create is set.
+func (r *Registry) Set(id, status string, create bool) (RegistryEntry, bool) {
+	r.mu.Lock()
+	e, ok := r.devices[id]
+	if !ok {
+		if !create {
+			r.mu.Unlock()
+			return RegistryEntry{}, false
+		}
+		e = &RegistryEntry{ID: id}
+		r.devices[id] = e
+	}
+	approvedBy := ""
+	if status == registryApproved {
+		approvedBy = "api"
+	}
+	r.setStatusLocked(e, status, approvedBy, time.Now())
+	out := *e
+	r.mu.Unlock()
+	if err := r.save(); err != nil {
+		log.Printf("registry save failed: %v", err)
+	}
+	return out, true
+}
+
+// Delete forgets id; it enrolls again the next time it reports.
+func (r *Registry) Delete(id string) bool {
+	r.mu.Lock()
+	if _, ok := r.devices[id]; !ok {
+		r.mu.Unlock()
+		return false
+	}
+	delete(r.devices, id)
+	r.updateGaugesLocked()
+	r.mu.Unlock()
+	if err := r.save(); err != nil {
+		log.Printf("registry save failed: %v", err)
+	}
+	return true
+}
+
+// Close stops the background saver and saves the attempt counters and
+// last-seen times gathered since the last change.
+func (r *Registry) Close() {
+	if r == nil {
+		return
+	}
+	if r.done != nil {
+		close(r.done)
+		r.wg.Wait()
+	}
+	if err := r.save(); err != nil {
+		log.Printf("registry save failed: %v", err)
+	}
+}
+
+// registerRegistryAPI serves the enrollment workflow under /api/registry.
+// Every request needs the admin token when one is set, as entries carry
+// source addresses.
+//
+//	GET    /api/registry[?status=pending]  list entries
+//	GET    /api/registry/{id}              one entry
+//	PUT    /api/registry/{id}              pre-register (approve) a device
+//	POST   /api/registry/{id}/approve      approve a pending or rejected device
+//	POST   /api/registry/{id}/reject       reject it and forget its live state
+//	DELETE /api/registry/{id}              remove the entry
+func registerRegistryAPI(mux *http.ServeMux, reg *Registry, state *State, token string) {
+	handle := func(pattern string, fn func(w http.ResponseWriter, r *http.Request)) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			if !authorized(r, token) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if reg == nil {
+				http.Error(w, "registry disabled", http.StatusNotFound)
+				return
+			}
+			fn(w, r)
+		})
+	}
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	handle("GET /api/registry", func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "", registryPending, registryApproved, registryRejected:
+		default:
+			http.Error(w, "unknown status "+status, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"strict": reg.strict, "devices": reg.List(status)})
+	})
+	handle("GET /api/registry/{id}", func(w http.ResponseWriter, r *http.Request) {
+		e, ok := reg.Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "device not registered", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, e)
+	})
+	handle("PUT /api/registry/{id}", func(w http.ResponseWriter, r *http.Request) {
+		e, _ := reg.Set(r.PathValue("id"), registryApproved, true)
+		writeJSON(w, e)
+	})
+	setStatus := func(status string) func(w http.ResponseWriter, r *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			id := r.PathValue("id")
+			e, ok := reg.Set(id, status, false)
+			if !ok {
+				http.Error(w, "device not registered", http.StatusNotFound)
+				return
+			}
+			if status == registryRejected {
+				state.Decommission(id, "")
+			}
+			log.Printf("registry: device %s %s", id, status)
+			writeJSON(w, e)
+		}
+	}
+	handle("POST /api/registry/{id}/approve", setStatus(registryApproved))
+	handle("POST /api/registry/{id}/reject", setStatus(registryRejected))
+	handle("DELETE /api/registry/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !reg.Delete(r.PathValue("id")) {
+			http.Error(w, "device not registered", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
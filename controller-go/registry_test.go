@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryEnrollment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	auto, err := parseCIDRs("10.1.0.0/16,192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := NewRegistry(path, true, auto, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	now := time.Now()
+	src := func(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 4000} }
+
+	if reg.Admit("sw-01", src("203.0.113.1"), now) {
+		t.Fatalf("unknown device admitted in strict mode")
+	}
+	reg.Admit("sw-01", src("203.0.113.1"), now)
+	if e, _ := reg.Get("sw-01"); e.Status != registryPending || e.Attempts != 2 || e.Source != "203.0.113.1:4000" {
+		t.Fatalf("unexpected pending entry: %+v", e)
+	}
+	if !reg.Admit("sw-02", src("10.1.2.3"), now) || !reg.Admit("sw-03", src("192.0.2.7"), now) {
+		t.Fatalf("auto-approve CIDR not honoured")
+	}
+	if e, _ := reg.Get("sw-02"); e.Status != registryApproved || e.ApprovedBy != "10.1.0.0/16" {
+		t.Fatalf("unexpected auto-approved entry: %+v", e)
+	}
+	reg.Admit("sw-04", src("203.0.113.1"), now)
+	reg.Admit("sw-05", src("203.0.113.1"), now)
+	if _, ok := reg.Get("sw-05"); ok {
+		t.Fatalf("enrollments beyond --registry-max-pending should not be tracked")
+	}
+
+	state := NewState(5*time.Second, 3, nil, nil)
+	state.Ingest(Msg{DeviceID: "sw-04", Iface: "eth0", TsUnixMs: 1000, Seq: 1})
+	mux := http.NewServeMux()
+	registerRegistryAPI(mux, reg, state, "secret")
+	do := func(method, path string, want int) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("%s %s: status %d, want %d: %s", method, path, rec.Code, want, rec.Body)
+		}
+	}
+	do(http.MethodPost, "/api/registry/sw-01/approve", http.StatusOK)
+	do(http.MethodPost, "/api/registry/sw-04/reject", http.StatusOK)
+	do(http.MethodPost, "/api/registry/nope/approve", http.StatusNotFound)
+	do(http.MethodPut, "/api/registry/sw-06", http.StatusOK)
+	do(http.MethodGet, "/api/registry?status=bogus", http.StatusBadRequest)
+	if !reg.Admit("sw-01", src("203.0.113.1"), now) || !reg.Admit("sw-06", nil, now) {
+		t.Fatalf("approved devices must be admitted")
+	}
+	if reg.Admit("sw-04", src("10.1.2.3"), now) {
+		t.Fatalf("rejected devices must stay rejected, even from an auto-approve CIDR")
+	}
+	if _, ok := state.Devices["sw-04"]; ok {
+		t.Fatalf("rejecting a device should forget its live state")
+	}
+
+	reloaded, err := NewRegistry(path, true, nil, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if got := reloaded.List(registryApproved); len(got) != 4 {
+		t.Fatalf("expected 4 approved devices after reload, got %+v", got)
+	}
+	if e, _ := reloaded.Get("sw-04"); e.Status != registryRejected {
+		t.Fatalf("rejection not persisted: %+v", e)
+	}
+}
+
+func TestRegistryPermissiveModeRecordsOnly(t *testing.T) {
+	reg, err := NewRegistry(filepath.Join(t.TempDir(), "registry.json"), false, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reg.Admit("sw-01", nil, time.Now()) {
+		t.Fatalf("pending devices are ingested outside strict mode")
+	}
+	if e, _ := reg.Get("sw-01"); e.Status != registryPending {
+		t.Fatalf("unknown device should enroll as pending: %+v", e)
+	}
+	if r, _ := NewRegistry("", false, nil, 0, 0); r != nil || !r.Admit("x", nil, time.Now()) {
+		t.Fatalf("a disabled registry admits everything")
+	}
+}
+
+func TestRegistryCapsAutoApprovalAndSavesInBackground(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	auto, err := parseCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := NewRegistry(path, true, auto, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4000}
+	if !reg.Admit("sw-01", src, time.Now()) {
+		t.Fatalf("first device from the CIDR should be auto-approved")
+	}
+	if reg.Admit("sw-02", src, time.Now()) {
+		t.Fatalf("auto-approval beyond --registry-max-auto")
+	}
+	if e, _ := reg.Get("sw-02"); e.Status != registryPending {
+		t.Fatalf("device past the auto-approve cap should enroll as pending: %+v", e)
+	}
+
+	// Admit only queues the write; the saver catches up shortly after
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if strings.Contains(string(data), `"sw-02"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("enrollment not saved in the background: %s", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	reg.Admit("sw-02", src, time.Now())
+	reg.Close()
+	reloaded, err := NewRegistry(path, true, auto, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if e, _ := reloaded.Get("sw-02"); e.Attempts != 2 {
+		t.Fatalf("Close should save the latest attempts: %+v", e)
+	}
+	if reloaded.Admit("sw-03", src, time.Now()) {
+		t.Fatalf("the cap must count auto-approvals loaded from the file")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// FieldAgg summarises one sample field over a rollup bucket.
+type FieldAgg struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Sum  float64 `json:"sum"`
+	Last float64 `json:"last"`
+}
+
+func (f FieldAgg) Avg(count int) float64 {
+	if count == 0 {
+		return 0
+	}
+	return f.Sum / float64(count)
+}
+
+func (f *FieldAgg) add(v float64, first bool) {
+	if first {
+		*f = FieldAgg{Min: v, Max: v, Sum: v, Last: v}
+		return
+	}
+	f.Min = math.Min(f.Min, v)
+	f.Max = math.Max(f.Max, v)
+	f.Sum += v
+	f.Last = v
+}
+
+func (f *FieldAgg) merge(o FieldAgg, first bool) {
+	if first {
+		*f = o
+		return
+	}
+	f.Min = math.Min(f.Min, o.Min)
+	f.Max = math.Max(f.Max, o.Max)
+	f.Sum += o.Sum
+	f.Last = o.Last
+}
+
+// Rollup aggregates every sample of a series whose timestamp falls in
+// [Ts, Ts+step). Utilization only covers samples with a known link speed,
+// UtilCount of them.
+type Rollup struct {
+	Ts        int64    `json:"ts"`
+	Count     int      `json:"count"`
+	Rx        FieldAgg `json:"rx"`
+	Tx        FieldAgg `json:"tx"`
+	Drops     FieldAgg `json:"drops"`
+	Q         FieldAgg `json:"q"`
+	Lat       FieldAgg `json:"lat"`
+	RxUtil    FieldAgg `json:"rx_util"`
+	TxUtil    FieldAgg `json:"tx_util"`
+	UtilCount int      `json:"util_count"`
+	Speed     float64  `json:"speed"` // last known link speed in the bucket
+}
+
+func (r *Rollup) addSample(s Sample) {
+	first := r.Count == 0
+	r.Rx.add(s.Rx, first)
+	r.Tx.add(s.Tx, first)
+	r.Drops.add(float64(s.Drops), first)
+	r.Q.add(float64(s.Q), first)
+	r.Lat.add(s.Lat, first)
+	r.Count++
+	if s.Speed > 0 {
+		first = r.UtilCount == 0
+		r.RxUtil.add(s.RxUtilPct(), first)
+		r.TxUtil.add(s.TxUtilPct(), first)
+		r.UtilCount++
+		r.Speed = s.Speed
+	}
+}
+
+func (r *Rollup) mergeRollup(o Rollup) {
+	if o.Count == 0 {
+		return
+	}
+	first := r.Count == 0
+	r.Rx.merge(o.Rx, first)
+	r.Tx.merge(o.Tx, first)
+	r.Drops.merge(o.Drops, first)
+	r.Q.merge(o.Q, first)
+	r.Lat.merge(o.Lat, first)
+	r.Count += o.Count
+	if o.UtilCount > 0 {
+		first = r.UtilCount == 0
+		r.RxUtil.merge(o.RxUtil, first)
+		r.TxUtil.merge(o.TxUtil, first)
+		r.UtilCount += o.UtilCount
+		r.Speed = o.Speed
+	}
+}
+
+// fields returns the per-field aggregates in queryFields order.
+func (r *Rollup) fields() []*FieldAgg {
+	return []*FieldAgg{&r.Rx, &r.Tx, &r.Drops, &r.Q, &r.Lat, &r.RxUtil, &r.TxUtil}
+}
+
+// Sample flattens a rollup to its per-field averages so callers that only
+// understand raw samples can chart it.
+func (r Rollup) Sample() Sample {
+	return Sample{
+		Ts:    r.Ts,
+		Rx:    r.Rx.Avg(r.Count),
+		Tx:    r.Tx.Avg(r.Count),
+		Drops: uint32(math.Round(r.Drops.Avg(r.Count))),
+		Q:     int32(math.Round(r.Q.Avg(r.Count))),
+		Lat:   r.Lat.Avg(r.Count),
+		Speed: r.Speed,
+	}
+}
+
+// bucketStart floors ts (ms) to the start of its step-sized bucket.
+func bucketStart(ts int64, step time.Duration) int64 {
+	s := step.Milliseconds()
+	if s <= 0 {
+		return ts
+	}
+	return ts - ((ts%s)+s)%s
+}
+
+// rollupSamples buckets time-ordered samples into consecutive rollups.
+func rollupSamples(samples []Sample, step time.Duration) []Rollup {
+	out := make([]Rollup, 0)
+	for _, s := range samples {
+		b := bucketStart(s.Ts, step)
+		if len(out) == 0 || out[len(out)-1].Ts != b {
+			out = append(out, Rollup{Ts: b})
+		}
+		out[len(out)-1].addSample(s)
+	}
+	return out
+}
+
+// mergeRollups re-buckets finer time-ordered rollups into coarser steps.
+func mergeRollups(in []Rollup, step time.Duration) []Rollup {
+	out := make([]Rollup, 0)
+	for _, r := range in {
+		b := bucketStart(r.Ts, step)
+		if len(out) == 0 || out[len(out)-1].Ts != b {
+			out = append(out, Rollup{Ts: b})
+		}
+		out[len(out)-1].mergeRollup(r)
+	}
+	return out
+}
+
+// historyTier is one retention level. The raw tier has a zero step.
+type historyTier struct {
+	name string
+	step time.Duration
+	ttl  time.Duration
+}
+
+// rollup tiers after raw; a tier with a zero ttl is disabled
+var rollupSteps = []struct {
+	name string
+	step time.Duration
+}{
+	{"1m", time.Minute},
+	{"1h", time.Hour},
+}
+
+// buildTiers returns raw plus every enabled rollup tier, finest first.
+func buildTiers(rawTTL time.Duration, rollupTTLs map[string]time.Duration) []historyTier {
+	tiers := []historyTier{{name: "raw", ttl: rawTTL}}
+	for _, rs := range rollupSteps {
+		if ttl := rollupTTLs[rs.name]; ttl > 0 {
+			tiers = append(tiers, historyTier{name: rs.name, step: rs.step, ttl: ttl})
+		}
+	}
+	return tiers
+}
+
+// selectTier returns the index of the coarsest tier whose step still
+// satisfies resolution, i.e. step <= resolution. A zero resolution always
+// means raw (index 0).
+func selectTier(tiers []historyTier, resolution time.Duration) int {
+	best := 0
+	for i, t := range tiers {
+		if t.step <= resolution && t.step > tiers[best].step {
+			best = i
+		}
+	}
+	return best
+}
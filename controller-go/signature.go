@@ -20,6 +20,14 @@ func signingString(m Msg) string {
 		strconv.FormatFloat(m.LatMs, 'f', -1, 64),
 		strconv.FormatUint(m.Seq, 10),
 	}
+	// speed is signed only when present, so older agents keep verifying
+	if m.SpeedBps != 0 {
+		parts = append(parts, strconv.FormatFloat(m.SpeedBps, 'f', -1, 64))
+	}
+	// likewise the backfill flag, which decides whether a sample is live
+	if m.Backfill {
+		parts = append(parts, "backfill")
+	}
 	return strings.Join(parts, "|")
 }
 
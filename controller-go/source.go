@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// SourceInfo is the catalog view of where a device reports from. Times are
+// Unix epoch ms.
+type SourceInfo struct {
+	Address  string   `json:"address"`
+	Since    int64    `json:"since"`
+	Previous string   `json:"previous,omitempty"`
+	Changes  uint64   `json:"changes"`
+	Allowed  []string `json:"allowed,omitempty"` // pinned CIDRs
+	// set while the device is ALERT because its address changed
+	Alert bool `json:"alert,omitempty"`
+}
+
+// sourcePinsLocked returns the CIDRs device id may report from, or nil when
+// it isn't pinned; s.mu must be held.
+func (s *State) sourcePinsLocked(id string) []*net.IPNet {
+	if pins, ok := s.sourcePins[id]; ok {
+		return pins
+	}
+	return s.sourceAllow
+}
+
+// SourceAllowed reports whether device id may report from ip. Unpinned
+// devices may report from anywhere; pinned ones never from an unknown
+// address.
+func (s *State) SourceAllowed(id string, ip net.IP) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pins := s.sourcePinsLocked(id)
+	if len(pins) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range pins {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordSourceLocked notes the address d reported from. Only the IP is
+// compared, as agents pick a new source port when they restart. It returns
+// the event to publish when the address changed; s.mu must be held.
+func (s *State) recordSourceLocked(d *Device, src net.IP, now time.Time) (Event, bool) {
+	if src == nil {
+		return Event{}, false
+	}
+	addr := src.String()
+	if addr == d.Source {
+		return Event{}, false
+	}
+	prev := d.Source
+	d.Source = addr
+	d.SourceSince = now
+	if prev == "" {
+		return Event{}, false
+	}
+	d.PrevSource = prev
+	d.SourceChanges++
+	if s.sourceChangeAlert > 0 {
+		d.sourceAlertUntil = now.Add(s.sourceChangeAlert)
+	}
+	return Event{Kind: "source_changed", Device: d.ID, From: prev, To: addr, T: now.UnixMilli(), Tags: d.Tags, Meta: d.Meta}, true
+}
+
+func (s *State) publishSourceChange(ev Event) {
+	log.Printf("device %s now reports from %s (was %s)", ev.Device, ev.To, ev.From)
+	cSourceChanges.Inc()
+	if s.hub != nil {
+		s.hub.BroadcastEvent(ev)
+	}
+}
+
+// sourceInfoLocked returns d's source view, or nil before its first
+// datagram with a known address; s.mu must be held.
+func (s *State) sourceInfoLocked(d *Device, now time.Time) *SourceInfo {
+	if d.Source == "" {
+		return nil
+	}
+	info := &SourceInfo{
+		Address:  d.Source,
+		Since:    d.SourceSince.UnixMilli(),
+		Previous: d.PrevSource,
+		Changes:  d.SourceChanges,
+		Alert:    now.Before(d.sourceAlertUntil),
+	}
+	for _, n := range s.sourcePinsLocked(d.ID) {
+		info.Allowed = append(info.Allowed, n.String())
+	}
+	return info
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSourcePinning(t *testing.T) {
+	state := NewState(5*time.Second, 3, nil, nil)
+	state.sourceAllow, _ = parseCIDRs("10.0.0.0/8")
+	state.SetInventory(Inventory{Devices: map[string]DeviceInventory{"sw-01": {AllowedSources: []string{"192.0.2.7"}}}})
+
+	for _, tc := range []struct {
+		id, ip string
+		want   bool
+	}{
+		{"sw-01", "192.0.2.7", true},
+		{"sw-01", "10.1.1.1", false}, // the inventory overrides the default
+		{"sw-02", "10.1.1.1", true},
+		{"sw-02", "192.0.2.7", false},
+		{"sw-02", "", false},
+	} {
+		if got := state.SourceAllowed(tc.id, net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("SourceAllowed(%s, %s) = %t, want %t", tc.id, tc.ip, got, tc.want)
+		}
+	}
+	if err := (Inventory{Devices: map[string]DeviceInventory{"sw-01": {AllowedSources: []string{"bogus"}}}}).validate(); err == nil {
+		t.Fatalf("invalid allowed_sources should fail validation")
+	}
+}
+
+func TestSourceChangeAlerts(t *testing.T) {
+	state := NewState(time.Hour, 3, nil, nil)
+	state.sourceChangeAlert = time.Minute
+	msg := Msg{DeviceID: "sw-01", Iface: "eth0", TsUnixMs: 1000, Seq: 1}
+	state.IngestFrom(msg, net.ParseIP("10.0.0.1"))
+	state.IngestFrom(msg, net.ParseIP("10.0.0.1"))
+	now := time.Now()
+	state.evaluateStatuses(now)
+	info, _ := state.DeviceInfo("sw-01")
+	if info.Status != "OK" || info.Source == nil || info.Source.Address != "10.0.0.1" || info.Source.Changes != 0 {
+		t.Fatalf("first address is not a change: %+v %+v", info, info.Source)
+	}
+
+	state.IngestFrom(msg, net.ParseIP("10.0.0.2"))
+	state.evaluateStatuses(now)
+	info, _ = state.DeviceInfo("sw-01")
+	if info.Status != "ALERT" || info.Source.Previous != "10.0.0.1" || info.Source.Changes != 1 || !info.Source.Alert {
+		t.Fatalf("address change should alert: %+v %+v", info, info.Source)
+	}
+	state.evaluateStatuses(now.Add(2 * time.Minute))
+	if state.Devices["sw-01"].Status != "OK" {
+		t.Fatalf("source alert should clear after --source-change-alert")
+	}
+}
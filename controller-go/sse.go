@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sseRecentEvents = 256 // events kept for Last-Event-ID resume
+	sseStreamBuffer = 64  // messages queued per stream before it is dropped
+)
+
+// hubMessage is a broadcast with the id SSE clients resume from. Exactly one
+// of Snapshot and Event is set, except for the reset marker of a stream that
+// resumed too late, which has neither.
+type hubMessage struct {
+	ID       uint64
+	Snapshot *StateSnapshot
+	Event    *Event
+	Reset    bool
+}
+
+// recordLocked numbers msg and keeps what a resuming stream needs: the
+// latest snapshot, which supersedes older ones, and the recent events; h.mu
+// must be held.
+func (h *Hub) recordLocked(msg interface{}) hubMessage {
+	h.seq++
+	hm := hubMessage{ID: h.seq}
+	switch m := msg.(type) {
+	case StateSnapshot:
+		hm.Snapshot = &m
+		h.lastSnap = &hm
+	case Event:
+		hm.Event = &m
+		h.recent = append(h.recent, hm)
+		if n := len(h.recent) - sseRecentEvents; n > 0 {
+			h.dropped = h.recent[n-1].ID
+			h.recent = h.recent[n:]
+		}
+	}
+	return hm
+}
+
+// streamFilter narrows a stream to some devices, with the same id, tag and
+// status parameters as /api/devices. Tags and statuses only apply to
+// snapshots; events are matched by device id.
+type streamFilter struct {
+	IDs      []string // path.Match globs
+	Tags     []string // all of
+	Statuses []string // any of
+}
+
+func parseStreamFilter(params url.Values) streamFilter {
+	f := streamFilter{IDs: listParam(params, "id"), Tags: listParam(params, "tag"), Statuses: listParam(params, "status")}
+	for i, st := range f.Statuses {
+		f.Statuses[i] = strings.ToUpper(st)
+	}
+	return f
+}
+
+func (f streamFilter) empty() bool {
+	return len(f.IDs) == 0 && len(f.Tags) == 0 && len(f.Statuses) == 0
+}
+
+func (f streamFilter) matchDevice(d DeviceSnapshot) bool {
+	if len(f.IDs) > 0 && !matchAny(f.IDs, d.ID) {
+		return false
+	}
+	if len(f.Statuses) > 0 && !containsString(f.Statuses, d.Status) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !containsString(d.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the message as the stream should see it, or false if the
+// stream doesn't want it.
+func (f streamFilter) apply(hm hubMessage) (hubMessage, bool) {
+	if f.empty() || hm.Reset {
+		return hm, true
+	}
+	if hm.Event != nil {
+		return hm, len(f.IDs) == 0 || matchAny(f.IDs, hm.Event.Device)
+	}
+	snap := f.filterSnapshot(*hm.Snapshot)
+	hm.Snapshot = &snap
+	return hm, true
+}
+
+func (f streamFilter) filterSnapshot(snap StateSnapshot) StateSnapshot {
+	out := StateSnapshot{T: snap.T, Devices: []DeviceSnapshot{}}
+	for _, d := range snap.Devices {
+		if f.matchDevice(d) {
+			out.Devices = append(out.Devices, d)
+		}
+	}
+	return out
+}
+
+// stream is one connected SSE client. ch is closed when the client falls
+// too far behind; it then reconnects and resumes from its last id.
+type stream struct {
+	ch     chan hubMessage
+	filter streamFilter
+}
+
+func (h *Hub) publishStreamsLocked(hm hubMessage) {
+	for st := range h.streams {
+		select {
+		case st.ch <- hm:
+		default:
+			log.Printf("sse client too slow, dropping stream")
+			delete(h.streams, st)
+			close(st.ch)
+		}
+	}
+	gStreamClients.Set(float64(len(h.streams)))
+}
+
+// subscribe registers a stream and returns what it missed: the events after
+// lastID and the latest snapshot if newer, in id order. Without a lastID
+// only the latest snapshot is returned. When events after lastID have
+// already left the recent window, the backlog is a reset marker followed by
+// the latest snapshot, so the client knows to rebuild from it.
+func (h *Hub) subscribe(f streamFilter, lastID uint64, resume bool) (*stream, []hubMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var backlog []hubMessage
+	// the events since lastID are gone, or lastID isn't one of ours
+	gap := resume && (lastID < h.dropped || lastID > h.seq)
+	if gap {
+		backlog = append(backlog, hubMessage{Reset: true})
+	} else if resume {
+		for _, hm := range h.recent {
+			if hm.ID > lastID {
+				backlog = append(backlog, hm)
+			}
+		}
+	}
+	if h.lastSnap != nil && (!resume || gap || h.lastSnap.ID > lastID) {
+		// the snapshot goes where its id puts it among the events
+		i := 0
+		for i < len(backlog) && backlog[i].ID < h.lastSnap.ID {
+			i++
+		}
+		backlog = append(backlog[:i], append([]hubMessage{*h.lastSnap}, backlog[i:]...)...)
+	}
+	st := &stream{ch: make(chan hubMessage, sseStreamBuffer), filter: f}
+	h.streams[st] = true
+	gStreamClients.Set(float64(len(h.streams)))
+	return st, backlog
+}
+
+func (h *Hub) unsubscribe(st *stream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.streams[st] {
+		delete(h.streams, st)
+		close(st.ch)
+	}
+	gStreamClients.Set(float64(len(h.streams)))
+}
+
+// writeSSE writes hm as a "state" or "event" SSE message carrying the same
+// JSON as the WebSocket, or as a "reset" message without an id.
+func writeSSE(w http.ResponseWriter, hm hubMessage) error {
+	if hm.Reset {
+		_, err := fmt.Fprintf(w, "event: reset\ndata: {\"type\":\"reset\"}\n\n")
+		return err
+	}
+	name, v := "state", interface{}(hm.Snapshot)
+	if hm.Event != nil {
+		name, v = "event", hm.Event
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", hm.ID, name, data)
+	return err
+}
+
+// ServeSSE streams snapshots and events as Server-Sent Events, for clients
+// behind proxies that break WebSocket upgrades. It takes the id, tag and
+// status filters of /api/devices. A reconnecting client resumes from the
+// Last-Event-ID header, or a lastEventId query parameter.
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	params := r.URL.Query()
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = params.Get("lastEventId")
+	}
+	var lastID uint64
+	resume := last != ""
+	if resume {
+		var err error
+		if lastID, err = strconv.ParseUint(last, 10, 64); err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+	filter := parseStreamFilter(params)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// stop nginx and friends from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	st, backlog := h.subscribe(filter, lastID, resume)
+	defer h.unsubscribe(st)
+	fmt.Fprintf(w, "retry: 3000\n\n")
+	send := func(hm hubMessage) error {
+		if hm, ok := filter.apply(hm); ok {
+			return writeSSE(w, hm)
+		}
+		return nil
+	}
+	for _, hm := range backlog {
+		if err := send(hm); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(h.sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case hm, ok := <-st.ch:
+			if !ok {
+				return
+			}
+			if err := send(hm); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			// a comment line keeps proxies from timing out an idle stream
+			if _, err := fmt.Fprintf(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
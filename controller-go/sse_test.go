@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSSE reads messages from an SSE body until n have arrived, returning
+// each message's id/event/data lines joined by spaces.
+func readSSE(t *testing.T, r *bufio.Reader, n int) []string {
+	t.Helper()
+	var out []string
+	var cur []string
+	for len(out) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v (got %q)", err, out)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if len(cur) > 0 {
+				out = append(out, strings.Join(cur, " "))
+				cur = nil
+			}
+		case strings.HasPrefix(line, ":"), strings.HasPrefix(line, "retry:"):
+		default:
+			cur = append(cur, line)
+		}
+	}
+	return out
+}
+
+func TestSSEStreamResume(t *testing.T) {
+	hub := NewHub()
+	hub.seq, hub.dropped = 0, 0
+	go hub.Run()
+	srv := httptest.NewServer(http.HandlerFunc(hub.ServeSSE))
+	defer srv.Close()
+	waitSeq := func(want uint64) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			hub.mu.Lock()
+			seq := hub.seq
+			hub.mu.Unlock()
+			if seq >= want {
+				return
+			}
+		}
+		t.Fatalf("hub did not reach seq %d", want)
+	}
+	connect := func(query, lastID string) (*bufio.Reader, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+query, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		return bufio.NewReader(resp.Body), cancel
+	}
+
+	snap := StateSnapshot{T: 1, Devices: []DeviceSnapshot{{ID: "sw-01", Status: "OK"}, {ID: "rtr-01", Status: "ALERT"}}}
+	hub.BroadcastState(snap)
+	hub.BroadcastEvent(Event{Kind: "forgotten", Device: "sw-02", Reason: "expired"})
+	waitSeq(2)
+
+	r, cancel := connect("?id=sw-*", "")
+	got := readSSE(t, r, 1)
+	if got[0] != `id: 1 event: state data: {"t":1,"devices":[{"id":"sw-01","status":"OK"}]}` {
+		t.Fatalf("unexpected initial snapshot: %q", got)
+	}
+	hub.BroadcastEvent(Event{Kind: "forgotten", Device: "rtr-01", Reason: "expired"})
+	hub.BroadcastEvent(Event{Kind: "forgotten", Device: "sw-03", Reason: "decommissioned"})
+	got = readSSE(t, r, 1)
+	if !strings.HasPrefix(got[0], "id: 4 event: event ") || !strings.Contains(got[0], `"device":"sw-03"`) {
+		t.Fatalf("expected only the sw-03 event: %q", got)
+	}
+	cancel()
+
+	// resuming after the snapshot replays the events since, unfiltered
+	r, cancel = connect("", "1")
+	defer cancel()
+	got = readSSE(t, r, 3)
+	for i, want := range []string{`id: 2 event: event data: {"type":"event","kind":"forgotten","device":"sw-02"`, "id: 3 ", "id: 4 "} {
+		if !strings.HasPrefix(got[i], want) {
+			t.Fatalf("message %d = %q, want prefix %q", i, got[i], want)
+		}
+	}
+	cancel()
+
+	// once the events after the id have left the window, the stream says so
+	// and starts over from the latest snapshot
+	hub.mu.Lock()
+	for i := 0; i < sseRecentEvents; i++ {
+		hub.recordLocked(Event{Kind: "forgotten", Device: "sw-04"})
+	}
+	hub.mu.Unlock()
+	for _, lastID := range []string{"3", "99999999999999999"} {
+		r, cancel = connect("", lastID)
+		got = readSSE(t, r, 2)
+		cancel()
+		if got[0] != `event: reset data: {"type":"reset"}` || !strings.HasPrefix(got[1], "id: 1 event: state ") {
+			t.Fatalf("resume from %s: expected a reset and the snapshot, got %q", lastID, got)
+		}
+	}
+	// the oldest id still covered resumes as usual
+	r, cancel = connect("", "4")
+	defer cancel()
+	if got = readSSE(t, r, 1); !strings.HasPrefix(got[0], "id: 5 event: event ") {
+		t.Fatalf("resume at the window edge: %q", got)
+	}
+}
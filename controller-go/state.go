@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"log"
+	"net"
 	"sync"
 	"time"
 )
@@ -15,24 +16,70 @@ type Sample struct {
 	Q     int32
 	Lat   float64
 	Seq   uint64
+	Speed float64 // link speed in bps when the sample was taken, 0 if unknown
 }
 
+// utilPct returns bps as a percentage of the link speed, or 0 when the
+// speed is unknown.
+func utilPct(bps, speed float64) float64 {
+	if speed <= 0 {
+		return 0
+	}
+	return bps / speed * 100
+}
+
+func (s Sample) RxUtilPct() float64 { return utilPct(s.Rx, s.Speed) }
+func (s Sample) TxUtilPct() float64 { return utilPct(s.Tx, s.Speed) }
+
 type IfaceState struct {
-	mu       sync.Mutex
-	Last     Sample
-	Buf      []Sample
-	LastSeen time.Time
-	EWMARx   float64
-	EWMATx   float64
-	EWMALat  float64
-	Status   string
-	breaches int
+	mu               sync.Mutex
+	Last             Sample
+	Buf              []Sample
+	FirstSeen        time.Time
+	LastSeen         time.Time
+	Messages         uint64 // live samples received
+	EWMARx           float64
+	EWMATx           float64
+	EWMALat          float64
+	Status           string
+	breaches         int
+	ReportedSpeedBps float64 // last speed reported by the agent
+	// from the inventory
+	SpeedBps    float64 // overrides the reported speed when set
+	Description string
+	Tags        []string
+	Meta        map[string]string
+	// set when restored from a checkpoint, cleared by the next sample
+	restoredAt time.Time
+}
+
+// speed returns the iface's link speed: the inventory's if configured,
+// else the agent's report, else 0.
+func (ifs *IfaceState) speed() float64 {
+	if ifs.SpeedBps > 0 {
+		return ifs.SpeedBps
+	}
+	return ifs.ReportedSpeedBps
 }
 
+// Stale reports whether the iface was restored from a checkpoint and has not
+// reported since.
+func (ifs *IfaceState) Stale() bool { return !ifs.restoredAt.IsZero() }
+
 type Device struct {
-	ID     string
-	Ifaces map[string]*IfaceState
-	Status string // OK/ALERT/OFFLINE
+	ID        string
+	Ifaces    map[string]*IfaceState
+	Status    string // OK/ALERT/OFFLINE
+	FirstSeen time.Time
+	Messages  uint64 // live samples received across ifaces
+	Tags      []string
+	Meta      map[string]string
+	// address the device reports from; see source.go
+	Source           string
+	SourceSince      time.Time
+	PrevSource       string
+	SourceChanges    uint64
+	sourceAlertUntil time.Time
 }
 
 type State struct {
@@ -41,7 +88,19 @@ type State struct {
 	offlineAfter time.Duration
 	hub          *Hub
 	alertConsec  int
+	utilAlertPct float64       // 0 disables the utilization threshold
+	forgetAfter  time.Duration // 0 keeps silent devices forever
 	history      HistoryStore
+	inventory    Inventory
+	// source address pinning: per-device CIDRs from the inventory, else the
+	// --source-allow default
+	sourcePins        map[string][]*net.IPNet
+	sourceAllow       []*net.IPNet
+	sourceChangeAlert time.Duration // how long a device stays ALERT after its address changes
+	// devices changed since the last published snapshot; see publish.go
+	dirtyMu sync.Mutex
+	dirty   map[string]bool
+	dirtyC  chan struct{}
 }
 
 func NewState(offlineAfter time.Duration, alertConsec int, hub *Hub, history HistoryStore) *State {
@@ -57,31 +116,47 @@ func NewState(offlineAfter time.Duration, alertConsec int, hub *Hub, history His
 		hub:          hub,
 		alertConsec:  alertConsec,
 		history:      history,
+		dirty:        make(map[string]bool),
+		dirtyC:       make(chan struct{}, 1),
 	}
 }
 
-func (s *State) Ingest(m Msg) {
+func (s *State) Ingest(m Msg) { s.IngestFrom(m, nil) }
+
+// IngestFrom ingests m received from src, which may be nil when the address
+// is unknown.
+func (s *State) IngestFrom(m Msg, src net.IP) {
+	if m.Backfill {
+		s.ingestBackfill(m)
+		return
+	}
 	s.mu.Lock()
+	now := time.Now()
 	d, ok := s.Devices[m.DeviceID]
 	if !ok {
-		d = &Device{ID: m.DeviceID, Ifaces: make(map[string]*IfaceState), Status: "OK"}
-		s.Devices[m.DeviceID] = d
+		d = s.addDeviceLocked(&Device{ID: m.DeviceID, Status: "OK", FirstSeen: now})
 	}
+	d.Messages++
+	ev, moved := s.recordSourceLocked(d, src, now)
 	ifs, ok := d.Ifaces[m.Iface]
 	if !ok {
-		ifs = &IfaceState{Buf: make([]Sample, 0, 128), Status: "OK"}
-		d.Ifaces[m.Iface] = ifs
+		ifs = s.addIfaceLocked(d, m.Iface, &IfaceState{Buf: make([]Sample, 0, 128), Status: "OK", FirstSeen: now})
 	}
 
 	ifs.mu.Lock()
-	sample := Sample{Ts: m.TsUnixMs, Rx: m.RxBps, Tx: m.TxBps, Drops: m.Drops, Q: m.Q, Lat: m.LatMs, Seq: m.Seq}
+	if m.SpeedBps > 0 {
+		ifs.ReportedSpeedBps = m.SpeedBps
+	}
+	sample := Sample{Ts: m.TsUnixMs, Rx: m.RxBps, Tx: m.TxBps, Drops: m.Drops, Q: m.Q, Lat: m.LatMs, Seq: m.Seq, Speed: ifs.speed()}
 	ifs.Last = sample
 	ifs.Buf = append(ifs.Buf, sample)
 	if len(ifs.Buf) > 128 {
 		copy(ifs.Buf, ifs.Buf[len(ifs.Buf)-128:])
 		ifs.Buf = ifs.Buf[len(ifs.Buf)-128:]
 	}
-	ifs.LastSeen = time.Now()
+	ifs.LastSeen = now
+	ifs.Messages++
+	ifs.restoredAt = time.Time{}
 	// simple EWMA
 	alpha := 0.3
 	if ifs.EWMARx == 0 {
@@ -94,20 +169,56 @@ func (s *State) Ingest(m Msg) {
 		ifs.EWMALat = alpha*sample.Lat + (1-alpha)*ifs.EWMALat
 	}
 	ifs.mu.Unlock()
+	s.mu.Unlock()
+	s.markDirty(m.DeviceID)
 
-	var snap StateSnapshot
-	if s.hub != nil {
-		snap = s.snapshotLocked()
+	if moved {
+		s.publishSourceChange(ev)
 	}
-	s.mu.Unlock()
+	s.storeHistory(m.DeviceID, m.Iface, sample)
+}
 
-	if s.hub != nil {
-		s.hub.BroadcastState(snap)
+// addDeviceLocked registers d, applying its inventory entry; s.mu must be
+// held for writing.
+func (s *State) addDeviceLocked(d *Device) *Device {
+	d.Ifaces = make(map[string]*IfaceState)
+	applyDeviceInventory(d, s.inventory.Devices[d.ID])
+	s.Devices[d.ID] = d
+	return d
+}
+
+func (s *State) addIfaceLocked(d *Device, name string, ifs *IfaceState) *IfaceState {
+	applyIfaceInventory(ifs, s.inventory.Devices[d.ID].Ifaces[name])
+	d.Ifaces[name] = ifs
+	return ifs
+}
+
+// ingestBackfill records a sample an agent buffered while the controller was
+// unreachable. It carries its original timestamp, so it goes to history only
+// and leaves live status, EWMAs and last-seen untouched.
+func (s *State) ingestBackfill(m Msg) {
+	sample := Sample{Ts: m.TsUnixMs, Rx: m.RxBps, Tx: m.TxBps, Drops: m.Drops, Q: m.Q, Lat: m.LatMs, Seq: m.Seq, Speed: s.backfillSpeed(m)}
+	cBackfill.Inc()
+	s.storeHistory(m.DeviceID, m.Iface, sample)
+}
+
+// backfillSpeed picks the link speed for a backfilled sample: the
+// inventory's, else the one the agent sent with it.
+func (s *State) backfillSpeed(m Msg) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if bps := s.inventory.Devices[m.DeviceID].Ifaces[m.Iface].SpeedBps; bps > 0 {
+		return bps
 	}
-	if s.historyEnabled() {
-		if err := s.history.StoreSample(m.DeviceID, m.Iface, sample); err != nil {
-			log.Printf("history store failed: %v", err)
-		}
+	return m.SpeedBps
+}
+
+func (s *State) storeHistory(device, iface string, sample Sample) {
+	if !s.historyEnabled() {
+		return
+	}
+	if err := s.history.StoreSample(device, iface, sample); err != nil {
+		log.Printf("history store failed: %v", err)
 	}
 }
 
@@ -115,26 +226,11 @@ func (s *State) historyEnabled() bool {
 	return s.history != nil && s.history.Enabled()
 }
 
-func (s *State) FetchHistory(device, iface string, since time.Duration) ([]Sample, error) {
+func (s *State) FetchHistory(device, iface string, since, resolution time.Duration) ([]Sample, error) {
 	if !s.historyEnabled() {
 		return nil, errors.New("history disabled")
 	}
-	return s.history.FetchSamples(device, iface, since)
-}
-
-func (s *State) snapshotLocked() StateSnapshot {
-	snap := StateSnapshot{T: time.Now().UnixMilli(), Devices: make([]DeviceSnapshot, 0)}
-	for _, d := range s.Devices {
-		ds := DeviceSnapshot{ID: d.ID, Status: d.Status, Ifaces: make([]IfaceSnapshot, 0)}
-		for name, ifs := range d.Ifaces {
-			ifs.mu.Lock()
-			is := IfaceSnapshot{Name: name, RxBps: ifs.Last.Rx, TxBps: ifs.Last.Tx, Drops: int64(ifs.Last.Drops), Q: int(ifs.Last.Q), LatMs: ifs.Last.Lat, Status: ifs.Status}
-			ifs.mu.Unlock()
-			ds.Ifaces = append(ds.Ifaces, is)
-		}
-		snap.Devices = append(snap.Devices, ds)
-	}
-	return snap
+	return s.history.FetchSamples(device, iface, since, resolution)
 }
 
 // snapshot access for other packages
@@ -146,12 +242,24 @@ type IfaceSnapshot struct {
 	Q      int     `json:"q"`
 	LatMs  float64 `json:"lat_ms"`
 	Status string  `json:"status"`
+	Stale  bool    `json:"stale,omitempty"` // restored from a checkpoint, no fresh data yet
+	// link speed and utilization, omitted while the speed is unknown
+	SpeedBps  float64 `json:"speed_bps,omitempty"`
+	RxUtilPct float64 `json:"rx_util_pct,omitempty"`
+	TxUtilPct float64 `json:"tx_util_pct,omitempty"`
+	// inventory metadata
+	Description string            `json:"description,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
 }
 
 type DeviceSnapshot struct {
-	ID     string          `json:"id"`
-	Status string          `json:"status"`
-	Ifaces []IfaceSnapshot `json:"ifaces,omitempty"`
+	ID     string            `json:"id"`
+	Status string            `json:"status"`
+	Stale  bool              `json:"stale,omitempty"` // every iface is stale
+	Tags   []string          `json:"tags,omitempty"`
+	Meta   map[string]string `json:"meta,omitempty"`
+	Ifaces []IfaceSnapshot   `json:"ifaces,omitempty"`
 }
 
 type StateSnapshot struct {
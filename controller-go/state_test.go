@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type recordingHistory struct {
+	samples []Sample
+}
+
+func (r *recordingHistory) StoreSample(_, _ string, s Sample) error {
+	r.samples = append(r.samples, s)
+	return nil
+}
+func (r *recordingHistory) FetchSamples(string, string, time.Duration, time.Duration) ([]Sample, error) {
+	return r.samples, nil
+}
+func (r *recordingHistory) SampleRange(string, string, time.Time, time.Time, time.Duration) ([]Sample, error) {
+	return r.samples, nil
+}
+func (r *recordingHistory) RollupRange(_, _ string, _, _ time.Time, step time.Duration) ([]Rollup, error) {
+	return rollupSamples(r.samples, step), nil
+}
+func (r *recordingHistory) ListSeries() ([]seriesID, error) {
+	return nil, nil
+}
+func (r *recordingHistory) Enabled() bool { return true }
+func (r *recordingHistory) Close() error  { return nil }
+
+func TestIngestBackfillOnlyWritesHistory(t *testing.T) {
+	hist := &recordingHistory{}
+	state := NewState(5*time.Second, 3, nil, hist)
+
+	live := Msg{DeviceID: "sw-01", Iface: "eth0", TsUnixMs: 2000, RxBps: 10, Seq: 2}
+	state.Ingest(live)
+
+	old := Msg{DeviceID: "sw-01", Iface: "eth0", TsUnixMs: 1000, RxBps: 99, Drops: 500, Seq: 1, Backfill: true}
+	state.Ingest(old)
+	state.Ingest(Msg{DeviceID: "sw-02", Iface: "eth0", TsUnixMs: 1000, Backfill: true})
+
+	if len(hist.samples) != 3 {
+		t.Fatalf("expected 3 history samples, got %d", len(hist.samples))
+	}
+	if _, ok := state.Devices["sw-02"]; ok {
+		t.Fatalf("backfill must not create live devices")
+	}
+	ifs := state.Devices["sw-01"].Ifaces["eth0"]
+	if ifs.Last.Ts != 2000 || ifs.EWMARx != 10 || len(ifs.Buf) != 1 {
+		t.Fatalf("backfill disturbed live state: last=%+v ewma=%v buf=%d", ifs.Last, ifs.EWMARx, len(ifs.Buf))
+	}
+}
+
+func TestSignatureCoversBackfill(t *testing.T) {
+	secret := []byte("s")
+	m := Msg{DeviceID: "sw-01", Iface: "eth0", TsUnixMs: 1000, RxBps: 10, Seq: 1}
+	sig := computeSignature(m, secret)
+	m.Backfill = true
+	if computeSignature(m, secret) == sig {
+		t.Fatalf("flipping backfill kept the signature valid")
+	}
+}
+
+func TestCheckpointRestoreMarksStaleUntilFreshData(t *testing.T) {
+	path := t.TempDir() + "/state.json"
+	src := NewState(5*time.Second, 1, nil, nil)
+	src.Ingest(Msg{DeviceID: "sw-01", Iface: "eth0", TsUnixMs: 1000, RxBps: 10, Drops: 500, Seq: 7})
+	src.Ingest(Msg{DeviceID: "sw-01", Iface: "eth1", TsUnixMs: 1000, RxBps: 20, Seq: 3})
+	src.evaluateStatuses(time.Now())
+	c, err := NewCheckpointer(src, path, time.Hour)
+	if err != nil {
+		t.Fatalf("checkpointer: %v", err)
+	}
+	c.Close() // saves
+
+	dst := NewState(5*time.Second, 1, nil, nil)
+	c, err = NewCheckpointer(dst, path, time.Hour)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	defer c.Close()
+	eth0 := dst.Devices["sw-01"].Ifaces["eth0"]
+	if !eth0.Stale() || eth0.Status != "ALERT" || eth0.EWMARx != 10 || eth0.Last.Seq != 7 || eth0.breaches != 1 {
+		t.Fatalf("unexpected restored iface: %+v", eth0)
+	}
+
+	// stale ifaces keep their status rather than re-counting old breaches
+	now := time.Now()
+	dst.evaluateStatuses(now)
+	snap := dst.Snapshot()
+	if len(snap.Devices) != 1 || !snap.Devices[0].Stale || snap.Devices[0].Status != "ALERT" {
+		t.Fatalf("expected a stale ALERT device, got %+v", snap.Devices)
+	}
+
+	dst.Ingest(Msg{DeviceID: "sw-01", Iface: "eth1", TsUnixMs: 2000, RxBps: 30, Seq: 4})
+	eth1 := dst.Devices["sw-01"].Ifaces["eth1"]
+	if eth1.Stale() || eth1.EWMARx != 0.3*30+0.7*20 {
+		t.Fatalf("fresh sample should clear stale and continue the EWMA: %+v", eth1)
+	}
+	dst.evaluateStatuses(now)
+	snap = dst.Snapshot()
+	if snap.Devices[0].Stale {
+		t.Fatalf("device with a fresh iface still marked stale")
+	}
+
+	// a restored iface that never reports goes offline after offlineAfter
+	if status := evaluateIfaceStatus(eth0, now.Add(6*time.Second), 5*time.Second, 1, 0); status != "OFFLINE" {
+		t.Fatalf("expected OFFLINE for a silent restored iface, got %s", status)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
@@ -10,32 +11,123 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// Event is a change pushed to WebSocket clients between snapshots.
+type Event struct {
+	Type   string `json:"type"` // always "event"
+	Kind   string `json:"kind"` // "forgotten" or "source_changed"
+	Device string `json:"device"`
+	Iface  string `json:"iface,omitempty"`  // forgotten: set when only one iface went
+	Reason string `json:"reason,omitempty"` // forgotten: "expired" or "decommissioned"
+	From   string `json:"from,omitempty"`   // source_changed: previous and new address
+	To     string `json:"to,omitempty"`
+	T      int64  `json:"t"`
+
+	// the device's inventory tags and metadata, so clients can route events
+	Tags []string          `json:"tags,omitempty"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
 type Hub struct {
-	clients   map[*websocket.Conn]bool
+	clients   map[*wsClient]bool
 	mu        sync.Mutex
-	broadcast chan StateSnapshot
+	broadcast chan interface{} // StateSnapshot or Event
+
+	// SSE streams and what they need to resume; see sse.go
+	streams      map[*stream]bool
+	seq          uint64
+	recent       []hubMessage // latest events, oldest first
+	dropped      uint64       // id of the newest event no longer in recent
+	lastSnap     *hubMessage
+	sseHeartbeat time.Duration
+
+	// latest state and the version it last changed at; see delta.go
+	wsState   StateSnapshot
+	wsVersion uint64
+
+	wsQueue        int           // messages queued per client
+	wsWriteTimeout time.Duration // per message write deadline
+	wsPingInterval time.Duration // clients silent for twice this are dropped
+	wsSlowTimeout  time.Duration // how long a client may stay behind
 }
 
 func NewHub() *Hub {
-	return &Hub{clients: make(map[*websocket.Conn]bool), broadcast: make(chan StateSnapshot, 32)}
+	seq := uint64(time.Now().UnixMilli()) * 1000
+	return &Hub{
+		clients:   make(map[*wsClient]bool),
+		broadcast: make(chan interface{}, 32),
+		streams:   make(map[*stream]bool),
+		// ids keep increasing across restarts; a client resuming with an id
+		// from before one missed events this process never had, so it counts
+		// as dropped and the client is told to reset
+		seq:            seq,
+		dropped:        seq,
+		sseHeartbeat:   15 * time.Second,
+		wsState:        StateSnapshot{Devices: []DeviceSnapshot{}},
+		wsQueue:        32,
+		wsWriteTimeout: 10 * time.Second,
+		wsPingInterval: 30 * time.Second,
+		wsSlowTimeout:  30 * time.Second,
+	}
 }
 
 func (h *Hub) Run() {
-	ticker := time.NewTicker(1 * time.Second)
+	// often enough to release updates held back by rate caps and full queues
+	ticker := time.NewTicker(100 * time.Millisecond)
 	for {
 		select {
-		case snap := <-h.broadcast:
+		case msg := <-h.broadcast:
+			h.mu.Lock()
+			hm := h.recordLocked(msg)
+			h.publishStreamsLocked(hm)
+			now := time.Now()
+			if hm.Snapshot != nil {
+				h.updateStateLocked(*hm.Snapshot, hm.ID)
+				for c := range h.clients {
+					h.sendUpdateLocked(c, now)
+				}
+			} else {
+				h.sendEventLocked(*hm.Event, now)
+			}
+			h.mu.Unlock()
+		case now := <-ticker.C:
 			h.mu.Lock()
 			for c := range h.clients {
-				if err := c.WriteJSON(snap); err != nil {
-					log.Printf("ws write err: %v", err)
-					c.Close()
-					delete(h.clients, c)
+				if !c.full() {
+					// drained since, even if nothing was queued after
+					c.slowSince = time.Time{}
+				}
+				if !c.slowSince.IsZero() && now.Sub(c.slowSince) > h.wsSlowTimeout {
+					log.Printf("ws client %s behind for %s, disconnecting", c.conn.RemoteAddr(), h.wsSlowTimeout)
+					cWSSlowDisconnects.Inc()
+					h.removeClientLocked(c)
+					// don't wait for the writer to drain its queue
+					c.conn.Close()
+					continue
+				}
+				switch {
+				case c.needSnapshot:
+					h.sendSnapshotLocked(c)
+				case c.pending:
+					h.sendUpdateLocked(c, now)
 				}
 			}
 			h.mu.Unlock()
-		case <-ticker.C:
-			// heartbeat: could broadcast empty or heartbeat
+		}
+	}
+}
+
+// sendEventLocked queues ev, encoded once, for every client that wants it.
+// Events aren't versioned, so a client without room misses them; h.mu must
+// be held.
+func (h *Hub) sendEventLocked(ev Event, now time.Time) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("ws event encode err: %v", err)
+		return
+	}
+	for c := range h.clients {
+		if c.sub.matchEvent(ev) && !c.queueLocked(data, now) {
+			cWSDropped.WithLabelValues("event").Inc()
 		}
 	}
 }
@@ -47,21 +139,57 @@ func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
 		log.Printf("ws upgrade err: %v", err)
 		return
 	}
+	client := &wsClient{conn: c, send: make(chan []byte, h.wsQueue)}
+	// the initial snapshot is queued under h.mu so no delta can overtake it
 	h.mu.Lock()
-	h.clients[c] = true
+	h.sendSnapshotLocked(client)
+	h.clients[client] = true
+	gWSClients.Set(float64(len(h.clients)))
 	h.mu.Unlock()
-	// send initial state on connect if available
-	// keep reader to detect close
-	go func() {
-		defer func() { c.Close(); h.mu.Lock(); delete(h.clients, c); h.mu.Unlock() }()
-		for {
-			var v interface{}
-			if err := c.ReadJSON(&v); err != nil {
-				// client closed or sent invalid
-				return
+	go client.writeLoop(h.wsWriteTimeout, h.wsPingInterval)
+
+	// reads: client messages, and pongs that prove the client is alive
+	defer func() {
+		h.mu.Lock()
+		h.removeClientLocked(client)
+		h.mu.Unlock()
+	}()
+	pongWait := 2 * h.wsPingInterval
+	c.SetReadLimit(64 << 10)
+	c.SetReadDeadline(time.Now().Add(pongWait))
+	c.SetPongHandler(func(string) error { return c.SetReadDeadline(time.Now().Add(pongWait)) })
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			// client closed, went quiet or broke the protocol
+			return
+		}
+		c.SetReadDeadline(time.Now().Add(pongWait))
+		var m clientMessage
+		decodeErr := json.Unmarshal(data, &m)
+		h.mu.Lock()
+		// skipped once dropped as slow
+		if h.clients[client] {
+			if decodeErr != nil {
+				// a bad frame is answered, not fatal
+				replyErrorLocked(client, fmt.Errorf("invalid message: %v", decodeErr))
+			} else {
+				h.handleClientMessageLocked(client, m)
 			}
 		}
-	}()
+		h.mu.Unlock()
+	}
+}
+
+// removeClientLocked forgets c and closes its queue, which makes its writer
+// close the connection; h.mu must be held.
+func (h *Hub) removeClientLocked(c *wsClient) {
+	if !h.clients[c] {
+		return
+	}
+	delete(h.clients, c)
+	close(c.send)
+	gWSClients.Set(float64(len(h.clients)))
 }
 
 func (h *Hub) BroadcastState(s StateSnapshot) {
@@ -73,6 +201,16 @@ func (h *Hub) BroadcastState(s StateSnapshot) {
 	}
 }
 
+// BroadcastEvent queues ev for every client. Events carry "type": "event".
+func (h *Hub) BroadcastEvent(ev Event) {
+	ev.Type = "event"
+	select {
+	case h.broadcast <- ev:
+	default:
+		log.Printf("broadcast channel full, dropping %s event", ev.Kind)
+	}
+}
+
 // helper to marshal snapshot (unused but handy)
 func marshalSnapshot(s StateSnapshot) []byte {
 	b, _ := json.Marshal(s)
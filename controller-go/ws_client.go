@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsClient is one WebSocket connection, its subscription and the filtered
+// state it holds, which its deltas are computed against. The hub queues
+// encoded messages on send without blocking; writeLoop is the connection's
+// only writer. Fields other than conn and send are guarded by Hub.mu.
+type wsClient struct {
+	conn *websocket.Conn
+	send chan []byte
+
+	sub      wsSubscription
+	sent     StateSnapshot
+	version  uint64
+	lastSend time.Time
+	// an update is held back by the rate cap or a full queue; the hub sends
+	// one delta covering everything once it can
+	pending      bool
+	needSnapshot bool      // a snapshot is owed but didn't fit
+	slowSince    time.Time // when the queue was first found full, zero once it drains
+}
+
+// full reports whether the queue has no room; only the hub adds to it, so
+// room found under Hub.mu is still there when it queues.
+func (c *wsClient) full() bool { return len(c.send) == cap(c.send) }
+
+// behindLocked notes that c couldn't take a message; h.mu must be held.
+func (c *wsClient) behindLocked(now time.Time) {
+	if c.slowSince.IsZero() {
+		c.slowSince = now
+	}
+}
+
+// roomLocked reports whether c's queue has room. A full queue starts the
+// slow clock; room stops it, whether or not anything is queued next. h.mu
+// must be held.
+func (c *wsClient) roomLocked(now time.Time) bool {
+	if c.full() {
+		c.behindLocked(now)
+		return false
+	}
+	c.slowSince = time.Time{}
+	return true
+}
+
+// queueLocked queues an encoded message, reporting false when the queue is
+// full; Hub.mu must be held.
+func (c *wsClient) queueLocked(data []byte, now time.Time) bool {
+	select {
+	case c.send <- data:
+		c.slowSince = time.Time{}
+		return true
+	default:
+		c.behindLocked(now)
+		return false
+	}
+}
+
+func (c *wsClient) queueJSONLocked(v interface{}, now time.Time) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("ws encode err: %v", err)
+		return true
+	}
+	return c.queueLocked(data, now)
+}
+
+// writeLoop writes queued messages with a deadline each and pings the
+// client every pingInterval. It closes the connection when the queue is
+// closed or a write fails, which also ends the read loop in ServeWS.
+func (c *wsClient) writeLoop(writeTimeout, pingInterval time.Duration) {
+	ping := time.NewTicker(pingInterval)
+	defer func() {
+		ping.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("ws write err: %v", err)
+				return
+			}
+		case <-ping.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("ws ping err: %v", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+const maxClientRate = 50 // updates per second a client may ask for
+
+// clientMessage is what WebSocket clients send:
+//
+//	{"type":"resync"}
+//	{"type":"subscribe","devices":["dc1-*"],"tags":["core"],"status":["ALERT"],"max_rate":1}
+//	{"type":"unsubscribe","devices":["dc1-sw-07"]}
+type clientMessage struct {
+	Type    string   `json:"type"`
+	Devices []string `json:"devices"` // ids or path.Match globs
+	Tags    []string `json:"tags"`
+	Status  []string `json:"status"`
+	MaxRate *float64 `json:"max_rate"` // updates per second, 0 uncapped
+}
+
+// wsSubscription is what one client wants to hear about. It starts with
+// every device. Subscribing to devices narrows that to the ones named and
+// later subscriptions add to them; tags and status replace the current
+// filters. Unsubscribing removes devices, tags or statuses, and without any
+// of them stops updates altogether. Devices unsubscribed while following
+// every device are left out of it instead; subscribing to just those again
+// brings them back.
+type wsSubscription struct {
+	filter  streamFilter
+	exclude []string // ids or globs left out of every device
+	none    bool     // unsubscribed from every device
+	MaxRate float64
+}
+
+func (s wsSubscription) view(snap StateSnapshot) StateSnapshot {
+	if s.none {
+		return StateSnapshot{T: snap.T, Devices: []DeviceSnapshot{}}
+	}
+	view := s.filter.filterSnapshot(snap)
+	if len(s.exclude) > 0 {
+		kept := view.Devices[:0]
+		for _, d := range view.Devices {
+			if !matchAny(s.exclude, d.ID) {
+				kept = append(kept, d)
+			}
+		}
+		view.Devices = kept
+	}
+	return view
+}
+
+// matchEvent reports whether the client wants ev; like SSE streams, events
+// are matched by device id only.
+func (s wsSubscription) matchEvent(ev Event) bool {
+	if s.none || matchAny(s.exclude, ev.Device) {
+		return false
+	}
+	return len(s.filter.IDs) == 0 || matchAny(s.filter.IDs, ev.Device)
+}
+
+func (s *wsSubscription) subscribe(m clientMessage) error {
+	for _, p := range m.Devices {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid device pattern %q", p)
+		}
+	}
+	statuses, err := parseStatuses(m.Status)
+	if err != nil {
+		return err
+	}
+	if m.MaxRate != nil && (*m.MaxRate < 0 || *m.MaxRate > maxClientRate) {
+		return fmt.Errorf("max_rate must be between 0 and %d", maxClientRate)
+	}
+	lifted := len(s.filter.IDs) == 0 && len(m.Devices) > 0
+	for _, p := range m.Devices {
+		lifted = lifted && containsString(s.exclude, p)
+	}
+	switch {
+	case lifted:
+		// back into every device rather than narrowing to these
+		s.exclude = removeStrings(s.exclude, m.Devices)
+	case len(m.Devices) > 0:
+		if s.none {
+			s.filter.IDs, s.exclude, s.none = nil, nil, false
+		}
+		s.exclude = removeStrings(s.exclude, m.Devices)
+		for _, p := range m.Devices {
+			if !containsString(s.filter.IDs, p) {
+				s.filter.IDs = append(s.filter.IDs, p)
+			}
+		}
+	}
+	if m.Tags != nil {
+		s.filter.Tags = append([]string(nil), m.Tags...)
+	}
+	if m.Status != nil {
+		s.filter.Statuses = statuses
+	}
+	if m.MaxRate != nil {
+		s.MaxRate = *m.MaxRate
+	}
+	return nil
+}
+
+func (s *wsSubscription) unsubscribe(m clientMessage) error {
+	for _, p := range m.Devices {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid device pattern %q", p)
+		}
+	}
+	statuses, err := parseStatuses(m.Status)
+	if err != nil {
+		return err
+	}
+	if m.Devices == nil && m.Tags == nil && m.Status == nil {
+		s.filter.IDs, s.exclude, s.none = nil, nil, true
+		return nil
+	}
+	switch {
+	case len(m.Devices) == 0 || s.none:
+	case len(s.filter.IDs) == 0 && containsString(m.Devices, "*"):
+		s.exclude, s.none = nil, true
+	case len(s.filter.IDs) == 0:
+		// following every device: leave these out of it
+		for _, p := range m.Devices {
+			if !containsString(s.exclude, p) {
+				s.exclude = append(s.exclude, p)
+			}
+		}
+	default:
+		s.filter.IDs = removeStrings(s.filter.IDs, m.Devices)
+		if len(s.filter.IDs) == 0 {
+			// nothing left to follow; an empty list would mean everything
+			s.filter.IDs, s.exclude, s.none = nil, nil, true
+		}
+	}
+	s.filter.Tags = removeStrings(s.filter.Tags, m.Tags)
+	s.filter.Statuses = removeStrings(s.filter.Statuses, statuses)
+	return nil
+}
+
+func parseStatuses(in []string) ([]string, error) {
+	out := make([]string, 0, len(in))
+	for _, st := range in {
+		st = strings.ToUpper(st)
+		switch st {
+		case "OK", "ALERT", "OFFLINE":
+		default:
+			return nil, fmt.Errorf("unknown status %q", st)
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+func removeStrings(list, drop []string) []string {
+	var out []string
+	for _, v := range list {
+		if !containsString(drop, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// handleClientMessageLocked acts on a message from c. Subscription changes
+// are answered with a snapshot of the new view, errors with
+// {"type":"error"}; h.mu must be held.
+func (h *Hub) handleClientMessageLocked(c *wsClient, m clientMessage) {
+	var err error
+	switch m.Type {
+	case "resync":
+		// the client saw a gap in delta versions
+		h.sendSnapshotLocked(c)
+		return
+	case "subscribe":
+		err = c.sub.subscribe(m)
+	case "unsubscribe":
+		err = c.sub.unsubscribe(m)
+	default:
+		err = fmt.Errorf("unknown message type %q", m.Type)
+	}
+	if err != nil {
+		replyErrorLocked(c, err)
+		return
+	}
+	h.sendSnapshotLocked(c)
+}
+
+// replyErrorLocked tells c its last message was rejected; h.mu must be held.
+func replyErrorLocked(c *wsClient, err error) {
+	c.queueJSONLocked(map[string]string{"type": "error", "error": err.Error()}, time.Now())
+}
@@ -1,6 +1,6 @@
 import React, {useEffect, useMemo, useRef, useState} from 'react'
 import {createRoot} from 'react-dom/client'
-import {connectWS, inferHttpOrigin} from './ws'
+import {applyDelta, connectWS, inferHttpOrigin, subscriptionFromURL} from './ws'
 import DeviceCard from './DeviceCard'
 import PacketFlowAnimation from './PacketFlowAnimation'
 import './styles.css'
@@ -27,19 +27,38 @@ function App(){
 
   const demoTimerRef = useRef(null)
   const receivedRealData = useRef(false)
+  const versionRef = useRef(null)
 
   useEffect(()=>{
     const ws = connectWS('/ws')
     ws.onmessage = (ev)=>{
       try{
         const msg = JSON.parse(ev.data)
-        setState(msg)
+        // events (e.g. a forgotten device) are reflected by the next delta
+        if (msg.type === 'event') return
+        if (msg.type === 'delta'){
+          // waiting for a snapshot
+          if (versionRef.current === null) return
+          if (msg.base !== versionRef.current){
+            // missed an update: ask for a fresh snapshot, skip until it comes
+            versionRef.current = null
+            ws.send(JSON.stringify({type:'resync'}))
+            return
+          }
+          versionRef.current = msg.version
+          setState(prev => applyDelta(prev, msg))
+        } else {
+          versionRef.current = msg.version ?? null
+          setState({t: msg.t, devices: msg.devices ?? []})
+        }
         receivedRealData.current = true
         if (demoMode) stopDemo()
       }catch(e){ console.error(e) }
     }
     ws.onopen = ()=> {
       if (demoMode) stopDemo()
+      const sub = subscriptionFromURL()
+      if (sub) ws.send(JSON.stringify(sub))
     }
     const activateDemo = ()=>{
       if (!receivedRealData.current) startDemo()
@@ -76,9 +76,18 @@ export default function DeviceCard({d, controllerOrigin, demoMode}){
         <div className="device-card__title">
           <span>Device</span>
           <strong>{d.id}</strong>
+          {(d.meta?.site || d.meta?.role || d.tags?.length > 0) && (
+            <div className="device-card__meta">
+              {[d.meta?.site, d.meta?.role].filter(Boolean).join(' · ')}
+              {d.tags?.map(tag => <span key={tag} className="tag">{tag}</span>)}
+            </div>
+          )}
         </div>
-        <div className={`device-card__badge ${badgeClass}`}>
-          {d.status || 'OK'}
+        <div
+          className={`device-card__badge ${badgeClass}${d.stale ? ' badge--stale' : ''}`}
+          title={d.stale ? 'Restored after a controller restart; no fresh data yet' : undefined}
+        >
+          {d.status || 'OK'}{d.stale ? ' · stale' : ''}
         </div>
       </div>
 
@@ -105,12 +114,12 @@ export default function DeviceCard({d, controllerOrigin, demoMode}){
         {d.ifaces && d.ifaces.map(ifc => (
           <div key={ifc.name} className="iface-row">
             <div className="iface-row__header">
-              <h4>{ifc.name}</h4>
-              <div className="iface-row__badge">{ifc.status || 'OK'}</div>
+              <h4 title={ifc.description || undefined}>{ifc.name}</h4>
+              <div className={`iface-row__badge${ifc.stale ? ' badge--stale' : ''}`}>{ifc.status || 'OK'}{ifc.stale ? ' · stale' : ''}</div>
             </div>
             <div className="iface-row__stats">
-              <div>rx · {formatMbps(ifc.rx_bps)} Mbps</div>
-              <div>tx · {formatMbps(ifc.tx_bps)} Mbps</div>
+              <div>rx · {formatMbps(ifc.rx_bps)} Mbps{ifc.speed_bps ? ` (${(ifc.rx_util_pct || 0).toFixed(1)}%)` : ''}</div>
+              <div>tx · {formatMbps(ifc.tx_bps)} Mbps{ifc.speed_bps ? ` (${(ifc.tx_util_pct || 0).toFixed(1)}%)` : ''}</div>
               <div>drops · {ifc.drops}</div>
               <div>queue · {ifc.q}</div>
               <div>latency · {ifc.lat_ms?.toFixed(2)} ms</div>
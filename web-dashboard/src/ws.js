@@ -38,3 +38,34 @@ export function connectWS(path){
   ws.onerror = (e)=> console.error('ws err', e)
   return ws
 }
+
+// applyDelta merges a controller delta into a snapshot-shaped state
+// ({t, devices}); see controller-go/delta.go
+export function applyDelta(state, delta){
+  const removed = new Set(delta.removed ?? [])
+  const byId = new Map((state.devices ?? []).filter(d => !removed.has(d.id)).map(d => [d.id, d]))
+  for (const dd of delta.devices ?? []){
+    const prev = byId.get(dd.id)
+    const gone = new Set(dd.removed_ifaces ?? [])
+    const ifaces = new Map((prev?.ifaces ?? []).filter(i => !gone.has(i.name)).map(i => [i.name, i]))
+    for (const ifc of dd.ifaces ?? []) ifaces.set(ifc.name, ifc)
+    const {removed_ifaces, ...header} = dd
+    byId.set(dd.id, {...header, ifaces: [...ifaces.values()]})
+  }
+  return {t: delta.t, devices: [...byId.values()]}
+}
+
+// subscriptionFromURL builds a subscribe message from the page's query
+// string, e.g. ?devices=dc1-*&tags=core&status=ALERT&max_rate=1, so a NOC
+// screen can follow one site. Returns null when none is given.
+export function subscriptionFromURL(search = window.location.search){
+  const params = new URLSearchParams(search)
+  const list = (name)=> params.getAll(name).flatMap(v => v.split(',')).map(v => v.trim()).filter(Boolean)
+  const sub = {type: 'subscribe'}
+  for (const name of ['devices', 'tags', 'status']){
+    const values = list(name)
+    if (values.length) sub[name] = values
+  }
+  if (params.has('max_rate')) sub.max_rate = Number(params.get('max_rate'))
+  return Object.keys(sub).length > 1 ? sub : null
+}